@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+	"uiserver/lib"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Records a query submitted by the user in the audit log, event is AuditSubmit or AuditProfile.
+func auditSubmit(c *gin.Context, config *lib.Config, event string, req *SubmitRequest, start time.Time, resultCount int, err error) {
+	entry := lib.AuditEntry{
+		Event:       event,
+		Backend:     req.Backend,
+		RequestID:   req.RequestId,
+		Query:       req.Query,
+		DurationMs:  time.Since(start).Milliseconds(),
+		ResultCount: resultCount,
+	}
+	if len(req.Bindings) > 0 {
+		entry.Bindings = req.Bindings
+	}
+	if backend, backendErr := config.Backend(req.Backend); backendErr == nil {
+		entry.Backend = backend.Name
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	lib.Audit(c, entry)
+}
+
+func auditHandler(c *gin.Context) {
+	if lib.CurrentRole(c) != lib.RoleAdmin {
+		c.JSON(http.StatusForbidden, "Admin role required")
+		return
+	}
+	v, exists := c.Get("audit")
+	if !exists {
+		c.JSON(http.StatusNotFound, "Audit log is disabled")
+		return
+	}
+	auditLog := v.(*lib.AuditLog)
+
+	filter := lib.AuditFilter{Username: c.Query("user"), Event: c.Query("event")}
+	var err error
+	if from := c.Query("from"); from != "" {
+		if filter.From, err = time.Parse(time.RFC3339, from); err != nil {
+			c.JSON(http.StatusBadRequest, "Invalid from, expected an RFC 3339 time")
+			return
+		}
+	}
+	if to := c.Query("to"); to != "" {
+		if filter.To, err = time.Parse(time.RFC3339, to); err != nil {
+			c.JSON(http.StatusBadRequest, "Invalid to, expected an RFC 3339 time")
+			return
+		}
+	}
+	filter.Limit, err = strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || filter.Limit <= 0 {
+		c.JSON(http.StatusBadRequest, "Invalid limit")
+		return
+	}
+
+	entries, err := auditLog.Query(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, entries)
+}
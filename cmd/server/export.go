@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+	"uiserver/lib"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Either a query, or the ids of vertices and edges to export with their elementMap().
+type ExportRequest struct {
+	// csv, jsonl, graphml or gexf.
+	Format   string                     `json:"format"`
+	Query    string                     `json:"query"`
+	Bindings map[string]json.RawMessage `json:"bindings"`
+	IDs      *struct {
+		Vertices []json.RawMessage `json:"vertices"`
+		Edges    []json.RawMessage `json:"edges"`
+	} `json:"ids"`
+	Backend string `json:"backend"`
+	// Name of the downloaded file, without the extension.
+	Filename string `json:"filename"`
+}
+
+var unsafeFilenameRe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func exportFilename(req *ExportRequest) string {
+	name := unsafeFilenameRe.ReplaceAllString(req.Filename, "_")
+	if name == "" || name == "." || name == ".." {
+		name = "export"
+	}
+	return name + "." + req.Format
+}
+
+func exportHandler(c *gin.Context) {
+	v, exists := c.Get("conf")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, "Cannot load config")
+		return
+	}
+	config := v.(*lib.Config)
+
+	var req ExportRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, "Invalid request")
+		return
+	}
+	contentType, ok := lib.ExportContentType(req.Format)
+	if !ok {
+		c.JSON(http.StatusBadRequest, fmt.Sprintf("Invalid format: %q, expected csv, jsonl, graphml or gexf", req.Format))
+		return
+	}
+	if (req.Query == "") == (req.IDs == nil) {
+		c.JSON(http.StatusBadRequest, "Invalid request: either query or ids is required")
+		return
+	}
+	if req.IDs != nil && len(req.IDs.Vertices)+len(req.IDs.Edges) > config.Export.MaxIDs {
+		c.JSON(http.StatusBadRequest, fmt.Sprintf("Invalid request: more than %d ids", config.Export.MaxIDs))
+		return
+	}
+	backend, err := config.Backend(req.Backend)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+
+	export, err := lib.NewExport(req.Format, config.Export, c.Writer, func() {
+		c.Header("Content-Type", contentType)
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, exportFilename(&req)))
+		c.Status(http.StatusOK)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer export.Close()
+
+	start := time.Now()
+	entry := lib.AuditEntry{Event: lib.AuditExport, Backend: backend.Name, Query: req.Query}
+	if req.Query != "" {
+		if len(req.Bindings) > 0 {
+			entry.Bindings = req.Bindings
+		}
+		submit := SubmitRequest{Query: req.Query, Bindings: req.Bindings, Backend: backend.Name}
+		var query lib.QueryRequest
+		query, err = submit.toQueryRequest(config)
+		if err != nil {
+			err = &lib.QueryError{Status: http.StatusBadRequest, Message: fmt.Sprintf("Invalid request: %v", err)}
+		} else {
+			_, err = lib.SubmitStream(c, config, query, export.Add)
+		}
+	} else {
+		entry.Query = "g.V(ids).elementMap(), g.E(ids).elementMap()"
+		entry.Bindings = req.IDs
+		err = exportElements(c, config, backend, export, "V", req.IDs.Vertices)
+		if err == nil {
+			err = exportElements(c, config, backend, export, "E", req.IDs.Edges)
+		}
+	}
+	entry.DurationMs = time.Since(start).Milliseconds()
+	entry.ResultCount = export.Count
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	lib.Audit(c, entry)
+	if err != nil && !export.Started() {
+		respondQueryError(c, err)
+		return
+	}
+	if err == nil {
+		err = export.Finish()
+	}
+	if err != nil {
+		logrus.Errorf("unable to write export: %v", err)
+		abortResponse(c)
+	}
+}
+
+// Set on the requests whose response is aborted, see abortResponse.
+const abortResponseKey = "abortResponse"
+
+// Aborts a response which failed after its first bytes, so that the client sees a truncated download instead of a
+// complete file.
+func abortResponse(c *gin.Context) {
+	c.Set(abortResponseKey, true)
+	c.Abort()
+}
+
+// abortMiddleware ends the responses aborted by abortResponse with http.ErrAbortHandler: net/http closes the HTTP/1.1
+// connection, or resets the HTTP/2 stream. The panic is raised outside of gin.Recovery, which would swallow it.
+func abortMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		if c.GetBool(abortResponseKey) {
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// Fetches the elementMap() of the elements in batches of the prefetch batch size.
+func exportElements(c *gin.Context, config *lib.Config, backend *lib.Backend, export *lib.Export, elementType string, ids []json.RawMessage) error {
+	batchSize := config.Prefetch.BatchSize
+	for start := 0; start < len(ids); start += batchSize {
+		end := start + batchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		result, err := getProps(c, config, backend, elementType, ids[start:end])
+		if err != nil {
+			return err
+		}
+		if err := export.Add(result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
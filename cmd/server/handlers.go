@@ -2,23 +2,46 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"strings"
+	"strconv"
 	"sync"
+	"time"
 	"uiserver/lib"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 )
 
 type ServerStatus struct {
+	// Url and health of the default backend.
 	GremlinServer    string
 	GremlinHealthy   string
+	Backends         []BackendStatus
 	PrefetchPageSize int
 	WatermarkText    string
 }
 
+type BackendStatus struct {
+	Name    string
+	Url     string
+	Healthy string
+}
+
+func backendHealth(c *gin.Context, config *lib.Config, backend *lib.Backend) string {
+	ok, err := lib.Healthcheck(c, config, backend)
+	if !ok {
+		if err != nil {
+			logrus.Infof("Healthcheck error on backend %s: %v", backend.Name, err)
+			return "Error"
+		}
+		return "Empty"
+	}
+	return "OK"
+}
+
 func statusHandler(c *gin.Context) {
 	v, exists := c.Get("conf")
 	if !exists {
@@ -26,29 +49,70 @@ func statusHandler(c *gin.Context) {
 	}
 	config := v.(*lib.Config)
 
-	result := "OK"
-	ok, err := lib.Healthcheck(c, config)
-	if !ok {
-		if err != nil {
-			logrus.Infof("Healthcheck error: %v", err)
-			result = "Error"
-		} else {
-			result = "Empty"
-		}
+	backends := config.AllBackends()
+	statuses := make([]BackendStatus, len(backends))
+	var wg sync.WaitGroup
+	wg.Add(len(backends))
+	for i, backend := range backends {
+		go func(i int, backend *lib.Backend) {
+			defer wg.Done()
+			statuses[i] = BackendStatus{Name: backend.Name, Url: backend.WsUrl(), Healthy: backendHealth(c, config, backend)}
+		}(i, backend)
 	}
+	wg.Wait()
 
-	url := lib.GetWsUrl(config)
 	status := ServerStatus{
-		GremlinServer:    url,
-		GremlinHealthy:   result,
+		GremlinServer:    statuses[0].Url,
+		GremlinHealthy:   statuses[0].Healthy,
+		Backends:         statuses,
 		PrefetchPageSize: config.Prefetch.BatchCount * config.Prefetch.BatchSize,
 		WatermarkText:    config.Customization.Watermark,
 	}
 	c.JSON(http.StatusOK, status)
 }
 
+type BackendInfo struct {
+	Name    string `json:"name"`
+	Url     string `json:"url"`
+	Auth    string `json:"auth"`
+	Default bool   `json:"default"`
+}
+
+func backendsHandler(c *gin.Context) {
+	v, exists := c.Get("conf")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, "Cannot load config")
+		return
+	}
+	config := v.(*lib.Config)
+
+	backends := []BackendInfo{}
+	for i, backend := range config.AllBackends() {
+		backends = append(backends, BackendInfo{Name: backend.Name, Url: backend.WsUrl(), Auth: backend.Auth, Default: i == 0})
+	}
+	c.JSON(http.StatusOK, backends)
+}
+
 type SubmitRequest struct {
 	Query string `json:"query"`
+	// Optional client generated UUID, which can be used to cancel the query.
+	RequestId string `json:"requestId"`
+	// Optional query bindings, plain JSON or typed GraphSON values.
+	Bindings map[string]json.RawMessage `json:"bindings"`
+	// Optional backend name, the default backend when empty.
+	Backend string `json:"backend"`
+}
+
+func (req *SubmitRequest) toQueryRequest(config *lib.Config) (lib.QueryRequest, error) {
+	backend, err := config.Backend(req.Backend)
+	if err != nil {
+		return lib.QueryRequest{}, err
+	}
+	bindings, err := lib.ParseBindings(backend, req.Bindings)
+	if err != nil {
+		return lib.QueryRequest{}, err
+	}
+	return lib.QueryRequest{Query: req.Query, Backend: req.Backend, RequestID: req.RequestId, Bindings: bindings}, nil
 }
 
 func submitHandler(c *gin.Context) {
@@ -64,9 +128,22 @@ func submitHandler(c *gin.Context) {
 		return
 	}
 
-	response, err := lib.Submit(c, config, req.Query)
+	query, err := req.toQueryRequest(config)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, fmt.Sprintf("gremlin query error: %v", err))
+		c.JSON(http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+
+	start := time.Now()
+	response, err := lib.Submit(c, config, query)
+	resultCount := 0
+	if response != nil {
+		resultCount = len(response.Value)
+	}
+	recordHistory(c, &req, start, resultCount, err)
+	auditSubmit(c, config, lib.AuditSubmit, &req, start, resultCount, err)
+	if err != nil {
+		respondQueryError(c, err)
 		return
 	}
 
@@ -79,6 +156,146 @@ func submitHandler(c *gin.Context) {
 	c.Data(http.StatusOK, "application/json", responseBytes)
 }
 
+// Runs the query with profile() and explain(), the query is not recorded in the history.
+func profileHandler(c *gin.Context) {
+	v, exists := c.Get("conf")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, "Cannot load config")
+		return
+	}
+	config := v.(*lib.Config)
+
+	var req SubmitRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	query, err := req.toQueryRequest(config)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+
+	start := time.Now()
+	profile, err := lib.ProfileQuery(c, config, query)
+	resultCount := 0
+	if profile != nil {
+		resultCount = len(profile.Metrics.Steps)
+	}
+	auditSubmit(c, config, lib.AuditProfile, &req, start, resultCount, err)
+	if err != nil {
+		respondQueryError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, profile)
+}
+
+// Responds with the JSON error of a failed query, with the Retry-After of the queries rejected by a limit.
+func respondQueryError(c *gin.Context, err error) {
+	queryError := lib.NewQueryError(err)
+	if queryError.RetryAfter > 0 {
+		c.Header("Retry-After", strconv.Itoa(queryError.RetryAfter))
+	}
+	c.JSON(queryError.Status, queryError)
+}
+
+// One line of the newline-delimited JSON returned by /submit/stream. Each partial response of the gremlin server is
+// sent as a "batch" line, the last line is always a "trailer" with the status attributes or the error.
+type StreamMessage struct {
+	Type       string                 `json:"type"`
+	Data       *lib.GsonResponse      `json:"data,omitempty"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      *lib.QueryError        `json:"error,omitempty"`
+}
+
+func submitStreamHandler(c *gin.Context) {
+	v, exists := c.Get("conf")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, "Cannot load config")
+		return
+	}
+	config := v.(*lib.Config)
+
+	var req SubmitRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	if req.RequestId == "" {
+		req.RequestId = uuid.NewString()
+	}
+	query, err := req.toQueryRequest(config)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+
+	c.Header("X-Request-Id", req.RequestId)
+	// The slot is taken before the response starts, a query over the limits still gets a 429.
+	start := time.Now()
+	release, err := lib.AcquireQuerySlot(c, config)
+	if err != nil {
+		recordHistory(c, &req, start, 0, err)
+		auditSubmit(c, config, lib.AuditSubmit, &req, start, 0, err)
+		respondQueryError(c, err)
+		return
+	}
+	defer release()
+
+	c.Header("Content-Type", "application/x-ndjson")
+	// Disable response buffering of nginx style reverse proxies.
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	encoder := json.NewEncoder(c.Writer)
+	resultCount := 0
+	attributes, err := lib.SubmitStream(c, config, query, func(batch *lib.GsonResponse) error {
+		resultCount += len(batch.Value)
+		if err := encoder.Encode(StreamMessage{Type: "batch", Data: batch}); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	})
+	recordHistory(c, &req, start, resultCount, err)
+	auditSubmit(c, config, lib.AuditSubmit, &req, start, resultCount, err)
+
+	trailer := StreamMessage{Type: "trailer", Attributes: attributes}
+	if err != nil {
+		trailer.Error = lib.NewQueryError(err)
+	}
+	if err := encoder.Encode(trailer); err != nil {
+		logrus.Debugf("unable to write stream trailer: %v", err)
+		return
+	}
+	c.Writer.Flush()
+}
+
+func cancelHandler(c *gin.Context) {
+	err := lib.CancelQuery(c, c.Param("requestId"))
+	if errors.Is(err, lib.ErrQueryNotFound) {
+		c.JSON(http.StatusNotFound, "Query not found")
+		return
+	}
+	c.JSON(http.StatusOK, "Query cancelled")
+}
+
+// The ids are passed as a binding, never formatted into the script.
+func getProps(c *gin.Context, config *lib.Config, backend *lib.Backend, elementType string, ids []json.RawMessage) (*lib.GsonResponse, error) {
+	idList, err := json.Marshal(ids)
+	if err != nil {
+		return nil, err
+	}
+	bindings, err := lib.ParseBindings(backend, map[string]json.RawMessage{"ids": idList})
+	if err != nil {
+		return nil, &lib.QueryError{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+	query := fmt.Sprintf("g.%s(ids).elementMap()", elementType)
+	return lib.Submit(c, config, lib.QueryRequest{Query: query, Backend: backend.Name, Bindings: bindings})
+}
+
 func getPropsHandler(c *gin.Context) {
 	v, exists := c.Get("conf")
 	if !exists {
@@ -87,9 +304,11 @@ func getPropsHandler(c *gin.Context) {
 	}
 	config := v.(*lib.Config)
 
+	// IDs are either plain JSON or typed GraphSON values, e.g. {"@type": "g:Int64", "@value": 1}.
 	var requestBody struct {
-		Type string   `json:"type"`
-		IDs  []string `json:"ids"`
+		Type    string            `json:"type"`
+		IDs     []json.RawMessage `json:"ids"`
+		Backend string            `json:"backend"`
 	}
 
 	if err := c.BindJSON(&requestBody); err != nil {
@@ -105,6 +324,12 @@ func getPropsHandler(c *gin.Context) {
 		return
 	}
 
+	backend, err := config.Backend(requestBody.Backend)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
 	if len(ids) == 0 {
 		c.JSON(http.StatusBadRequest, "Missing ids")
 		return
@@ -115,12 +340,23 @@ func getPropsHandler(c *gin.Context) {
 		return
 	}
 
+	// The batches share one slot, they would be rejected by each other with a limit under the batch count.
+	release, err := lib.AcquireQuerySlot(c, config)
+	if err != nil {
+		respondQueryError(c, err)
+		return
+	}
+	defer release()
+
 	batchSize := config.Prefetch.BatchSize
 	numBatches := (len(ids) + batchSize - 1) / batchSize
 	var combinedResult lib.GsonResponse
+	var batchErr error
+	var mutex sync.Mutex
 
 	var wg sync.WaitGroup
 	wg.Add(numBatches)
+	start := time.Now()
 
 	for i := 0; i < numBatches; i++ {
 		go func(batchIndex int) {
@@ -132,24 +368,15 @@ func getPropsHandler(c *gin.Context) {
 				end = len(ids)
 			}
 
-			batchIDs := ids[start:end]
-			quotedIDs := make([]string, len(batchIDs))
-			for i, id := range batchIDs {
-				quotedIDs[i] = fmt.Sprintf(`"%s"`, id)
-			}
+			lib.ObservePropsBatch(backend.Name, end-start)
+			result, err := getProps(c, config, backend, elementType, ids[start:end])
 
-			var query string
-			if elementType == "V" {
-				query = fmt.Sprintf("g.V(%s).elementMap()", strings.Join(quotedIDs, ","))
-			} else {
-				query = fmt.Sprintf("g.E(%s).elementMap()", strings.Join(quotedIDs, ","))
-			}
-			result, err := lib.Submit(c, config, query)
+			mutex.Lock()
+			defer mutex.Unlock()
 			if err != nil {
-				c.JSON(http.StatusBadRequest, fmt.Sprintf("Gremlin query error: %v", err))
+				batchErr = err
 				return
 			}
-
 			combinedResult.Type = result.Type
 			combinedResult.Value = append(combinedResult.Value, result.Value...)
 		}(i)
@@ -157,6 +384,24 @@ func getPropsHandler(c *gin.Context) {
 
 	wg.Wait()
 
+	entry := lib.AuditEntry{
+		Event:       lib.AuditProps,
+		Backend:     backend.Name,
+		Query:       fmt.Sprintf("g.%s(ids).elementMap()", elementType),
+		Bindings:    map[string]interface{}{"ids": ids},
+		DurationMs:  time.Since(start).Milliseconds(),
+		ResultCount: len(combinedResult.Value),
+	}
+	if batchErr != nil {
+		entry.Error = batchErr.Error()
+	}
+	lib.Audit(c, entry)
+
+	if batchErr != nil {
+		respondQueryError(c, batchErr)
+		return
+	}
+
 	responseBytes, err := json.Marshal(combinedResult)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, fmt.Sprintf("gremlin query parse error: %v", err))
@@ -164,3 +409,105 @@ func getPropsHandler(c *gin.Context) {
 	}
 	c.Data(http.StatusOK, "application/json", responseBytes)
 }
+
+func schemaHandler(c *gin.Context) {
+	v, exists := c.Get("conf")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, "Cannot load config")
+		return
+	}
+	config := v.(*lib.Config)
+
+	backend, err := config.Backend(c.Query("backend"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	// Checked here, the cached schemas and the schema files do not go through the query path.
+	if err := lib.CheckBackendAccess(c, backend); err != nil {
+		respondQueryError(c, err)
+		return
+	}
+	schema, err := lib.GetSchema(c, config, backend, c.Query("refresh") == "true")
+	if err != nil {
+		respondQueryError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, schema)
+}
+
+func expandHandler(c *gin.Context) {
+	v, exists := c.Get("conf")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, "Cannot load config")
+		return
+	}
+	config := v.(*lib.Config)
+
+	var req lib.ExpandRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	start := time.Now()
+	result, err := lib.Expand(c, config, &req)
+	entry := lib.AuditEntry{
+		Event:      lib.AuditExpand,
+		Backend:    req.Backend,
+		Query:      "expand",
+		Bindings:   &req,
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+	if result != nil {
+		entry.ResultCount = len(result.Paths)
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	lib.Audit(c, entry)
+
+	if err != nil {
+		respondQueryError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func pathsHandler(c *gin.Context) {
+	v, exists := c.Get("conf")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, "Cannot load config")
+		return
+	}
+	config := v.(*lib.Config)
+
+	var req lib.PathsRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	start := time.Now()
+	result, err := lib.FindPaths(c, config, &req)
+	entry := lib.AuditEntry{
+		Event:      lib.AuditPaths,
+		Backend:    req.Backend,
+		Query:      "paths",
+		Bindings:   &req,
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+	if result != nil {
+		entry.ResultCount = len(result.Paths)
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	lib.Audit(c, entry)
+
+	if err != nil {
+		respondQueryError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+	"uiserver/lib"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Copies an uploaded file to a temporary file, the multipart files are removed at the end of the request.
+func spoolUpload(header *multipart.FileHeader) (*lib.ImportFile, error) {
+	upload, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer upload.Close()
+	file, err := os.CreateTemp("", "puppygraph-import-*")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if _, err := io.Copy(file, upload); err != nil {
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &lib.ImportFile{Name: header.Filename, Path: file.Name()}, nil
+}
+
+// Starts an import of the multipart files: "file" for GraphML, or "vertices" and "edges" for CSV.
+func importHandler(c *gin.Context) {
+	if lib.CurrentRole(c) != lib.RoleAdmin {
+		c.JSON(http.StatusForbidden, "Admin role required")
+		return
+	}
+	v, exists := c.Get("conf")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, "Cannot load config")
+		return
+	}
+	config := v.(*lib.Config)
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+	req := lib.ImportRequest{Backend: c.PostForm("backend"), IDProperty: c.PostForm("idProperty")}
+	if batchSize := c.PostForm("batchSize"); batchSize != "" {
+		if req.BatchSize, err = strconv.Atoi(batchSize); err != nil || req.BatchSize <= 0 {
+			c.JSON(http.StatusBadRequest, "Invalid batchSize, expected a positive number")
+			return
+		}
+	}
+	for name, file := range map[string]**lib.ImportFile{"file": &req.GraphML, "vertices": &req.Vertices, "edges": &req.Edges} {
+		headers := form.File[name]
+		if len(headers) == 0 {
+			continue
+		}
+		if len(headers) > 1 {
+			err = fmt.Errorf("more than one %s file", name)
+		} else {
+			*file, err = spoolUpload(headers[0])
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		for _, file := range []*lib.ImportFile{req.GraphML, req.Vertices, req.Edges} {
+			if file != nil {
+				os.Remove(file.Path)
+			}
+		}
+		c.JSON(http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+
+	job, err := lib.StartImport(c, config, req)
+	if err != nil {
+		respondQueryError(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, job)
+}
+
+func listImportsHandler(c *gin.Context) {
+	if lib.CurrentRole(c) != lib.RoleAdmin {
+		c.JSON(http.StatusForbidden, "Admin role required")
+		return
+	}
+	c.JSON(http.StatusOK, lib.ListImportJobs())
+}
+
+func getImportHandler(c *gin.Context) {
+	if lib.CurrentRole(c) != lib.RoleAdmin {
+		c.JSON(http.StatusForbidden, "Admin role required")
+		return
+	}
+	job, ok := lib.GetImportJob(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, "Import not found")
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+func cancelImportHandler(c *gin.Context) {
+	if lib.CurrentRole(c) != lib.RoleAdmin {
+		c.JSON(http.StatusForbidden, "Admin role required")
+		return
+	}
+	job, ok := lib.CancelImportJob(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, "Import not found")
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"uiserver/lib"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Records a query submitted by the user. The query result is never failed because of the history.
+func recordHistory(c *gin.Context, req *SubmitRequest, start time.Time, resultCount int, err error) {
+	v, exists := c.Get("store")
+	if !exists {
+		return
+	}
+	store := v.(*lib.Store)
+
+	entry := lib.HistoryEntry{
+		RequestID:   req.RequestId,
+		Query:       req.Query,
+		Bindings:    req.Bindings,
+		Backend:     req.Backend,
+		SubmittedAt: start.UTC(),
+		DurationMs:  time.Since(start).Milliseconds(),
+		ResultCount: resultCount,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if err := store.AppendHistory(lib.CurrentUsername(c), entry); err != nil {
+		logrus.Warnf("unable to record query history: %v", err)
+	}
+}
+
+func historyHandler(c *gin.Context) {
+	v, exists := c.Get("store")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, "Cannot load store")
+		return
+	}
+	store := v.(*lib.Store)
+
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, "Invalid offset")
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, "Invalid limit")
+		return
+	}
+
+	entries, err := store.History(lib.CurrentUsername(c), c.Query("q"), offset, limit)
+	if err != nil {
+		logrus.Errorf("unable to read query history: %v", err)
+		c.JSON(http.StatusInternalServerError, "Cannot read query history")
+		return
+	}
+	c.JSON(http.StatusOK, entries)
+}
+
+func clearHistoryHandler(c *gin.Context) {
+	v, exists := c.Get("store")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, "Cannot load store")
+		return
+	}
+	store := v.(*lib.Store)
+
+	if err := store.ClearHistory(lib.CurrentUsername(c)); err != nil {
+		logrus.Errorf("unable to clear query history: %v", err)
+		c.JSON(http.StatusInternalServerError, "Cannot clear query history")
+		return
+	}
+	c.JSON(http.StatusOK, "History cleared")
+}
+
+type SavedQueryRequest struct {
+	Name        string                     `json:"name"`
+	Description string                     `json:"description"`
+	Query       string                     `json:"query"`
+	Bindings    map[string]json.RawMessage `json:"bindings"`
+	Backend     string                     `json:"backend"`
+	Tags        []string                   `json:"tags"`
+}
+
+func (req *SavedQueryRequest) toSavedQuery(config *lib.Config) (lib.SavedQuery, error) {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return lib.SavedQuery{}, errors.New("missing name")
+	}
+	if strings.TrimSpace(req.Query) == "" {
+		return lib.SavedQuery{}, errors.New("missing query")
+	}
+	backend, err := config.Backend(req.Backend)
+	if err != nil {
+		return lib.SavedQuery{}, err
+	}
+	// Saved bindings must be valid when the query is run.
+	if _, err := lib.ParseBindings(backend, req.Bindings); err != nil {
+		return lib.SavedQuery{}, err
+	}
+	var tags []string
+	for _, tag := range req.Tags {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return lib.SavedQuery{
+		Name:        req.Name,
+		Description: req.Description,
+		Query:       req.Query,
+		Bindings:    req.Bindings,
+		Backend:     req.Backend,
+		Tags:        tags,
+	}, nil
+}
+
+func listSavedQueriesHandler(c *gin.Context) {
+	v, exists := c.Get("store")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, "Cannot load store")
+		return
+	}
+	store := v.(*lib.Store)
+
+	filter := lib.SavedQueryFilter{
+		Text: c.Query("q"),
+		Tags: c.QueryArray("tag"),
+	}
+	if c.Query("mine") == "true" {
+		filter.Owner = lib.CurrentUsername(c)
+	}
+	c.JSON(http.StatusOK, store.SavedQueries(filter))
+}
+
+func getSavedQueryHandler(c *gin.Context) {
+	v, exists := c.Get("store")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, "Cannot load store")
+		return
+	}
+	store := v.(*lib.Store)
+
+	query, err := store.SavedQuery(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, "Saved query not found")
+		return
+	}
+	c.JSON(http.StatusOK, query)
+}
+
+func createSavedQueryHandler(c *gin.Context) {
+	saveQuery(c, func(store *lib.Store, username string, query lib.SavedQuery) (lib.SavedQuery, error) {
+		return store.CreateSavedQuery(username, query)
+	})
+}
+
+func updateSavedQueryHandler(c *gin.Context) {
+	saveQuery(c, func(store *lib.Store, username string, query lib.SavedQuery) (lib.SavedQuery, error) {
+		return store.UpdateSavedQuery(username, c.Param("id"), query)
+	})
+}
+
+func saveQuery(c *gin.Context, save func(store *lib.Store, username string, query lib.SavedQuery) (lib.SavedQuery, error)) {
+	v, exists := c.Get("conf")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, "Cannot load config")
+		return
+	}
+	config := v.(*lib.Config)
+	v, exists = c.Get("store")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, "Cannot load store")
+		return
+	}
+	store := v.(*lib.Store)
+
+	var req SavedQueryRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, "Invalid request")
+		return
+	}
+	query, err := req.toSavedQuery(config)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, "Invalid request: "+err.Error())
+		return
+	}
+
+	saved, err := save(store, lib.CurrentUsername(c), query)
+	switch {
+	case errors.Is(err, lib.ErrSavedQueryNotFound):
+		c.JSON(http.StatusNotFound, "Saved query not found")
+	case errors.Is(err, lib.ErrSavedQueryExists):
+		c.JSON(http.StatusConflict, err.Error())
+	case err != nil:
+		logrus.Errorf("unable to save query: %v", err)
+		c.JSON(http.StatusInternalServerError, "Cannot save query")
+	default:
+		c.JSON(http.StatusOK, saved)
+	}
+}
+
+func deleteSavedQueryHandler(c *gin.Context) {
+	v, exists := c.Get("store")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, "Cannot load store")
+		return
+	}
+	store := v.(*lib.Store)
+
+	err := store.DeleteSavedQuery(lib.CurrentUsername(c), c.Param("id"))
+	switch {
+	case errors.Is(err, lib.ErrSavedQueryNotFound):
+		c.JSON(http.StatusNotFound, "Saved query not found")
+	case err != nil:
+		logrus.Errorf("unable to delete saved query: %v", err)
+		c.JSON(http.StatusInternalServerError, "Cannot delete saved query")
+	default:
+		c.JSON(http.StatusOK, "Saved query deleted")
+	}
+}
@@ -3,8 +3,7 @@ package main
 import (
 	"fmt"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
+	"os"
 	"uiserver/lib"
 
 	"github.com/gin-gonic/gin"
@@ -21,6 +20,10 @@ func noCacheMiddleware() gin.HandlerFunc {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "hash-password" {
+		hashPasswordCommand()
+		return
+	}
 	logrus.SetFormatter(&lib.PuppyLogFormatter{ModuleName: "UiServer"})
 
 	conf, err := lib.LoadConfig()
@@ -31,53 +34,82 @@ func main() {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
 
-	r := gin.Default()
+	r := gin.New()
+	// The aborted responses are still logged.
+	r.Use(abortMiddleware(), gin.Logger(), gin.Recovery())
+	// The client IP of the audit log and of the login lockout.
+	if err := r.SetTrustedProxies(conf.TrustedProxies); err != nil {
+		logrus.Fatalf("Invalid trusted proxies: %v. Exiting.", err)
+	}
 
 	// for large data size, should rely on client side to run small batch update
 	r.MaxMultipartMemory = 8 << 30 // 8GB
 
+	store, err := lib.OpenStore(conf.Storage)
+	if err != nil {
+		logrus.Fatalf("Cannot open the store: %v. Exiting.", err)
+	}
+
+	var auditLog *lib.AuditLog
+	if conf.Audit.Enabled {
+		auditLog, err = lib.OpenAuditLog(conf.Audit)
+		if err != nil {
+			logrus.Fatalf("Cannot open the audit log: %v. Exiting.", err)
+		}
+	}
+
+	var users *lib.UserStore
+	if conf.Authentication.UsersFile != "" {
+		admin := conf.Authentication.Admin
+		users, err = lib.OpenUserStore(conf.Authentication.UsersFile, lib.LocalUser{Username: admin.Username, Role: admin.Role})
+		if err != nil {
+			logrus.Fatalf("Cannot open the users file: %v. Exiting.", err)
+		}
+	}
+
+	watcher := lib.WatchConfig(conf)
+
 	requestScopedMiddleware := func(c *gin.Context) {
-		c.Set("conf", conf)
+		c.Set("conf", watcher.Current())
+		c.Set("store", store)
+		if auditLog != nil {
+			c.Set("audit", auditLog)
+		}
+		if users != nil {
+			c.Set("users", users)
+		}
 		c.Next()
 	}
 	r.Use(requestScopedMiddleware)
+	if conf.Metrics.Enabled {
+		r.Use(lib.MetricsMiddleware())
+		// Scraped by prometheus with its own token, not the UI session.
+		r.GET("/metrics", lib.MetricsHandler(conf.Metrics))
+	}
 
-	jwtMiddleware := lib.InitJwtMiddleware(conf.Authentication.FrontendJWT.SecretKey, conf.Authentication.FrontendJWT.Timeout)
+	jwtMiddleware := lib.InitJwtMiddleware(conf.Authentication.FrontendJWT.SecretKey, conf.Authentication.FrontendJWT.Timeout, conf.TLS.Enabled())
 
 	r.POST("/login", jwtMiddleware.LoginHandler)
-	r.POST("/logout", jwtMiddleware.LogoutHandler)
-	r.GET("/refresh_token", jwtMiddleware.RefreshHandler)
-
-	auth := func(c *gin.Context) {
-		jwtMiddleware.MiddlewareFunc()(c)
+	r.POST("/logout", lib.LogoutHandler(jwtMiddleware))
+	r.GET("/refresh_token", lib.RefreshHandler(jwtMiddleware))
+	if conf.Authentication.OIDC.Enabled() {
+		r.GET("/login/oidc", lib.OIDCLoginHandler)
+		r.GET("/login/oidc/callback", lib.OIDCCallbackHandler(jwtMiddleware))
 	}
 
-	// gremlin reverse proxy
-	r.Any("/gremlin", func(c *gin.Context) {
-		logrus.Debugf("gremlin: %+v", c.Request)
+	// API tokens and client certificates are accepted next to the JWT.
+	auth := lib.AuthMiddleware(jwtMiddleware)
+
+	rateLimit := lib.RateLimitMiddleware()
+
+	// gremlin server proxy for websocket and http clients, authenticated with the UI session
+	r.Any("/gremlin", auth, rateLimit, func(c *gin.Context) {
 		v, exists := c.Get("conf")
 		if !exists {
 			c.JSON(http.StatusInternalServerError, "Cannot load config.")
 			return
 		}
-		conf := v.(*lib.Config)
-		origin := "http://" + conf.GremlinServer.Host
-		remote, err := url.Parse(origin)
-		if err != nil {
-			panic(err)
-		}
-
-		proxy := httputil.NewSingleHostReverseProxy(remote)
-		proxy.Director = func(req *http.Request) {
-			req.Header = c.Request.Header
-			req.Header.Set("Origin", origin)
-			req.Host = remote.Host
-			req.URL.Scheme = remote.Scheme
-			req.URL.Host = remote.Host
-			req.URL.Path = conf.GremlinServer.Path
-		}
-
-		proxy.ServeHTTP(c.Writer, c.Request)
+		lib.ProxyGremlin(c, v.(*lib.Config))
 	})
 
 	// html
@@ -90,8 +122,51 @@ func main() {
 	r.Static("/static", "./html/build/static")
 
 	r.GET("/status", auth, statusHandler)
-	r.POST("/submit", auth, submitHandler)
-	r.POST("/ui-api/props", auth, getPropsHandler)
+	r.GET("/backends", auth, backendsHandler)
+	r.POST("/submit", auth, rateLimit, submitHandler)
+	r.POST("/submit/stream", auth, rateLimit, submitStreamHandler)
+	r.POST("/submit/:requestId/cancel", auth, cancelHandler)
+	r.POST("/profile", auth, rateLimit, profileHandler)
+	r.POST("/ui-api/props", auth, rateLimit, getPropsHandler)
+	r.GET("/ui-api/schema", auth, rateLimit, schemaHandler)
+	r.POST("/ui-api/expand", auth, rateLimit, expandHandler)
+	r.POST("/ui-api/paths", auth, rateLimit, pathsHandler)
+	r.POST("/export", auth, rateLimit, exportHandler)
+	r.POST("/import", auth, rateLimit, importHandler)
+	r.GET("/import", auth, listImportsHandler)
+	r.GET("/import/:id", auth, getImportHandler)
+	r.POST("/import/:id/cancel", auth, cancelImportHandler)
+
+	r.GET("/history", auth, historyHandler)
+	r.DELETE("/history", auth, clearHistoryHandler)
+	r.GET("/queries", auth, listSavedQueriesHandler)
+	r.POST("/queries", auth, createSavedQueryHandler)
+	r.GET("/queries/:id", auth, getSavedQueryHandler)
+	r.PUT("/queries/:id", auth, updateSavedQueryHandler)
+	r.DELETE("/queries/:id", auth, deleteSavedQueryHandler)
+
+	r.GET("/tokens", auth, listAPITokensHandler)
+	r.POST("/tokens", auth, createAPITokenHandler)
+	r.DELETE("/tokens/:id", auth, revokeAPITokenHandler)
+
+	r.GET("/audit", auth, auditHandler)
+
+	if users != nil {
+		r.GET("/users", auth, listUsersHandler)
+		r.POST("/users", auth, createUserHandler)
+		r.PUT("/users/:username", auth, updateUserHandler)
+		r.PUT("/users/:username/password", auth, resetPasswordHandler)
+	}
 
-	r.Run(fmt.Sprintf(":%d", conf.Port))
+	addr := fmt.Sprintf(":%d", conf.Port)
+	if conf.TLS.Enabled() {
+		tlsConfig, err := lib.WatchTLS(conf.TLS)
+		if err != nil {
+			logrus.Fatalf("Cannot load the TLS certificate: %v. Exiting.", err)
+		}
+		server := &http.Server{Addr: addr, Handler: r, TLSConfig: tlsConfig}
+		// The certificate comes from the TLS config, which follows the changes of the files.
+		logrus.Fatal(server.ListenAndServeTLS("", ""))
+	}
+	r.Run(addr)
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"uiserver/lib"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+type CreateAPITokenRequest struct {
+	Name string `json:"name"`
+	// Read-only tokens have the reader role, whatever the role of the user.
+	ReadOnly bool `json:"readOnly"`
+	// Backends the token can query, all of them when empty.
+	Backends []string `json:"backends"`
+}
+
+// CreateAPITokenResponse has the secret of the new token, which cannot be read again.
+type CreateAPITokenResponse struct {
+	lib.APIToken
+	Token string `json:"token"`
+}
+
+// Returns the store when the request is authenticated with a JWT, or answers the request. A leaked API token cannot
+// be used to create other tokens.
+func apiTokenStore(c *gin.Context) (*lib.Store, bool) {
+	if lib.CurrentAPIToken(c) != "" {
+		c.JSON(http.StatusForbidden, "API tokens cannot manage API tokens")
+		return nil, false
+	}
+	v, exists := c.Get("store")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, "Cannot load store")
+		return nil, false
+	}
+	return v.(*lib.Store), true
+}
+
+func listAPITokensHandler(c *gin.Context) {
+	store, ok := apiTokenStore(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, store.APITokens(lib.CurrentUsername(c)))
+}
+
+func createAPITokenHandler(c *gin.Context) {
+	v, exists := c.Get("conf")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, "Cannot load config")
+		return
+	}
+	config := v.(*lib.Config)
+	store, ok := apiTokenStore(c)
+	if !ok {
+		return
+	}
+
+	var req CreateAPITokenRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, "Invalid request")
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		c.JSON(http.StatusBadRequest, "Invalid request: missing name")
+		return
+	}
+	for _, name := range req.Backends {
+		if _, err := config.Backend(name); err != nil || name == "" {
+			c.JSON(http.StatusBadRequest, "Invalid request: unknown backend "+name)
+			return
+		}
+	}
+	token := lib.APIToken{Name: req.Name, Role: lib.CurrentRole(c), Backends: req.Backends}
+	if req.ReadOnly {
+		token.Role = lib.RoleReader
+	}
+
+	token, secret, err := store.CreateAPIToken(lib.CurrentUsername(c), token, config.Authentication.APITokenLifetime)
+	entry := lib.AuditEntry{Event: lib.AuditTokenCreate, Query: req.Name, Bindings: &req}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	lib.Audit(c, entry)
+	if err != nil {
+		logrus.Errorf("unable to save API token: %v", err)
+		c.JSON(http.StatusInternalServerError, "Cannot save API token")
+		return
+	}
+	c.JSON(http.StatusOK, CreateAPITokenResponse{APIToken: token, Token: secret})
+}
+
+func revokeAPITokenHandler(c *gin.Context) {
+	store, ok := apiTokenStore(c)
+	if !ok {
+		return
+	}
+
+	err := store.RevokeAPIToken(lib.CurrentUsername(c), c.Param("id"))
+	entry := lib.AuditEntry{Event: lib.AuditTokenRevoke, Query: c.Param("id")}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	lib.Audit(c, entry)
+	switch {
+	case errors.Is(err, lib.ErrAPITokenNotFound):
+		c.JSON(http.StatusNotFound, "API token not found")
+	case err != nil:
+		logrus.Errorf("unable to revoke API token: %v", err)
+		c.JSON(http.StatusInternalServerError, "Cannot revoke API token")
+	default:
+		c.JSON(http.StatusOK, "API token revoked")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"uiserver/lib"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Prints the hash of the password read from the first line of stdin, for the users file.
+func hashPasswordCommand() {
+	fmt.Fprintln(os.Stderr, "Password:")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot read the password: %v\n", err)
+		} else {
+			fmt.Fprintln(os.Stderr, "Empty password")
+		}
+		os.Exit(1)
+	}
+	hash, err := lib.HashPassword(password)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot hash the password: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(hash)
+}
+
+type CreateUserRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+// Nil fields are left unchanged.
+type UpdateUserRequest struct {
+	Role     *string `json:"role"`
+	Disabled *bool   `json:"disabled"`
+}
+
+type ResetPasswordRequest struct {
+	Password string `json:"password"`
+}
+
+// Returns the user store for an admin, or answers the request.
+func adminUserStore(c *gin.Context) (*lib.UserStore, bool) {
+	if lib.CurrentRole(c) != lib.RoleAdmin {
+		c.JSON(http.StatusForbidden, "Admin role required")
+		return nil, false
+	}
+	v, exists := c.Get("users")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, "Cannot load users")
+		return nil, false
+	}
+	return v.(*lib.UserStore), true
+}
+
+// Records a change of a user by the admin in the audit log.
+func auditUserChange(c *gin.Context, event string, username string, change interface{}, err error) {
+	entry := lib.AuditEntry{Event: event, Query: username, Bindings: change}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	lib.Audit(c, entry)
+}
+
+func respondUser(c *gin.Context, user lib.LocalUser, err error) {
+	switch {
+	case errors.Is(err, lib.ErrUserNotFound):
+		c.JSON(http.StatusNotFound, "User not found")
+	case errors.Is(err, lib.ErrUserExists):
+		c.JSON(http.StatusConflict, err.Error())
+	case errors.Is(err, lib.ErrInvalidUser):
+		c.JSON(http.StatusBadRequest, "Invalid request: "+err.Error())
+	case err != nil:
+		logrus.Errorf("unable to save user: %v", err)
+		c.JSON(http.StatusInternalServerError, "Cannot save user")
+	default:
+		c.JSON(http.StatusOK, user)
+	}
+}
+
+func listUsersHandler(c *gin.Context) {
+	users, ok := adminUserStore(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, users.Users())
+}
+
+func createUserHandler(c *gin.Context) {
+	users, ok := adminUserStore(c)
+	if !ok {
+		return
+	}
+	var req CreateUserRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, "Invalid request")
+		return
+	}
+	req.Username = strings.TrimSpace(req.Username)
+	user, err := users.CreateUser(req.Username, req.Password, req.Role)
+	auditUserChange(c, lib.AuditUserCreate, req.Username, gin.H{"role": req.Role}, err)
+	respondUser(c, user, err)
+}
+
+func updateUserHandler(c *gin.Context) {
+	users, ok := adminUserStore(c)
+	if !ok {
+		return
+	}
+	var req UpdateUserRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, "Invalid request")
+		return
+	}
+	username := c.Param("username")
+	// An admin cannot lock itself out.
+	if username == lib.CurrentUsername(c) && ((req.Disabled != nil && *req.Disabled) || (req.Role != nil && *req.Role != lib.RoleAdmin)) {
+		c.JSON(http.StatusBadRequest, "Cannot disable or demote the current user")
+		return
+	}
+	user, err := users.UpdateUser(username, req.Role, req.Disabled)
+	auditUserChange(c, lib.AuditUserUpdate, username, &req, err)
+	respondUser(c, user, err)
+}
+
+func resetPasswordHandler(c *gin.Context) {
+	users, ok := adminUserStore(c)
+	if !ok {
+		return
+	}
+	var req ResetPasswordRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, "Invalid request")
+		return
+	}
+	username := c.Param("username")
+	user, err := users.ResetPassword(username, req.Password)
+	auditUserChange(c, lib.AuditUserPassword, username, nil, err)
+	respondUser(c, user, err)
+}
@@ -151,6 +151,11 @@ func (client *Client) Close() {
 	client.connections.close()
 }
 
+// ActiveResults returns the number of results in progress on each open connection of the client.
+func (client *Client) ActiveResults() []int {
+	return client.connections.activeResults()
+}
+
 // SubmitWithOptions submits a Gremlin script to the server with specified RequestOptions and returns a ResultSet.
 func (client *Client) SubmitWithOptions(traversalString string, requestOptions RequestOptions) (ResultSet, error) {
 	client.logHandler.logf(Debug, submitStartedString, traversalString)
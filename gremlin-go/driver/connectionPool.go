@@ -25,6 +25,7 @@ import (
 
 type connectionPool interface {
 	write(*request) (ResultSet, error)
+	activeResults() []int
 	close()
 }
 
@@ -63,6 +64,20 @@ func (pool *loadBalancingPool) close() {
 	}
 }
 
+// activeResults returns the number of active results of each established connection.
+func (pool *loadBalancingPool) activeResults() []int {
+	pool.loadBalanceLock.Lock()
+	defer pool.loadBalanceLock.Unlock()
+
+	results := make([]int, 0, len(pool.connections))
+	for _, connection := range pool.connections {
+		if connection.state == established {
+			results = append(results, connection.activeResults())
+		}
+	}
+	return results
+}
+
 func (pool *loadBalancingPool) write(request *request) (ResultSet, error) {
 	pool.loadBalanceLock.Lock()
 	defer pool.loadBalanceLock.Unlock()
@@ -105,6 +105,24 @@ func TestConnectionPool(t *testing.T) {
 			})
 		})
 
+		t.Run("activeResults", func(t *testing.T) {
+			pool := getPoolForTesting()
+			defer pool.close()
+			mockConnection1 := getMockConnection()
+			mockConnection2 := getMockConnection()
+			mockConnection1.results.internalMap = bigMap
+			mockConnection2.results.internalMap = smallMap
+			nonEstablished := &connection{
+				logHandler: logger,
+				protocol:   nil,
+				results:    nil,
+				state:      closedDueToError,
+			}
+			pool.connections = []*connection{mockConnection1, nonEstablished, mockConnection2}
+
+			assert.Equal(t, []int{3, 2}, pool.activeResults())
+		})
+
 		t.Run("close", func(t *testing.T) {
 			pool := getPoolForTesting()
 			empty := &synchronizedMap{
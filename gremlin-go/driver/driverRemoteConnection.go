@@ -168,6 +168,11 @@ func (driver *DriverRemoteConnection) Close() {
 	driver.isClosed = true
 }
 
+// ActiveResults returns the number of results in progress on each open connection of the DriverRemoteConnection.
+func (driver *DriverRemoteConnection) ActiveResults() []int {
+	return driver.client.ActiveResults()
+}
+
 // SubmitWithOptions sends a string traversal to the server along with specified RequestOptions.
 func (driver *DriverRemoteConnection) SubmitWithOptions(traversalString string, requestOptions RequestOptions) (ResultSet, error) {
 	result, err := driver.client.SubmitWithOptions(traversalString, requestOptions)
@@ -140,7 +140,14 @@ func (protocol *gremlinServerWSProtocol) responseHandler(resultSets *synchronize
 			return newError(err0503ResponseHandlerAuthError, response.responseStatus, response.responseResult)
 		}
 	} else {
-		newError := newError(err0502ResponseHandlerReadLoopError, response.responseStatus, statusCode)
+		newError := &ResponseError{
+			RequestID:  responseIDString,
+			StatusCode: statusCode,
+			Message:    response.responseStatus.message,
+			Attributes: response.responseStatus.attributes,
+			err:        newError(err0502ResponseHandlerReadLoopError, response.responseStatus, statusCode),
+		}
+		resultSets.load(responseIDString).setStatusAttributes(response.responseStatus.attributes)
 		resultSets.load(responseIDString).setError(newError)
 		resultSets.load(responseIDString).Close()
 		protocol.logHandler.logf(Error, logErrorGeneric, "gremlinServerWSProtocol.responseHandler()", newError.Error())
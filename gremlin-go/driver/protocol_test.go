@@ -24,6 +24,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/text/language"
 )
@@ -88,4 +89,57 @@ func TestProtocol(t *testing.T) {
 			// Ok. Close must not wait.
 		}
 	})
+
+	t.Run("Test protocol response error", func(t *testing.T) {
+		protocol := &gremlinServerWSProtocol{
+			logHandler: newLogHandler(&defaultLogger{}, Info, language.English),
+		}
+		requestID := uuid.New()
+		resultSets := &synchronizedMap{map[string]ResultSet{}, sync.Mutex{}}
+		resultSet := newChannelResultSet(requestID.String(), resultSets)
+		resultSets.store(requestID.String(), resultSet)
+
+		attributes := map[string]interface{}{"exceptions": []interface{}{"java.util.concurrent.TimeoutException"}}
+		err := protocol.responseHandler(resultSets, response{
+			responseID:     requestID,
+			responseStatus: responseStatus{code: 598, message: "timeout", attributes: attributes},
+		})
+		assert.Nil(t, err)
+
+		_, err = resultSet.All()
+		responseError, ok := err.(*ResponseError)
+		assert.True(t, ok)
+		assert.Equal(t, uint16(598), responseError.StatusCode)
+		assert.Equal(t, "timeout", responseError.Message)
+		assert.Equal(t, requestID.String(), responseError.RequestID)
+		assert.Equal(t, attributes, responseError.Attributes)
+		assert.Equal(t, attributes, resultSet.GetStatusAttributes())
+	})
+
+	t.Run("Test protocol discards responses of cancelled request", func(t *testing.T) {
+		protocol := &gremlinServerWSProtocol{
+			logHandler: newLogHandler(&defaultLogger{}, Info, language.English),
+		}
+		requestID := uuid.New()
+		resultSets := &synchronizedMap{map[string]ResultSet{}, sync.Mutex{}}
+		resultSet := newChannelResultSet(requestID.String(), resultSets)
+		resultSets.store(requestID.String(), resultSet)
+		resultSet.Cancel()
+
+		err := protocol.responseHandler(resultSets, response{
+			responseID:     requestID,
+			responseStatus: responseStatus{code: 206},
+			responseResult: responseResult{data: "partial"},
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, 1, resultSets.size())
+
+		err = protocol.responseHandler(resultSets, response{
+			responseID:     requestID,
+			responseStatus: responseStatus{code: 200},
+			responseResult: responseResult{data: "final"},
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, 0, resultSets.size())
+	})
 }
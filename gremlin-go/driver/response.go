@@ -40,3 +40,17 @@ type response struct {
 	responseStatus responseStatus
 	responseResult responseResult
 }
+
+// ResponseError is set as the error of a ResultSet when the server responds with an error status code. The status
+// attributes usually contain the "exceptions" and the "stackTrace" of the failure on the server.
+type ResponseError struct {
+	RequestID  string
+	StatusCode uint16
+	Message    string
+	Attributes map[string]interface{}
+	err        error
+}
+
+func (responseError *ResponseError) Error() string {
+	return responseError.err.Error()
+}
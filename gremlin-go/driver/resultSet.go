@@ -35,6 +35,7 @@ type ResultSet interface {
 	GetRequestID() string
 	IsEmpty() bool
 	Close()
+	Cancel()
 	unlockedClose()
 	Channel() chan *Result
 	addResult(result *Result)
@@ -52,10 +53,14 @@ type channelResultSet struct {
 	aggregateTo      string
 	statusAttributes map[string]interface{}
 	closed           bool
+	abandoned        bool
 	err              error
 	waitSignal       chan bool
 	channelMutex     sync.Mutex
 	waitSignalMutex  sync.Mutex
+	// Closed by Cancel, so that addResult stops waiting on a full channel and releases the channel mutex.
+	cancelled  chan struct{}
+	cancelOnce sync.Once
 }
 
 func (channelResultSet *channelResultSet) sendSignal() {
@@ -111,27 +116,53 @@ func (channelResultSet *channelResultSet) IsEmpty() bool {
 
 // Close can be used to close the channelResultSet.
 func (channelResultSet *channelResultSet) Close() {
-	if !channelResultSet.closed {
-		channelResultSet.channelMutex.Lock()
-		channelResultSet.closed = true
+	if channelResultSet.markClosed() {
 		channelResultSet.container.delete(channelResultSet.requestID)
-		close(channelResultSet.channel)
+	}
+}
+
+// Cancel abandons the request of the channelResultSet. The channel is closed right away and the error is set, while
+// the channelResultSet stays in the container until the server sends the final response, so that responses still in
+// flight for the request are discarded instead of failing the connection.
+func (channelResultSet *channelResultSet) Cancel() {
+	// Wake up addResult in case it is blocked on a full channel while holding the channel mutex.
+	channelResultSet.cancelOnce.Do(func() { close(channelResultSet.cancelled) })
+	channelResultSet.channelMutex.Lock()
+	if channelResultSet.closed {
 		channelResultSet.channelMutex.Unlock()
-		channelResultSet.sendSignal()
+		return
 	}
+	channelResultSet.setError(newError(err1201ResultSetCancelledError, channelResultSet.requestID))
+	channelResultSet.closed = true
+	channelResultSet.abandoned = true
+	close(channelResultSet.channel)
+	channelResultSet.channelMutex.Unlock()
+	channelResultSet.sendSignal()
 }
 
 // Close and remove from the channelResultSet from the container without locking container. Meant for use when calling
 // function already locks the container.
 func (channelResultSet *channelResultSet) unlockedClose() {
-	if !channelResultSet.closed {
-		channelResultSet.channelMutex.Lock()
-		channelResultSet.closed = true
+	if channelResultSet.markClosed() {
 		delete(channelResultSet.container.internalMap, channelResultSet.requestID)
-		close(channelResultSet.channel)
+	}
+}
+
+// markClosed closes the channel unless it is already closed, and tells whether the channelResultSet must be removed
+// from its container: when it was open, or when it was cancelled and the final response has arrived. The container is
+// not touched under the channel mutex, since unlockedClose is called with the container locked.
+func (channelResultSet *channelResultSet) markClosed() bool {
+	channelResultSet.channelMutex.Lock()
+	if channelResultSet.closed {
+		abandoned := channelResultSet.abandoned
 		channelResultSet.channelMutex.Unlock()
-		channelResultSet.sendSignal()
+		return abandoned
 	}
+	channelResultSet.closed = true
+	close(channelResultSet.channel)
+	channelResultSet.channelMutex.Unlock()
+	channelResultSet.sendSignal()
+	return true
 }
 
 func (channelResultSet *channelResultSet) setAggregateTo(val string) {
@@ -187,25 +218,44 @@ func (channelResultSet *channelResultSet) All() ([]*Result, error) {
 
 func (channelResultSet *channelResultSet) addResult(r *Result) {
 	channelResultSet.channelMutex.Lock()
+	if channelResultSet.closed {
+		// The request was cancelled, discard the data.
+		channelResultSet.channelMutex.Unlock()
+		return
+	}
 	if r.GetType().Kind() == reflect.Array || r.GetType().Kind() == reflect.Slice {
+	results:
 		for _, v := range r.Data.([]interface{}) {
 			if reflect.TypeOf(v) == reflect.TypeOf(&Traverser{}) {
 				for i := int64(0); i < (v.(*Traverser)).bulk; i++ {
-					channelResultSet.channel <- &Result{(v.(*Traverser)).value}
+					if !channelResultSet.send(&Result{(v.(*Traverser)).value}) {
+						break results
+					}
 				}
-			} else {
-				channelResultSet.channel <- &Result{v}
+			} else if !channelResultSet.send(&Result{v}) {
+				break
 			}
 		}
 	} else {
-		channelResultSet.channel <- &Result{r.Data}
+		channelResultSet.send(&Result{r.Data})
 	}
 	channelResultSet.channelMutex.Unlock()
 	channelResultSet.sendSignal()
 }
 
+// send adds a result to the channel, and returns false instead of waiting on a full channel once the request is
+// cancelled. Called with the channel mutex held.
+func (channelResultSet *channelResultSet) send(result *Result) bool {
+	select {
+	case channelResultSet.channel <- result:
+		return true
+	case <-channelResultSet.cancelled:
+		return false
+	}
+}
+
 func newChannelResultSetCapacity(requestID string, container *synchronizedMap, channelSize int) ResultSet {
-	return &channelResultSet{make(chan *Result, channelSize), requestID, container, "", nil, false, nil, nil, sync.Mutex{}, sync.Mutex{}}
+	return &channelResultSet{make(chan *Result, channelSize), requestID, container, "", nil, false, false, nil, nil, sync.Mutex{}, sync.Mutex{}, make(chan struct{}), sync.Once{}}
 }
 
 func newChannelResultSet(requestID string, container *synchronizedMap) ResultSet {
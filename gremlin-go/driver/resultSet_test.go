@@ -154,6 +154,64 @@ func TestChannelResultSet(t *testing.T) {
 		channelResultSet.Close()
 		assert.Equal(t, 0, container.size())
 	})
+
+	t.Run("Test ResultSet cancel.", func(t *testing.T) {
+		container := getSyncMap()
+		channelResultSet := newChannelResultSet(mockID, container)
+		container.store(mockID, channelResultSet)
+		AddResults(channelResultSet, 10)
+		channelResultSet.Cancel()
+		_, err := channelResultSet.All()
+		assert.NotNil(t, err)
+
+		// Late responses are discarded, the final one removes the result set from the container.
+		assert.NotPanics(t, func() { AddResults(channelResultSet, 10) })
+		assert.Equal(t, 1, container.size())
+		channelResultSet.Close()
+		assert.Equal(t, 0, container.size())
+	})
+
+	t.Run("Test ResultSet cancel unblocks full channel.", func(t *testing.T) {
+		channelResultSet := newChannelResultSetCapacity(mockID, getSyncMap(), 1)
+		done := make(chan bool)
+		go func() {
+			AddResults(channelResultSet, 10)
+			done <- true
+		}()
+		time.Sleep(100 * time.Millisecond)
+		channelResultSet.Cancel()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("addResult is still blocked after cancel")
+		}
+	})
+
+	t.Run("Test ResultSet concurrent cancel and close.", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			container := getSyncMap()
+			channelResultSet := newChannelResultSetCapacity(mockID, container, 1)
+			container.store(mockID, channelResultSet)
+			var wg sync.WaitGroup
+			wg.Add(3)
+			go func() {
+				defer wg.Done()
+				AddResults(channelResultSet, 10)
+			}()
+			go func() {
+				defer wg.Done()
+				channelResultSet.Cancel()
+			}()
+			go func() {
+				defer wg.Done()
+				channelResultSet.Close()
+			}()
+			wg.Wait()
+			// Whichever ran first, the final response removes the result set from the container.
+			channelResultSet.Close()
+			assert.Equal(t, 0, container.size())
+		}
+	})
 }
 
 func AddResultsPause(resultSet ResultSet, count int, ticks time.Duration) {
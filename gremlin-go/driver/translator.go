@@ -292,7 +292,8 @@ func (t *translator) toString(arg interface{}) (string, error) {
 		case *AnonymousTraversal:
 			return t.toString(arg)
 		case *Binding:
-			return v.String(), nil
+			// The value is sent in the bindings of the request, the script refers to it by name.
+			return v.Key, nil
 		case GraphTraversal:
 		case *GraphTraversal:
 			return t.translate(v.Bytecode, false)
@@ -258,6 +258,12 @@ func Test_translator_Translate(t *testing.T) {
 			},
 			equals: "g.inject(3,4,5).count()",
 		},
+		{
+			assert: func(g *GraphTraversalSource) *GraphTraversal {
+				return g.Inject((&Bindings{}).Of("rows", []interface{}{3, 4, 5})).Unfold()
+			},
+			equals: "g.inject(rows).unfold()",
+		},
 		{
 			assert: func(g *GraphTraversalSource) *GraphTraversal {
 				return g.V().Has("runways", P.Gt(5)).Count()
@@ -0,0 +1,346 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Audit events.
+const (
+	AuditLogin        = "login"
+	AuditLoginFailed  = "login_failed"
+	AuditLoginLocked  = "login_locked"
+	AuditSubmit       = "submit"
+	AuditProps        = "props"
+	AuditGremlin      = "gremlin"
+	AuditExport       = "export"
+	AuditImport       = "import"
+	AuditExpand       = "expand"
+	AuditPaths        = "paths"
+	AuditProfile      = "profile"
+	AuditUserCreate   = "user_create"
+	AuditUserUpdate   = "user_update"
+	AuditUserPassword = "user_password"
+	AuditTokenCreate  = "token_create"
+	AuditTokenRevoke  = "token_revoke"
+)
+
+const (
+	auditFileName   = "audit.jsonl"
+	auditFilePrefix = "audit-"
+	auditTimeLayout = "20060102T150405.000000000"
+)
+
+// AuditConfig controls the audit log of the logins and queries.
+type AuditConfig struct {
+	Enabled bool `yaml:"enabled" default:"true"`
+	// Directory of the audit files, created when missing.
+	Dir string `yaml:"dir" default:"./data/audit"`
+	// The file is rotated when it reaches this size.
+	MaxSizeMB int `yaml:"maxSizeMB" default:"100"`
+	// The file is rotated when its first entry is older than this.
+	MaxAge time.Duration `yaml:"maxAge" default:"24h"`
+	// Number of rotated files kept. Zero keeps all of them.
+	MaxBackups int `yaml:"maxBackups" default:"30"`
+}
+
+// AuditEntry is one line of the audit log.
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Username string    `json:"username"`
+	ClientIP string    `json:"clientIp,omitempty"`
+	// Id of the API token of the request, empty with a JWT.
+	APIToken    string      `json:"apiToken,omitempty"`
+	Backend     string      `json:"backend,omitempty"`
+	RequestID   string      `json:"requestId,omitempty"`
+	Query       string      `json:"query,omitempty"`
+	Bindings    interface{} `json:"bindings,omitempty"`
+	DurationMs  int64       `json:"durationMs"`
+	ResultCount int         `json:"resultCount"`
+	Error       string      `json:"error,omitempty"`
+}
+
+// AuditFilter selects audit entries. Empty fields match everything.
+type AuditFilter struct {
+	Username string
+	Event    string
+	From     time.Time
+	To       time.Time
+	Limit    int
+}
+
+// AuditLog appends entries to a JSON lines file, which is rotated by size and age.
+type AuditLog struct {
+	config AuditConfig
+
+	mutex    sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func OpenAuditLog(config AuditConfig) (*AuditLog, error) {
+	if err := os.MkdirAll(config.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("unable to create audit directory: %v", err)
+	}
+	a := &AuditLog{config: config}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) path() string {
+	return filepath.Join(a.config.Dir, auditFileName)
+}
+
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.path(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("unable to open audit log: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file = f
+	a.size = info.Size()
+	a.openedAt = time.Now()
+	// The age of an existing file is the time of its first entry.
+	if a.size > 0 {
+		if entries, err := readAuditFile(a.path(), 1); err == nil && len(entries) > 0 {
+			a.openedAt = entries[0].Time
+		}
+	}
+	return nil
+}
+
+// Record appends the entry. Failures are logged, they never fail the audited request.
+func (a *AuditLog) Record(entry AuditEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	entry.Time = entry.Time.UTC()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		logrus.Errorf("unable to encode audit entry: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.needsRotation(len(line)) {
+		if err := a.rotate(); err != nil {
+			logrus.Errorf("unable to rotate audit log: %v", err)
+		}
+	}
+	if a.file == nil {
+		return
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		logrus.Errorf("unable to write audit entry: %v", err)
+	}
+}
+
+func (a *AuditLog) needsRotation(lineSize int) bool {
+	if a.size == 0 {
+		return false
+	}
+	if a.config.MaxSizeMB > 0 && a.size+int64(lineSize) > int64(a.config.MaxSizeMB)<<20 {
+		return true
+	}
+	return a.config.MaxAge > 0 && time.Since(a.openedAt) > a.config.MaxAge
+}
+
+// Renames the current file after the rotation time and deletes the oldest rotated files.
+func (a *AuditLog) rotate() error {
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+	rotated := filepath.Join(a.config.Dir, auditFilePrefix+time.Now().UTC().Format(auditTimeLayout)+".jsonl")
+	if err := os.Rename(a.path(), rotated); err != nil {
+		return err
+	}
+	if err := a.open(); err != nil {
+		return err
+	}
+
+	if a.config.MaxBackups <= 0 {
+		return nil
+	}
+	backups, err := a.rotatedFiles()
+	if err != nil {
+		return err
+	}
+	for i := a.config.MaxBackups; i < len(backups); i++ {
+		if err := os.Remove(backups[i]); err != nil {
+			logrus.Warnf("unable to remove audit file %s: %v", backups[i], err)
+		}
+	}
+	return nil
+}
+
+// Rotated files, newest first.
+func (a *AuditLog) rotatedFiles() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(a.config.Dir, auditFilePrefix+"*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(files)))
+	return files, nil
+}
+
+// Query returns the entries matching the filter, newest first.
+func (a *AuditLog) Query(filter AuditFilter) ([]AuditEntry, error) {
+	a.mutex.Lock()
+	rotated, err := a.rotatedFiles()
+	a.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []AuditEntry{}
+	done := false
+	for _, path := range append([]string{a.path()}, rotated...) {
+		err := readAuditFileBackward(path, func(entry AuditEntry) bool {
+			if !filter.To.IsZero() && entry.Time.After(filter.To) {
+				return true
+			}
+			if !filter.From.IsZero() && entry.Time.Before(filter.From) {
+				// Entries are in time order, older files can be skipped too.
+				done = true
+				return false
+			}
+			if filter.Username != "" && entry.Username != filter.Username {
+				return true
+			}
+			if filter.Event != "" && entry.Event != filter.Event {
+				return true
+			}
+			result = append(result, entry)
+			done = filter.Limit > 0 && len(result) >= filter.Limit
+			return !done
+		})
+		if errors.Is(err, os.ErrNotExist) {
+			// Rotated away or removed since the listing.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			break
+		}
+	}
+	return result, nil
+}
+
+// Size of the blocks read from the end of the audit files.
+const auditReadBlockSize = 64 * 1024
+
+// Calls visit with the entries of a file from the last one to the first one, until visit returns false. The file is
+// read backward by blocks, so that a query only reads the entries it visits.
+func readAuditFileBackward(path string, visit func(AuditEntry) bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	visitLine := func(line []byte) bool {
+		var entry AuditEntry
+		if len(bytes.TrimSpace(line)) == 0 || json.Unmarshal(line, &entry) != nil {
+			return true
+		}
+		return visit(entry)
+	}
+	block := make([]byte, auditReadBlockSize)
+	// Start of the line at the beginning of the blocks read so far, which may begin in the previous block.
+	var partial []byte
+	for offset := info.Size(); offset > 0; {
+		size := int64(auditReadBlockSize)
+		if offset < size {
+			size = offset
+		}
+		offset -= size
+		if _, err := f.ReadAt(block[:size], offset); err != nil {
+			return err
+		}
+		data := append(append([]byte{}, block[:size]...), partial...)
+		for {
+			i := bytes.LastIndexByte(data, '\n')
+			if i < 0 {
+				break
+			}
+			if !visitLine(data[i+1:]) {
+				return nil
+			}
+			data = data[:i]
+		}
+		partial = data
+	}
+	visitLine(partial)
+	return nil
+}
+
+// Reads the entries of a file in order, at most limit entries when limit is positive.
+func readAuditFile(path string, limit int) ([]AuditEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() && (limit <= 0 || len(entries) < limit) {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// Audit records an event of the request. The username and client ip are taken from the request when not set.
+func Audit(c *gin.Context, entry AuditEntry) {
+	v, exists := c.Get("audit")
+	if !exists {
+		return
+	}
+	if entry.Username == "" {
+		entry.Username = CurrentUsername(c)
+	}
+	if entry.ClientIP == "" {
+		entry.ClientIP = c.ClientIP()
+	}
+	if entry.APIToken == "" {
+		entry.APIToken = CurrentAPIToken(c)
+	}
+	entry.Query = strings.TrimSpace(entry.Query)
+	v.(*AuditLog).Record(entry)
+}
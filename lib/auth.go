@@ -3,6 +3,8 @@ package lib
 import (
 	"fmt"
 	"log"
+	"net/http"
+	"strconv"
 	"time"
 
 	jwt "github.com/appleboy/gin-jwt/v2"
@@ -11,75 +13,211 @@ import (
 )
 
 type user struct {
-	Username string
-	PWToken  string
+	Username  string
+	SessionID string
+	Role      string
 }
 
-func InitJwtMiddleware(secretKey string, timeout time.Duration) *jwt.GinJWTMiddleware {
+// The published default secret key of earlier versions, refused outside of debug mode.
+const insecureJWTSecretKey = "w74DbQ9ggSjk1VqfmAl9BvXvqj8EMGd6"
+
+// Set on the request when the JWT is valid but its session ended.
+const sessionEndedKey = "sessionEnded"
+
+// Set on the request when the login is rejected by the lockout, see LockoutConfig.
+const loginLockedKey = "loginLocked"
+
+// InitJwtMiddleware creates the JWT middleware. Without a secret key, a random key is generated: the JWTs only
+// reference sessions in memory, which end when the server restarts anyway. The cookie is only sent over HTTPS when
+// secureCookie is set.
+func InitJwtMiddleware(secretKey string, timeout time.Duration, secureCookie bool) *jwt.GinJWTMiddleware {
+	if secretKey == "" {
+		key, err := randomString()
+		if err != nil {
+			log.Fatal("JWT Error:" + err.Error())
+		}
+		secretKey = key
+	}
+
 	type login struct {
 		Username string `form:"username" json:"username" binding:"required"`
 		Password string `form:"password" json:"password" binding:"required"`
+		// Backend validating the credentials with USE_GREMLIN_AUTH, see loginBackend.
+		Backend string `form:"backend" json:"backend"`
 	}
 
 	// the jwt middleware
 	authMiddleware, err := jwt.New(&jwt.GinJWTMiddleware{
-		Realm:      "puppygraph",
-		Key:        []byte(secretKey),
-		Timeout:    timeout,
-		MaxRefresh: 0,
-		Authenticator: func(c *gin.Context) (interface{}, error) {
+		Realm:   "puppygraph",
+		Key:     []byte(secretKey),
+		Timeout: timeout,
+		// A JWT can be refreshed while it is valid, see RefreshHandler.
+		MaxRefresh: timeout,
+		Authenticator: func(c *gin.Context) (_ interface{}, err error) {
 			var loginVals login
 			if err := c.ShouldBind(&loginVals); err != nil {
 				return "", jwt.ErrMissingLoginValues
 			}
 			username := loginVals.Username
 			password := loginVals.Password
-
 			v, exists := c.Get("conf")
 			if !exists {
 				return "", fmt.Errorf("cannot load config")
 			}
 			conf := v.(*Config)
+
+			defer func() {
+				entry := AuditEntry{Event: AuditLogin, Username: username, Backend: c.GetString("loginBackend")}
+				if err != nil {
+					entry.Event = AuditLoginFailed
+					entry.Error = err.Error()
+					loginFailures.Inc()
+				}
+				Audit(c, entry)
+				// The attempts rejected by the lockout do not extend it.
+				if _, locked := c.Get(loginLockedKey); locked || !conf.Lockout.Enabled {
+					return
+				}
+				if err == nil {
+					loginAttempts.succeeded(username)
+					return
+				}
+				for _, key := range loginAttempts.failed(c.ClientIP(), username, conf.Lockout, time.Now()) {
+					logrus.Warnf("login locked out for %s after failed attempts", key)
+					Audit(c, AuditEntry{Event: AuditLoginLocked, Username: username, Query: key, Error: err.Error()})
+				}
+			}()
+
+			// Checked before the credentials, so that the gremlin server is not asked while locked out.
+			if conf.Lockout.Enabled {
+				if err := loginAttempts.check(c.ClientIP(), username, time.Now()); err != nil {
+					c.Set(loginLockedKey, err)
+					return "", err
+				}
+			}
+			if reservedUsername(username) {
+				return "", jwt.ErrFailedAuthentication
+			}
 			if conf.Authentication.GremlinAuth {
-				err := GremlinAuthCheck(conf, username, password)
+				backend, err := loginBackend(conf, loginVals.Backend)
+				if err != nil {
+					return "", err
+				}
+				c.Set("loginBackend", backend.Name)
+				err = GremlinAuthCheck(backend, username, password)
 				if err != nil {
-					logrus.Errorf("login error: %v", err)
+					logrus.Errorf("login error on backend %s: %v", backend.Name, err)
 					return "", err
 				}
+			} else if v, exists := c.Get("users"); exists {
+				localUser, err := v.(*UserStore).Authenticate(username, password)
+				if err != nil {
+					return "", err
+				}
+				c.Set("loginRole", localUser.Role)
 			} else {
 				if username != conf.Authentication.Admin.Username || password != conf.Authentication.Admin.Password {
 					return "", jwt.ErrFailedAuthentication
 				}
 			}
 
-			pwtoken, err := Encrypt([]byte(secretKey), password)
+			// The password is kept for the gremlin authentication of the queries of the session.
+			if !conf.Authentication.GremlinAuth {
+				password = ""
+			}
+			sessionID, err := sessions.create(username, password, timeout)
 			if err != nil {
-				logrus.Errorf("failed to encrypt: %v", err)
+				logrus.Errorf("failed to create session: %v", err)
 				return "", err
 			}
 
-			user := user{Username: username, PWToken: pwtoken}
+			role := c.GetString("loginRole")
+			if role == "" {
+				role = loginRole(conf, username)
+				c.Set("loginRole", role)
+			}
+
+			user := user{Username: username, SessionID: sessionID, Role: role}
 			return &user, nil
 		},
 		PayloadFunc: func(data interface{}) jwt.MapClaims {
-			// NOTE: When USE_GREMLIN_AUTH is enabled, this stored the encrypted password in JWT for later gremlin query authentication.
+			// The JWT only references the session, the gremlin password stays on the server.
 			if v, ok := data.(*user); ok {
 				return jwt.MapClaims{
 					"username": v.Username,
-					"pwtoken":  v.PWToken,
+					"sid":      v.SessionID,
+					"role":     v.Role,
 				}
 			}
 			return jwt.MapClaims{}
 		},
 		IdentityHandler: func(c *gin.Context) interface{} {
-			claims := jwt.ExtractClaims(c)
 			return &user{
-				Username: claims["username"].(string),
-				PWToken:  claims["pwtoken"].(string),
+				Username:  CurrentUsername(c),
+				SessionID: currentSessionID(c),
+				Role:      CurrentRole(c),
 			}
 		},
+		// A JWT is only valid with its session, which ends on logout. The role of the claims is replaced by the current
+		// role of the user.
+		Authorizator: func(data interface{}, c *gin.Context) bool {
+			v, ok := data.(*user)
+			if ok {
+				_, ok = sessions.get(v.SessionID)
+			}
+			if !ok {
+				c.Set(sessionEndedKey, true)
+				return false
+			}
+			conf, exists := c.Get("conf")
+			if !exists {
+				return false
+			}
+			role, err := currentUserRole(c, conf.(*Config), v.Username, v.Role)
+			if err != nil {
+				sessions.revoke(v.SessionID)
+				c.Set(sessionEndedKey, true)
+				return false
+			}
+			v.Role = role
+			jwt.ExtractClaims(c)["role"] = role
+			return true
+		},
+		Unauthorized: func(c *gin.Context, code int, message string) {
+			if c.GetBool(sessionEndedKey) {
+				code = http.StatusUnauthorized
+				message = ErrSessionEnded.Error()
+			}
+			if v, exists := c.Get(loginLockedKey); exists {
+				limitError := v.(*LimitError)
+				c.Header("Retry-After", strconv.Itoa(limitError.RetryAfter))
+				code = http.StatusTooManyRequests
+				message = limitError.Message
+			}
+			c.JSON(code, gin.H{"code": code, "message": message})
+		},
+		LoginResponse: func(c *gin.Context, code int, token string, expire time.Time) {
+			response := gin.H{
+				"code":   http.StatusOK,
+				"token":  token,
+				"expire": expire.Format(time.RFC3339),
+			}
+			if role, exists := c.Get("loginRole"); exists {
+				response["role"] = role
+			}
+			// The backend which validated the gremlin credentials.
+			if backend, exists := c.Get("loginBackend"); exists {
+				response["backend"] = backend
+			}
+			c.JSON(http.StatusOK, response)
+		},
 		TokenLookup: "header: Authorization, cookie: jwt",
 		SendCookie:  true,
+		// The cookie is not readable by the scripts of the page, nor sent by the requests of other sites. Lax keeps it
+		// on the redirect of the OIDC callback.
+		SecureCookie:   secureCookie,
+		CookieHTTPOnly: true,
+		CookieSameSite: http.SameSiteLaxMode,
 	})
 
 	if err != nil {
@@ -94,3 +232,68 @@ func InitJwtMiddleware(secretKey string, timeout time.Duration) *jwt.GinJWTMiddl
 
 	return authMiddleware
 }
+
+// AuthMiddleware authenticates the requests with an API token in the Authorization header, then the requests with a
+// JWT in the Authorization header or cookie with the JWT middleware. The other requests with a verified client
+// certificate are authenticated as its user. The claims of a token or certificate are the claims of a JWT of its user,
+// so that the handlers do not tell them apart.
+func AuthMiddleware(mw *jwt.GinJWTMiddleware) gin.HandlerFunc {
+	jwtMiddleware := mw.MiddlewareFunc()
+	return func(c *gin.Context) {
+		var claims jwt.MapClaims
+		var err error
+		if secret, ok := apiTokenSecret(c); ok {
+			claims, err = apiTokenClaims(c, secret)
+		} else if certificate, ok := clientCertificate(c); ok && !hasJWT(c, mw) {
+			claims, err = clientCertificateClaims(c, certificate)
+		} else {
+			jwtMiddleware(c)
+			return
+		}
+		if err != nil {
+			c.Header("WWW-Authenticate", "Bearer realm="+mw.Realm)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"code": http.StatusUnauthorized, "message": err.Error()})
+			return
+		}
+		c.Set("JWT_PAYLOAD", claims)
+		c.Set(mw.IdentityKey, mw.IdentityHandler(c))
+		c.Next()
+	}
+}
+
+// Tells whether the request has a JWT, which takes precedence over the client certificate: a user logged in with a
+// password keeps the session of its gremlin credentials. A stale cookie does not hide the certificate.
+func hasJWT(c *gin.Context, mw *jwt.GinJWTMiddleware) bool {
+	if c.GetHeader("Authorization") != "" {
+		return true
+	}
+	// Expired JWTs are rejected by the parser.
+	claims, err := mw.GetClaimsFromJWT(c)
+	if err != nil {
+		return false
+	}
+	id, _ := claims["sid"].(string)
+	_, ok := sessions.get(id)
+	return ok
+}
+
+// Returns the backend validating the credentials of a login. Without a backend in the login request, this is the
+// first backend authenticating the queries with the credentials of the user.
+func loginBackend(config *Config, name string) (*Backend, error) {
+	if name != "" {
+		backend, err := config.Backend(name)
+		if err != nil {
+			return nil, err
+		}
+		if backend.Auth != BackendAuthUser {
+			return nil, fmt.Errorf("backend %s does not use gremlin authentication", name)
+		}
+		return backend, nil
+	}
+	for _, backend := range config.AllBackends() {
+		if backend.Auth == BackendAuthUser {
+			return backend, nil
+		}
+	}
+	return nil, fmt.Errorf("no backend uses gremlin authentication")
+}
@@ -0,0 +1,140 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Authentication modes of the queries sent to a backend.
+const (
+	// Credentials of the logged in user, validated at login. Requires USE_GREMLIN_AUTH.
+	BackendAuthUser = "user"
+	// Username and password of the backend config, shared by all users.
+	BackendAuthStatic = "static"
+	// No authentication.
+	BackendAuthNone = "none"
+)
+
+// Backend is a gremlin server the queries can be sent to.
+type Backend struct {
+	// Name used by the clients to select the backend.
+	Name           string            `json:"name" yaml:"name" default:"default"`
+	Host           string            `json:"host" yaml:"host" default:"127.0.0.1:8182"`
+	Path           string            `json:"path" yaml:"path" default:"/gremlin"`
+	Url            string            `json:"url" yaml:"url" default:""`
+	Aliases        map[string]string `json:"aliases" yaml:"aliases" default:""`
+	SkipCertVerify bool              `json:"skipCertVerify" yaml:"skipCertVerify" default:"false"`
+	// Aliases of the requests of readers, over the aliases, e.g. g:g_readonly for a traversal source of the gremlin
+	// server with the ReadOnlyStrategy.
+	ReadOnlyAliases map[string]string `json:"readOnlyAliases" yaml:"readOnlyAliases" default:""`
+	// One of "user", "static" or "none". Defaults to "user" when USE_GREMLIN_AUTH is enabled, "none" otherwise.
+	Auth     string `json:"auth" yaml:"auth" default:""`
+	Username string `json:"username" yaml:"username" default:""`
+	Password string `json:"password" yaml:"password" default:""`
+	// PuppyGraph schema JSON, a file or an http url, read by the schema endpoint instead of sampling the graph.
+	Schema string `json:"schema" yaml:"schema" default:""`
+	// The pool of the additional backends is the pool of the default backend.
+	Pool PoolConfig `json:"-" yaml:"pool"`
+}
+
+// WsUrl is the websocket url of the gremlin server.
+func (b *Backend) WsUrl() string {
+	if b.Url != "" {
+		return b.Url
+	} else {
+		return "ws://" + b.Host + b.Path
+	}
+}
+
+// AliasesFor returns the aliases of the requests of a user, with the read-only aliases for readers.
+func (b *Backend) AliasesFor(readOnly bool) map[string]string {
+	if !readOnly || len(b.ReadOnlyAliases) == 0 {
+		return b.Aliases
+	}
+	aliases := make(map[string]string, len(b.Aliases)+len(b.ReadOnlyAliases))
+	for key, value := range b.Aliases {
+		aliases[key] = value
+	}
+	for key, value := range b.ReadOnlyAliases {
+		aliases[key] = value
+	}
+	return aliases
+}
+
+// BackendList is decoded from a JSON list by envconfig.
+type BackendList []Backend
+
+// Decode implements envconfig.Decoder.
+func (l *BackendList) Decode(value string) error {
+	var backends []Backend
+	if err := json.Unmarshal([]byte(value), &backends); err != nil {
+		return fmt.Errorf("backends must be a JSON list: %v", err)
+	}
+	*l = backends
+	return nil
+}
+
+// Fills the defaults of the additional backends and validates all of them.
+func (config *Config) initBackends() error {
+	names := map[string]bool{}
+	for _, backend := range config.AllBackends() {
+		if backend != &config.GremlinServer {
+			if backend.Url == "" && backend.Host == "" {
+				return fmt.Errorf("backend %q: missing url", backend.Name)
+			}
+			if backend.Url == "" && backend.Path == "" {
+				backend.Path = "/gremlin"
+			}
+			backend.Pool = config.GremlinServer.Pool
+		}
+		if backend.Name == "" {
+			return fmt.Errorf("missing backend name")
+		}
+		if names[backend.Name] {
+			return fmt.Errorf("duplicate backend name %q", backend.Name)
+		}
+		names[backend.Name] = true
+		if backend.Auth == "" {
+			backend.Auth = BackendAuthNone
+			if config.Authentication.GremlinAuth {
+				backend.Auth = BackendAuthUser
+			}
+		}
+		switch backend.Auth {
+		case BackendAuthUser:
+			if !config.Authentication.GremlinAuth {
+				return fmt.Errorf("backend %q: auth %q requires USE_GREMLIN_AUTH", backend.Name, backend.Auth)
+			}
+		case BackendAuthStatic:
+			if backend.Username == "" {
+				return fmt.Errorf("backend %q: auth %q requires a username", backend.Name, backend.Auth)
+			}
+		case BackendAuthNone:
+		default:
+			return fmt.Errorf("backend %q: unknown auth %q", backend.Name, backend.Auth)
+		}
+	}
+	return nil
+}
+
+// AllBackends returns the default backend followed by the additional backends.
+func (config *Config) AllBackends() []*Backend {
+	backends := []*Backend{&config.GremlinServer}
+	for i := range config.Backends {
+		backends = append(backends, &config.Backends[i])
+	}
+	return backends
+}
+
+// Backend returns the backend with the given name, the default backend when name is empty.
+func (config *Config) Backend(name string) (*Backend, error) {
+	if name == "" {
+		return &config.GremlinServer, nil
+	}
+	for _, backend := range config.AllBackends() {
+		if backend.Name == name {
+			return backend, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown backend %q", name)
+}
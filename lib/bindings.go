@@ -0,0 +1,169 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+
+	"github.com/google/uuid"
+)
+
+var bindingNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Binding names which would shadow the traversal source in the script.
+var reservedBindingNames = map[string]bool{
+	"g":     true,
+	"graph": true,
+}
+
+// ParseBindings validates query bindings sent by the client and converts them to GraphSON 3 values, which are
+// forwarded as is by the graphson serializer.
+//
+// The aliases of the backend are reserved binding names.
+//
+// Values can either be typed GraphSON, e.g. {"@type": "g:Int64", "@value": 1}, or plain JSON. Plain integers are sent
+// as g:Int64 so that queries against numeric ids work, other numbers as g:Double, arrays as g:List and objects as
+// g:Map.
+func ParseBindings(backend *Backend, raw map[string]json.RawMessage) (map[string]interface{}, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	bindings := make(map[string]interface{}, len(raw))
+	for name, value := range raw {
+		if !bindingNameRe.MatchString(name) {
+			return nil, fmt.Errorf("invalid binding name %q", name)
+		}
+		if _, isAlias := backend.AliasesFor(true)[name]; isAlias || reservedBindingNames[name] {
+			return nil, fmt.Errorf("binding name %q is reserved", name)
+		}
+		normalized, err := normalizeGraphson(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid binding %q: %v", name, err)
+		}
+		bindings[name] = normalized
+	}
+	return bindings, nil
+}
+
+type typedValue struct {
+	Type  string          `json:"@type"`
+	Value json.RawMessage `json:"@value"`
+}
+
+func typed(typeName string, value interface{}) (json.RawMessage, error) {
+	valueBytes, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(typedValue{Type: typeName, Value: valueBytes})
+}
+
+func normalizeGraphson(raw json.RawMessage) (json.RawMessage, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	switch v := value.(type) {
+	case nil, bool, string:
+		return json.Marshal(v)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return typed("g:Int64", i)
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return typed("g:Double", f)
+	case []interface{}:
+		var items []json.RawMessage
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return nil, err
+		}
+		return normalizeList("g:List", items)
+	case map[string]interface{}:
+		if _, ok := v["@type"]; ok {
+			var tv typedValue
+			if err := json.Unmarshal(raw, &tv); err != nil {
+				return nil, err
+			}
+			return normalizeTyped(tv)
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return nil, err
+		}
+		flattened := make([]json.RawMessage, 0, 2*len(fields))
+		for key, field := range fields {
+			keyBytes, _ := json.Marshal(key)
+			flattened = append(flattened, keyBytes, field)
+		}
+		return normalizeList("g:Map", flattened)
+	}
+	return nil, fmt.Errorf("unsupported value %s", string(raw))
+}
+
+func normalizeList(typeName string, items []json.RawMessage) (json.RawMessage, error) {
+	normalized := make([]json.RawMessage, len(items))
+	for i, item := range items {
+		var err error
+		if normalized[i], err = normalizeGraphson(item); err != nil {
+			return nil, err
+		}
+	}
+	return typed(typeName, normalized)
+}
+
+func normalizeTyped(tv typedValue) (json.RawMessage, error) {
+	switch tv.Type {
+	case "g:Int32":
+		var i int64
+		if err := json.Unmarshal(tv.Value, &i); err != nil || i < math.MinInt32 || i > math.MaxInt32 {
+			return nil, fmt.Errorf("%s value must be a 32-bit integer", tv.Type)
+		}
+		return typed(tv.Type, i)
+	case "g:Int64", "g:Date", "g:Timestamp":
+		var i int64
+		if err := json.Unmarshal(tv.Value, &i); err != nil {
+			return nil, fmt.Errorf("%s value must be an integer", tv.Type)
+		}
+		return typed(tv.Type, i)
+	case "g:Float", "g:Double":
+		var f float64
+		if err := json.Unmarshal(tv.Value, &f); err != nil {
+			return nil, fmt.Errorf("%s value must be a number", tv.Type)
+		}
+		return typed(tv.Type, f)
+	case "g:UUID":
+		var s string
+		if err := json.Unmarshal(tv.Value, &s); err != nil {
+			return nil, fmt.Errorf("%s value must be a string", tv.Type)
+		}
+		id, err := uuid.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s value: %v", tv.Type, err)
+		}
+		return typed(tv.Type, id.String())
+	case "g:T", "g:Direction":
+		var s string
+		if err := json.Unmarshal(tv.Value, &s); err != nil {
+			return nil, fmt.Errorf("%s value must be a string", tv.Type)
+		}
+		return typed(tv.Type, s)
+	case "g:List", "g:Set", "g:Map":
+		var items []json.RawMessage
+		if err := json.Unmarshal(tv.Value, &items); err != nil {
+			return nil, fmt.Errorf("%s value must be an array", tv.Type)
+		}
+		if tv.Type == "g:Map" && len(items)%2 != 0 {
+			return nil, fmt.Errorf("%s value must have an even number of items", tv.Type)
+		}
+		return normalizeList(tv.Type, items)
+	}
+	return nil, fmt.Errorf("unsupported type %q", tv.Type)
+}
@@ -1,47 +1,272 @@
 package lib
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strings"
 	"time"
 
 	"github.com/kelseyhightower/envconfig"
 	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
 )
 
+// PoolConfig controls the long-lived gremlin connections kept per credential.
+type PoolConfig struct {
+	// Maximum number of websockets opened for a single user. Default: 4
+	MaximumConcurrentConnections int `yaml:"maximumConcurrentConnections" default:"4"`
+	// Minimum amount of in-flight queries on the least used websocket to trigger opening a new one.
+	NewConnectionThreshold int `yaml:"newConnectionThreshold" default:"4"`
+	// Connections of a user are closed after being unused for this duration. Zero disables eviction.
+	IdleTimeout time.Duration `yaml:"idleTimeout" default:"10m"`
+}
+
+// StorageConfig controls the files of the query history and saved queries.
+type StorageConfig struct {
+	// Directory of the store files, created when missing.
+	Dir string `yaml:"dir" default:"./data"`
+	// Number of history entries kept per user.
+	HistoryLimit int `yaml:"historyLimit" default:"1000"`
+}
+
+// Config is loaded from the environment, layered over the optional config file, see LoadConfig.
 type Config struct {
-	Port           int  `default:"8081"`
-	Debug          bool `default:"false"`
+	// YAML config file. The environment variables take precedence over it.
+	ConfigFile string `yaml:"-" envconfig:"CONFIG_FILE" default:""`
+	// How often the config file is checked for changes. Zero disables the reload.
+	ConfigReloadInterval time.Duration `yaml:"-" envconfig:"CONFIG_RELOAD_INTERVAL" default:"5s"`
+
+	Port  int  `yaml:"port" default:"8081"`
+	Debug bool `yaml:"debug" default:"false"`
+	// Addresses or CIDRs of the reverse proxies whose X-Forwarded-For header gives the client IP. None by default, the
+	// client IP is the address of the connection.
+	TrustedProxies []string `yaml:"trustedProxies" envconfig:"TRUSTED_PROXIES" default:""`
+	// HTTPS and client certificates, see TLSConfig.
+	TLS            TLSConfig `yaml:"tls"`
 	Authentication struct {
-		GremlinAuth bool `envconfig:"USE_GREMLIN_AUTH" default:"false"`
-		Admin       struct {
-			Username string `envconfig:"PUPPYGRAPH_USERNAME" default:"puppygraph"`
-			Password string `envconfig:"PUPPYGRAPH_PASSWORD" default:"888888"`
-		}
+		GremlinAuth bool `yaml:"useGremlinAuth" envconfig:"USE_GREMLIN_AUTH" default:"false"`
+		// Roles of the gremlin auth users by username, e.g. alice:admin,bob:reader.
+		UserRoles map[string]string `yaml:"userRoles" envconfig:"USER_ROLES" default:""`
+		// Role of the gremlin auth users without a role in UserRoles.
+		DefaultRole string `yaml:"defaultRole" envconfig:"DEFAULT_ROLE" default:"admin"`
+		// YAML file of local users with bcrypt passwords, replacing the admin user. Created when missing.
+		UsersFile string `yaml:"usersFile" envconfig:"USERS_FILE" default:""`
+		Admin     struct {
+			Username string `yaml:"username" envconfig:"PUPPYGRAPH_USERNAME" default:"puppygraph"`
+			Password string `yaml:"password" envconfig:"PUPPYGRAPH_PASSWORD" default:"888888"`
+			Role     string `yaml:"role" envconfig:"PUPPYGRAPH_ROLE" default:"admin"`
+		} `yaml:"admin"`
 		FrontendJWT struct {
-			Timeout   time.Duration `default:"24h"`
-			SecretKey string        `default:"w74DbQ9ggSjk1VqfmAl9BvXvqj8EMGd6"`
-		}
-	}
-	GremlinServer struct {
-		Host           string            `default:"127.0.0.1:8182"`
-		Path           string            `default:"/gremlin"`
-		Url            string            `defualt:""`
-		Aliases        map[string]string `default:""`
-		SkipCertVerify bool              `default:"false"`
-	}
+			Timeout time.Duration `yaml:"timeout" default:"24h"`
+			// How long a session can be extended by /refresh_token after its login.
+			MaxSessionLifetime time.Duration `yaml:"maxSessionLifetime" default:"168h"`
+			// Key signing the JWTs, a random key when empty.
+			SecretKey string `yaml:"secretKey" envconfig:"JWT_SECRET_KEY" default:""`
+		} `yaml:"frontendJWT"`
+		OIDC OIDCConfig `yaml:"oidc"`
+		// How long the API tokens are valid after their creation.
+		APITokenLifetime time.Duration `yaml:"apiTokenLifetime" envconfig:"API_TOKEN_LIFETIME" default:"2160h"`
+	} `yaml:"authentication"`
+	// The default backend.
+	GremlinServer Backend `yaml:"gremlinServer"`
+	// Additional backends, a JSON list of backends, e.g. [{"name": "staging", "url": "wss://staging:8182/gremlin"}].
+	Backends BackendList `yaml:"backends" envconfig:"GREMLIN_BACKENDS" default:""`
 	Prefetch struct {
-		BatchSize  int `default:"100"`
-		BatchCount int `default:"10"`
-	}
+		BatchSize  int `yaml:"batchSize" default:"100"`
+		BatchCount int `yaml:"batchCount" default:"10"`
+	} `yaml:"prefetch"`
+	Storage       StorageConfig `yaml:"storage"`
+	Audit         AuditConfig   `yaml:"audit"`
+	Metrics       MetricsConfig `yaml:"metrics"`
+	Limits        LimitsConfig  `yaml:"limits"`
+	Lockout       LockoutConfig `yaml:"lockout"`
+	Schema        SchemaConfig  `yaml:"schema"`
+	Expand        ExpandConfig  `yaml:"expand"`
+	Paths         PathsConfig   `yaml:"paths"`
+	Export        ExportConfig  `yaml:"export"`
 	Customization struct {
-		Watermark string `envconfig:"WATERMARK" default:""`
-	}
+		Watermark string `yaml:"watermark" envconfig:"WATERMARK" default:""`
+	} `yaml:"customization"`
 }
 
 func LoadConfig() (*Config, error) {
-	var conf Config
-	if err := envconfig.Process("", &conf); err != nil {
-		logrus.Error("unable to load config", err)
+	conf, err := loadConfig()
+	if err != nil {
+		logrus.Error("unable to load config: ", err)
+		return nil, err
+	}
+	return conf, nil
+}
+
+func loadConfig() (*Config, error) {
+	var env Config
+	if err := envconfig.Process("", &env); err != nil {
+		return nil, err
+	}
+	conf := env
+	if env.ConfigFile != "" {
+		// The file is decoded over a second copy, so that env keeps the values of the environment.
+		conf = Config{}
+		if err := envconfig.Process("", &conf); err != nil {
+			return nil, err
+		}
+		if err := decodeConfigFile(env.ConfigFile, &conf); err != nil {
+			return nil, err
+		}
+		restoreEnv(reflect.ValueOf(&conf).Elem(), reflect.ValueOf(&env).Elem(), "")
+	}
+	if err := conf.validate(); err != nil {
 		return nil, err
 	}
 	return &conf, nil
 }
+
+func decodeConfigFile(path string, conf *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read config file: %v", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	// Report typos instead of silently ignoring the setting.
+	decoder.KnownFields(true)
+	if err := decoder.Decode(conf); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// Copies the fields set in the environment from env to conf. The keys follow the rules of envconfig: the upper case
+// field name or envconfig tag, prefixed with the key of the parent struct. A field with an envconfig tag can also be
+// set by the tag alone.
+func restoreEnv(conf reflect.Value, env reflect.Value, prefix string) {
+	t := conf.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		alt := strings.ToUpper(field.Tag.Get("envconfig"))
+		key := strings.ToUpper(field.Name)
+		if alt != "" {
+			key = alt
+		}
+		if prefix != "" {
+			key = prefix + "_" + key
+		}
+
+		if field.Type.Kind() == reflect.Struct && !isEnvDecoder(conf.Field(i)) {
+			restoreEnv(conf.Field(i), env.Field(i), key)
+			continue
+		}
+		_, ok := os.LookupEnv(key)
+		if !ok && alt != "" {
+			_, ok = os.LookupEnv(alt)
+		}
+		if ok {
+			conf.Field(i).Set(env.Field(i))
+		}
+	}
+}
+
+func isEnvDecoder(v reflect.Value) bool {
+	_, ok := v.Addr().Interface().(envconfig.Decoder)
+	return ok
+}
+
+// Validates the config and reports all the invalid settings at once.
+func (config *Config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(config.Port > 0 && config.Port < 65536, "port must be between 1 and 65535, got %d", config.Port)
+	check(config.ConfigReloadInterval >= 0, "config reload interval must not be negative")
+	for _, proxy := range config.TrustedProxies {
+		_, _, err := net.ParseCIDR(proxy)
+		check(err == nil || net.ParseIP(proxy) != nil, "invalid trusted proxy %q, expected an IP or a CIDR", proxy)
+	}
+	if tlsConfig := config.TLS; tlsConfig.Enabled() {
+		check(tlsConfig.KeyFile != "", "TLS key file is required")
+		check(tlsConfig.ReloadInterval >= 0, "TLS reload interval must not be negative")
+		switch tlsConfig.ClientAuth {
+		case ClientAuthNone:
+		case ClientAuthOptional, ClientAuthRequire:
+			check(tlsConfig.ClientCAFile != "", "TLS client CA file is required with client auth %s", tlsConfig.ClientAuth)
+		default:
+			check(false, "unknown TLS client auth %q, expected none, optional or require", tlsConfig.ClientAuth)
+		}
+		check(tlsConfig.ClientDefaultRole == "" || validRole(tlsConfig.ClientDefaultRole), "unknown TLS client default role %q", tlsConfig.ClientDefaultRole)
+		for username, role := range tlsConfig.ClientRoles {
+			check(validRole(role), "unknown role %q of TLS client %s", role, username)
+		}
+	} else {
+		check(config.TLS.ClientAuth == ClientAuthNone, "TLS client auth requires a TLS certificate file")
+	}
+	if n := len(config.Authentication.FrontendJWT.SecretKey); n > 0 {
+		check(n >= 16, "JWT secret key must be at least 16 bytes long, got %d", n)
+	}
+	check(config.Debug || config.Authentication.FrontendJWT.SecretKey != insecureJWTSecretKey,
+		"JWT secret key is the published default key, set another key or none for a random key")
+	check(!reservedUsername(config.Authentication.Admin.Username), "the %s prefix of the admin user is reserved for the OIDC users", oidcUsernamePrefix)
+	check(validRole(config.Authentication.Admin.Role), "unknown role %q of the admin user", config.Authentication.Admin.Role)
+	check(validRole(config.Authentication.DefaultRole), "unknown default role %q", config.Authentication.DefaultRole)
+	for username, role := range config.Authentication.UserRoles {
+		check(validRole(role), "unknown role %q of user %s", role, username)
+	}
+	check(config.Authentication.FrontendJWT.Timeout > 0, "JWT timeout must be positive")
+	check(config.Authentication.FrontendJWT.MaxSessionLifetime >= config.Authentication.FrontendJWT.Timeout, "JWT max session lifetime must not be less than the timeout")
+	check(config.Authentication.APITokenLifetime > 0, "API token lifetime must be positive")
+	if oidcConfig := config.Authentication.OIDC; oidcConfig.Enabled() {
+		check(oidcConfig.ClientID != "", "OIDC client id is required")
+		check(oidcConfig.RedirectURL != "", "OIDC redirect url is required")
+		check(oidcConfig.DefaultRole == "" || validRole(oidcConfig.DefaultRole), "unknown OIDC default role %q", oidcConfig.DefaultRole)
+		for value, role := range oidcConfig.RoleMapping {
+			check(validRole(role), "unknown role %q of OIDC claim value %s", role, value)
+		}
+	}
+	check(config.Prefetch.BatchSize > 0, "prefetch batch size must be positive, got %d", config.Prefetch.BatchSize)
+	check(config.Prefetch.BatchCount > 0, "prefetch batch count must be positive, got %d", config.Prefetch.BatchCount)
+	check(config.Storage.Dir != "", "storage dir must not be empty")
+	check(config.Storage.HistoryLimit >= 0, "storage history limit must not be negative")
+	if config.Audit.Enabled {
+		check(config.Audit.Dir != "", "audit dir must not be empty")
+	}
+	check(config.Audit.MaxSizeMB >= 0, "audit max size must not be negative")
+	check(config.Audit.MaxAge >= 0, "audit max age must not be negative")
+	check(config.Audit.MaxBackups >= 0, "audit max backups must not be negative")
+	check(config.Export.MaxSpoolSizeMB >= 0, "export max spool size must not be negative")
+	check(config.Export.MaxIDs > 0, "export max ids must be positive, got %d", config.Export.MaxIDs)
+	check(config.Limits.MaxConcurrentQueriesPerUser >= 0, "max concurrent queries per user must not be negative")
+	check(config.Limits.MaxConcurrentQueries >= 0, "max concurrent queries must not be negative")
+	check(config.Limits.RequestsPerMinute >= 0, "requests per minute must not be negative")
+	check(config.Limits.QueueTimeout >= 0, "queue timeout must not be negative")
+	check(config.Lockout.FreeAttempts >= 0, "lockout free attempts must not be negative")
+	check(config.Lockout.BaseDelay > 0, "lockout base delay must be positive")
+	check(config.Lockout.MaxDelay >= config.Lockout.BaseDelay, "lockout max delay must not be less than the base delay")
+	check(config.Lockout.MaxFailuresPerUser > 0, "lockout max failures per user must be positive, got %d", config.Lockout.MaxFailuresPerUser)
+	check(config.Lockout.MaxFailuresPerIP > 0, "lockout max failures per IP must be positive, got %d", config.Lockout.MaxFailuresPerIP)
+	check(config.Lockout.Duration > 0, "lockout duration must be positive")
+	check(config.Lockout.Window > 0, "lockout window must be positive")
+	check(config.Schema.CacheTTL >= 0, "schema cache ttl must not be negative")
+	check(config.Schema.SampleSize > 0, "schema sample size must be positive, got %d", config.Schema.SampleSize)
+	check(config.Expand.MaxHops > 0, "expand max hops must be positive, got %d", config.Expand.MaxHops)
+	check(config.Expand.MaxResults > 0, "expand max results must be positive, got %d", config.Expand.MaxResults)
+	check(config.Paths.MaxDepth > 0, "paths max depth must be positive, got %d", config.Paths.MaxDepth)
+	check(config.Paths.MaxPaths > 0, "paths max paths must be positive, got %d", config.Paths.MaxPaths)
+	check(config.Paths.Timeout > 0, "paths timeout must be positive")
+	pool := config.GremlinServer.Pool
+	check(pool.MaximumConcurrentConnections > 0, "pool maximum concurrent connections must be positive")
+	check(pool.NewConnectionThreshold > 0, "pool new connection threshold must be positive")
+	check(pool.IdleTimeout >= 0, "pool idle timeout must not be negative")
+	if err := config.initBackends(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
@@ -1,56 +0,0 @@
-package lib
-
-import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
-	"encoding/base64"
-	"errors"
-	"io"
-)
-
-func Encrypt(key []byte, message string) (encoded string, err error) {
-	plainText := []byte(message)
-
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return
-	}
-
-	cipherText := make([]byte, aes.BlockSize+len(plainText))
-
-	iv := cipherText[:aes.BlockSize]
-	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
-		return
-	}
-
-	stream := cipher.NewCFBEncrypter(block, iv)
-	stream.XORKeyStream(cipherText[aes.BlockSize:], plainText)
-
-	return base64.RawStdEncoding.EncodeToString(cipherText), err
-}
-
-func Decrypt(key []byte, secure string) (decoded string, err error) {
-	cipherText, err := base64.RawStdEncoding.DecodeString(secure)
-	if err != nil {
-		return
-	}
-
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return
-	}
-
-	if len(cipherText) < aes.BlockSize {
-		err = errors.New("ciphertext block size is too short")
-		return
-	}
-
-	iv := cipherText[:aes.BlockSize]
-	cipherText = cipherText[aes.BlockSize:]
-
-	stream := cipher.NewCFBDecrypter(block, iv)
-	stream.XORKeyStream(cipherText, cipherText)
-
-	return string(cipherText), err
-}
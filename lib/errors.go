@@ -0,0 +1,98 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	gremlingo "github.com/apache/tinkerpop/gremlin-go/driver"
+)
+
+// Gremlin server response status codes, see org.apache.tinkerpop.gremlin.util.message.ResponseStatusCode.
+const (
+	gremlinUnauthorized              = 401
+	gremlinForbidden                 = 403
+	gremlinAuthenticate              = 407
+	gremlinRequestErrorSerialization = 497
+	gremlinMalformedRequest          = 498
+	gremlinInvalidRequestArguments   = 499
+	gremlinServerErrorTemporary      = 596
+	gremlinScriptEvaluationError     = 597
+	gremlinServerTimeout             = 598
+)
+
+// statusClientClosedRequest is the nginx convention for requests abandoned by the client.
+const statusClientClosedRequest = 499
+
+// QueryError is the JSON error body of failed gremlin requests.
+type QueryError struct {
+	// HTTP status code of the response, derived from the gremlin status code.
+	Status int `json:"-"`
+	// Gremlin server status code, zero when the gremlin server did not respond.
+	Code       int    `json:"code"`
+	Exception  string `json:"exception,omitempty"`
+	Message    string `json:"message"`
+	StackTrace string `json:"stackTrace,omitempty"`
+	RequestID  string `json:"requestId,omitempty"`
+	// Seconds before a query rejected by a limit should be retried, the Retry-After header.
+	RetryAfter int `json:"-"`
+}
+
+func (e *QueryError) Error() string {
+	return e.Message
+}
+
+func newUnavailableError(err error) *QueryError {
+	return &QueryError{Status: http.StatusServiceUnavailable, Message: fmt.Sprintf("gremlin server unavailable: %v", err)}
+}
+
+// NewQueryError converts an error of a gremlin request to a QueryError. The details are taken from the status of
+// the gremlin server response when there is one.
+func NewQueryError(err error) *QueryError {
+	var queryError *QueryError
+	if errors.As(err, &queryError) {
+		return queryError
+	}
+	if errors.Is(err, ErrQueryCancelled) {
+		return &QueryError{Status: statusClientClosedRequest, Message: err.Error()}
+	}
+	var limitError *LimitError
+	if errors.As(err, &limitError) {
+		return &QueryError{Status: http.StatusTooManyRequests, Message: limitError.Message, RetryAfter: limitError.RetryAfter}
+	}
+
+	var responseError *gremlingo.ResponseError
+	if !errors.As(err, &responseError) {
+		return &QueryError{Status: http.StatusBadGateway, Message: err.Error()}
+	}
+	queryError = &QueryError{
+		Status:    gremlinStatusToHttp(responseError.StatusCode),
+		Code:      int(responseError.StatusCode),
+		Message:   responseError.Message,
+		RequestID: responseError.RequestID,
+	}
+	if exceptions, ok := responseError.Attributes["exceptions"].([]interface{}); ok && len(exceptions) > 0 {
+		queryError.Exception = fmt.Sprint(exceptions[0])
+	}
+	if stackTrace, ok := responseError.Attributes["stackTrace"].(string); ok {
+		queryError.StackTrace = stackTrace
+	}
+	return queryError
+}
+
+func gremlinStatusToHttp(code uint16) int {
+	switch code {
+	case gremlinUnauthorized, gremlinAuthenticate:
+		return http.StatusUnauthorized
+	case gremlinForbidden:
+		return http.StatusForbidden
+	case gremlinRequestErrorSerialization, gremlinMalformedRequest, gremlinInvalidRequestArguments, gremlinScriptEvaluationError:
+		return http.StatusBadRequest
+	case gremlinServerTimeout:
+		return http.StatusGatewayTimeout
+	case gremlinServerErrorTemporary:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadGateway
+	}
+}
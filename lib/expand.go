@@ -0,0 +1,227 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ExpandConfig bounds the neighborhood expansions.
+type ExpandConfig struct {
+	MaxHops int `yaml:"maxHops" default:"3"`
+	// Maximum number of new vertices and edges returned by an expansion.
+	MaxResults int `yaml:"maxResults" default:"500"`
+}
+
+// ExpandFilter keeps the edges whose property compares to the value. The value is plain JSON or typed GraphSON.
+type ExpandFilter struct {
+	Prop string `json:"prop"`
+	// eq, neq, gt, gte, lt or lte.
+	Op    string          `json:"op"`
+	Value json.RawMessage `json:"value"`
+}
+
+var expandOps = map[string]bool{"eq": true, "neq": true, "gt": true, "gte": true, "lt": true, "lte": true}
+
+// ExpandRequest expands the neighborhood of vertices. Ids are plain JSON or typed GraphSON values.
+type ExpandRequest struct {
+	IDs []json.RawMessage `json:"ids"`
+	// out, in or both.
+	Direction  string         `json:"direction"`
+	EdgeLabels []string       `json:"edgeLabels"`
+	Hops       int            `json:"hops"`
+	Limit      int            `json:"limit"`
+	Filters    []ExpandFilter `json:"filters"`
+	// Elements the client already has, left out of the result.
+	KnownVertices []json.RawMessage `json:"knownVertices"`
+	KnownEdges    []json.RawMessage `json:"knownEdges"`
+	Backend       string            `json:"backend"`
+}
+
+// Subgraph is a set of paths with their vertices and edges, the vertices and edges are elementMap() values.
+type Subgraph struct {
+	Vertices []*GraphElement `json:"vertices"`
+	Edges    []*GraphElement `json:"edges"`
+	// Ids of the vertices and edges of each path, alternating vertices and edges.
+	Paths [][]interface{} `json:"paths"`
+}
+
+func newSubgraph() Subgraph {
+	return Subgraph{Vertices: []*GraphElement{}, Edges: []*GraphElement{}, Paths: [][]interface{}{}}
+}
+
+// ExpandResult is the subgraph of an expansion, its paths start from the requested vertices.
+type ExpandResult struct {
+	Subgraph
+	// Set when the result was cut at ExpandConfig.MaxResults.
+	Truncated bool `json:"truncated"`
+}
+
+// Steps of an expansion by direction: the edges, then the vertex at the other end.
+var expandSteps = map[string][2]string{
+	"out":  {"outE()", "inV()"},
+	"in":   {"inE()", "outV()"},
+	"both": {"bothE()", "otherV()"},
+}
+
+// Builds the script of an expansion. Every value of the request is a binding, only the shape of the script depends
+// on the request.
+func (req *ExpandRequest) script(config *Config) (string, map[string]json.RawMessage, error) {
+	if len(req.IDs) == 0 {
+		return "", nil, fmt.Errorf("missing ids")
+	}
+	if req.Direction == "" {
+		req.Direction = "out"
+	}
+	steps, ok := expandSteps[req.Direction]
+	if !ok {
+		return "", nil, fmt.Errorf("invalid direction %q, expected out, in or both", req.Direction)
+	}
+	if req.Hops == 0 {
+		req.Hops = 1
+	}
+	if req.Hops < 0 || req.Hops > config.Expand.MaxHops {
+		return "", nil, fmt.Errorf("invalid hops %d, expected 1 to %d", req.Hops, config.Expand.MaxHops)
+	}
+	if req.Limit < 0 {
+		return "", nil, fmt.Errorf("invalid limit %d", req.Limit)
+	}
+
+	ids, err := json.Marshal(req.IDs)
+	if err != nil {
+		return "", nil, err
+	}
+	bindings := map[string]json.RawMessage{"expandIds": ids}
+	bind := func(name string, value interface{}) {
+		bindings[name], _ = json.Marshal(value)
+	}
+
+	edges := steps[0]
+	if len(req.EdgeLabels) > 0 {
+		edges += ".hasLabel(within(expandLabels))"
+		bind("expandLabels", req.EdgeLabels)
+	}
+	for i, filter := range req.Filters {
+		if filter.Prop == "" || !expandOps[filter.Op] || len(filter.Value) == 0 {
+			return "", nil, fmt.Errorf("invalid filter %q %q, expected a prop, an op (eq, neq, gt, gte, lt or lte) and a value", filter.Prop, filter.Op)
+		}
+		edges += fmt.Sprintf(".has(expandProp%d, %s(expandValue%d))", i, filter.Op, i)
+		bind(fmt.Sprintf("expandProp%d", i), filter.Prop)
+		bindings[fmt.Sprintf("expandValue%d", i)] = filter.Value
+	}
+	if req.Limit > 0 {
+		// The limit applies to the edges of each vertex.
+		edges = fmt.Sprintf("local(%s.limit(expandLimit))", edges)
+		bind("expandLimit", req.Limit)
+	}
+	bind("expandHops", req.Hops)
+	// One more path than the limit tells whether the result is truncated.
+	bind("expandMaxPaths", config.Expand.MaxResults+1)
+
+	var script strings.Builder
+	fmt.Fprintf(&script, "g.V(expandIds).repeat(%s.%s.simplePath()).emit().times(expandHops)", edges, steps[1])
+	script.WriteString(".path().by(elementMap()).limit(expandMaxPaths)")
+	return script.String(), bindings, nil
+}
+
+// Expand runs the expansion of the request and returns the new vertices and edges.
+func Expand(c *gin.Context, config *Config, req *ExpandRequest) (*ExpandResult, error) {
+	backend, err := config.Backend(req.Backend)
+	if err != nil {
+		return nil, &QueryError{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+	script, raw, err := req.script(config)
+	if err != nil {
+		return nil, &QueryError{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+	bindings, err := ParseBindings(backend, raw)
+	if err != nil {
+		return nil, &QueryError{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+	known, err := knownElements(req)
+	if err != nil {
+		return nil, &QueryError{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+
+	result := &ExpandResult{Subgraph: newSubgraph()}
+	paths := 0
+	_, err = SubmitStream(c, config, QueryRequest{Query: script, Backend: backend.Name, Bindings: bindings}, func(batch *GsonResponse) error {
+		for _, item := range batch.Value {
+			paths++
+			if paths > config.Expand.MaxResults {
+				result.Truncated = true
+			}
+			if result.Truncated {
+				return nil
+			}
+			value, err := DecodeGraphSON(item)
+			if err != nil {
+				return fmt.Errorf("invalid path: %v", err)
+			}
+			objects, _ := value.([]interface{})
+			if !result.addPath(objects, known, config.Expand.MaxResults) {
+				result.Truncated = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Keys of the elements the client already has, including the start vertices, and of the elements added to the
+// result.
+func knownElements(req *ExpandRequest) (map[string]map[string]bool, error) {
+	known := map[string]map[string]bool{ElementVertex: {}, ElementEdge: {}}
+	vertices := append(append([]json.RawMessage{}, req.IDs...), req.KnownVertices...)
+	for kind, ids := range map[string][]json.RawMessage{ElementVertex: vertices, ElementEdge: req.KnownEdges} {
+		for _, id := range ids {
+			value, err := DecodeGraphSON(id)
+			if err != nil {
+				return nil, fmt.Errorf("invalid known id %s: %v", string(id), err)
+			}
+			known[kind][mapKey(value)] = true
+		}
+	}
+	return known, nil
+}
+
+// Adds the path and its elements which are not known yet. The path is left out when its elements would go over
+// maxResults, zero for no limit.
+func (g *Subgraph) addPath(objects []interface{}, known map[string]map[string]bool, maxResults int) bool {
+	var added []*GraphElement
+	ids := make([]interface{}, 0, len(objects))
+	for _, object := range objects {
+		element, ok := object.(*GraphElement)
+		if !ok {
+			continue
+		}
+		ids = append(ids, element.ID)
+		key := mapKey(element.ID)
+		if known[element.Kind][key] {
+			continue
+		}
+		known[element.Kind][key] = true
+		added = append(added, element)
+	}
+	if maxResults > 0 && len(g.Vertices)+len(g.Edges)+len(added) > maxResults {
+		for _, element := range added {
+			delete(known[element.Kind], mapKey(element.ID))
+		}
+		return false
+	}
+	for _, element := range added {
+		if element.Kind == ElementVertex {
+			g.Vertices = append(g.Vertices, element)
+		} else {
+			g.Edges = append(g.Edges, element)
+		}
+	}
+	g.Paths = append(g.Paths, ids)
+	return true
+}
@@ -0,0 +1,614 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Export formats.
+const (
+	ExportCSV     = "csv"
+	ExportJSONL   = "jsonl"
+	ExportGraphML = "graphml"
+	ExportGEXF    = "gexf"
+)
+
+var exportContentTypes = map[string]string{
+	ExportCSV:     "text/csv; charset=utf-8",
+	ExportJSONL:   "application/x-ndjson",
+	ExportGraphML: "application/graphml+xml",
+	ExportGEXF:    "application/gexf+xml",
+}
+
+// ExportContentType returns the content type of a format, false for unknown formats.
+func ExportContentType(format string) (string, bool) {
+	contentType, ok := exportContentTypes[format]
+	return contentType, ok
+}
+
+// ExportConfig bounds the exports.
+type ExportConfig struct {
+	// Maximum size of the temporary file of a GraphML or GEXF export. Zero disables the limit.
+	MaxSpoolSizeMB int `yaml:"maxSpoolSizeMB" default:"1024"`
+	// Maximum number of vertex and edge ids of an export of elements.
+	MaxIDs int `yaml:"maxIds" default:"100000"`
+}
+
+// Columns of the vertices and edges in CSV files, before the properties.
+var elementColumns = []string{"type", "id", "label", "outV", "inV"}
+
+// Last column of the CSV files, with the keys and values which have no column.
+const otherColumn = "other"
+
+// Export writes query results in a file format. JSON lines and CSV are written to the response as the results arrive,
+// the CSV columns are the ones of the first partial response. GraphML and GEXF declare all the attributes before the
+// first element and list the nodes before the edges, so their results are spooled to a temporary file, one raw
+// GraphSON result per line, and the file is written from the spool once the query is done.
+type Export struct {
+	format string
+	out    *bufio.Writer
+	// Called before the first byte of the file is written, to send the response headers.
+	begin   func()
+	started bool
+	// Number of results.
+	Count int
+
+	// CSV columns by property or map key.
+	columns     map[string]int
+	hasElement  bool
+	valueColumn int
+	csv         *csv.Writer
+
+	spool     *os.File
+	spooled   *bufio.Writer
+	spoolSize int64
+	maxSpool  int64
+	// Property types of the vertices and edges, by property name.
+	nodeKeys map[string]string
+	edgeKeys map[string]string
+}
+
+func NewExport(format string, config ExportConfig, w io.Writer, begin func()) (*Export, error) {
+	if _, ok := ExportContentType(format); !ok {
+		return nil, fmt.Errorf("unknown export format %q", format)
+	}
+	e := &Export{
+		format:      format,
+		out:         bufio.NewWriter(w),
+		begin:       begin,
+		valueColumn: -1,
+		maxSpool:    int64(config.MaxSpoolSizeMB) << 20,
+		nodeKeys:    map[string]string{},
+		edgeKeys:    map[string]string{},
+	}
+	if !e.spooling() {
+		return e, nil
+	}
+	spool, err := os.CreateTemp("", "puppygraph-export-*.jsonl")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create export file: %v", err)
+	}
+	e.spool, e.spooled = spool, bufio.NewWriter(spool)
+	return e, nil
+}
+
+func (e *Export) spooling() bool {
+	return e.format == ExportGraphML || e.format == ExportGEXF
+}
+
+// Started tells whether the file is being written. The errors before can still be sent as the response.
+func (e *Export) Started() bool {
+	return e.started
+}
+
+// Close removes the spool file.
+func (e *Export) Close() {
+	if e.spool != nil {
+		e.spool.Close()
+		os.Remove(e.spool.Name())
+	}
+}
+
+// Add writes or spools a partial response of the query.
+func (e *Export) Add(batch *GsonResponse) error {
+	values := make([]interface{}, len(batch.Value))
+	for i, raw := range batch.Value {
+		value, err := DecodeGraphSON(raw)
+		if err != nil {
+			return fmt.Errorf("error when parsing gson response: %v", err)
+		}
+		values[i] = value
+	}
+	var err error
+	switch e.format {
+	case ExportCSV:
+		if !e.started {
+			e.start()
+			err = e.writeCSVHeader(values)
+		}
+		for _, value := range values {
+			if err != nil {
+				break
+			}
+			err = e.writeCSVRow(value)
+		}
+	case ExportJSONL:
+		e.start()
+		encoder := json.NewEncoder(e.out)
+		encoder.SetEscapeHTML(false)
+		for _, value := range values {
+			if err = encoder.Encode(value); err != nil {
+				break
+			}
+		}
+	default:
+		return e.spoolBatch(batch, values)
+	}
+	if err != nil {
+		return err
+	}
+	e.Count += len(values)
+	return e.flush()
+}
+
+func (e *Export) start() {
+	if !e.started {
+		e.started = true
+		e.begin()
+	}
+}
+
+func (e *Export) flush() error {
+	if e.csv != nil {
+		e.csv.Flush()
+		if err := e.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return e.out.Flush()
+}
+
+func (e *Export) spoolBatch(batch *GsonResponse, values []interface{}) error {
+	for i, raw := range batch.Value {
+		VisitElements(values[i], func(element *GraphElement) {
+			keys := e.nodeKeys
+			if element.Kind == ElementEdge {
+				keys = e.edgeKeys
+			}
+			for key, property := range element.Properties {
+				keys[key] = mergePropertyType(keys[key], propertyType(property))
+			}
+		})
+		// One result per line.
+		var line bytes.Buffer
+		if err := json.Compact(&line, raw); err != nil {
+			return err
+		}
+		line.WriteByte('\n')
+		e.spoolSize += int64(line.Len())
+		if e.maxSpool > 0 && e.spoolSize > e.maxSpool {
+			return &QueryError{
+				Status:  http.StatusBadRequest,
+				Message: fmt.Sprintf("the results are over the %d MB limit of the %s exports", e.maxSpool>>20, e.format),
+			}
+		}
+		if _, err := e.spooled.Write(line.Bytes()); err != nil {
+			return fmt.Errorf("unable to write export file: %v", err)
+		}
+		e.Count++
+	}
+	return nil
+}
+
+// Property types, named after the GraphML attr.type values.
+func propertyType(value interface{}) string {
+	switch v := value.(type) {
+	case bool:
+		return "boolean"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "long"
+		}
+		return "double"
+	default:
+		return "string"
+	}
+}
+
+func mergePropertyType(current string, next string) string {
+	switch {
+	case current == "" || current == next:
+		return next
+	case current == "long" && next == "double", current == "double" && next == "long":
+		return "double"
+	default:
+		return "string"
+	}
+}
+
+// Finish writes the end of the file, or the whole file of the spooled results.
+func (e *Export) Finish() error {
+	e.start()
+	var err error
+	switch e.format {
+	case ExportCSV:
+		if e.csv == nil {
+			err = e.writeCSVHeader(nil)
+		}
+	case ExportGraphML:
+		err = e.writeGraph(e.out, &graphMLWriter{w: e.out})
+	case ExportGEXF:
+		err = e.writeGraph(e.out, &gexfWriter{w: e.out})
+	}
+	if err != nil {
+		return err
+	}
+	return e.flush()
+}
+
+// Reads the spooled results in order.
+func (e *Export) each(fn func(value interface{}) error) error {
+	if err := e.spooled.Flush(); err != nil {
+		return fmt.Errorf("unable to write export file: %v", err)
+	}
+	if _, err := e.spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(e.spool)
+	scanner.Buffer(make([]byte, 64*1024), 256*1024*1024)
+	for scanner.Scan() {
+		value, err := DecodeGraphSON(scanner.Bytes())
+		if err != nil {
+			return err
+		}
+		if err := fn(value); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Writes the header of the first results: the columns of the vertices and edges, then the properties or map keys in
+// alphabetical order, then a "value" column for the other results, and the "other" column. Properties named like one
+// of these columns have a "property:" prefix.
+func (e *Export) writeCSVHeader(values []interface{}) error {
+	keys := map[string]bool{}
+	hasValue := false
+	for _, value := range values {
+		switch v := value.(type) {
+		case *GraphElement:
+			e.hasElement = true
+			for key := range v.Properties {
+				keys[key] = true
+			}
+		case map[string]interface{}:
+			for key := range v {
+				keys[key] = true
+			}
+		default:
+			hasValue = true
+		}
+	}
+
+	var header []string
+	if e.hasElement {
+		header = append(header, elementColumns...)
+	}
+	e.columns = map[string]int{}
+	for _, key := range sortedKeys(keys) {
+		e.columns[key] = len(header)
+		name := key
+		if isElementColumn(key) || key == "value" || key == otherColumn {
+			name = "property:" + key
+		}
+		header = append(header, name)
+	}
+	if hasValue {
+		e.valueColumn = len(header)
+		header = append(header, "value")
+	}
+	header = append(header, otherColumn)
+
+	e.csv = csv.NewWriter(e.out)
+	return e.csv.Write(header)
+}
+
+// Writes a row of a result. The properties and map keys which have no column are written in the "other" column as a
+// JSON object, the results which do not fit the columns at all as a JSON value.
+func (e *Export) writeCSVRow(value interface{}) error {
+	width := len(e.columns) + 1
+	if e.hasElement {
+		width += len(elementColumns)
+	}
+	if e.valueColumn >= 0 {
+		width++
+	}
+	row := make([]string, width)
+	other := map[string]interface{}{}
+	setColumns := func(values map[string]interface{}) {
+		for key, item := range values {
+			if column, ok := e.columns[key]; ok {
+				row[column] = csvValue(item)
+			} else {
+				other[key] = item
+			}
+		}
+	}
+	switch v := value.(type) {
+	case *GraphElement:
+		if !e.hasElement {
+			row[width-1] = csvValue(v)
+			break
+		}
+		copy(row, []string{v.Kind, csvValue(v.ID), v.Label, csvValue(v.OutV), csvValue(v.InV)})
+		setColumns(v.Properties)
+	case map[string]interface{}:
+		setColumns(v)
+	default:
+		if e.valueColumn < 0 {
+			row[width-1] = csvValue(v)
+			break
+		}
+		row[e.valueColumn] = csvValue(v)
+	}
+	if len(other) > 0 {
+		row[width-1] = csvValue(other)
+	}
+	return e.csv.Write(row)
+}
+
+func isElementColumn(name string) bool {
+	for _, column := range elementColumns {
+		if column == name {
+			return true
+		}
+	}
+	return false
+}
+
+func csvValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return fmt.Sprint(v)
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// graphWriter writes the vertices and edges of a graph file. The nodes are written before the edges.
+type graphWriter interface {
+	begin(nodeKeys []graphKey, edgeKeys []graphKey)
+	node(id string, label string, properties map[string]interface{})
+	beginEdges()
+	edge(id string, source string, target string, label string, properties map[string]interface{})
+	end()
+}
+
+// An attribute declaration of a graph file.
+type graphKey struct {
+	id   string
+	name string
+	typ  string
+}
+
+// Writes the vertices, then the edges of the results. Every element is written once. The endpoints of the edges
+// which are not in the results are written as vertices without properties, so that the file can be loaded.
+func (e *Export) writeGraph(w *bufio.Writer, writer graphWriter) error {
+	nodeKeys := graphKeys("v", e.nodeKeys)
+	edgeKeys := graphKeys("e", e.edgeKeys)
+	writer.begin(nodeKeys, edgeKeys)
+
+	nodes := map[string]bool{}
+	// Labels of the endpoints of the edges, by id.
+	endpoints := map[string]string{}
+	err := e.each(func(value interface{}) error {
+		VisitElements(value, func(element *GraphElement) {
+			if element.Kind == ElementEdge {
+				endpoints[elementID(element.OutV)] = element.OutVLabel
+				endpoints[elementID(element.InV)] = element.InVLabel
+				return
+			}
+			id := elementID(element.ID)
+			if nodes[id] {
+				return
+			}
+			nodes[id] = true
+			writer.node(id, element.Label, element.Properties)
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range sortedKeys(endpoints) {
+		if !nodes[id] {
+			writer.node(id, endpoints[id], nil)
+		}
+	}
+
+	writer.beginEdges()
+	edges := map[string]bool{}
+	err = e.each(func(value interface{}) error {
+		VisitElements(value, func(element *GraphElement) {
+			id := elementID(element.ID)
+			if element.Kind != ElementEdge || edges[id] {
+				return
+			}
+			edges[id] = true
+			writer.edge(id, elementID(element.OutV), elementID(element.InV), element.Label, element.Properties)
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	writer.end()
+	return nil
+}
+
+func graphKeys(prefix string, types map[string]string) []graphKey {
+	keys := []graphKey{}
+	for i, name := range sortedKeys(types) {
+		keys = append(keys, graphKey{id: fmt.Sprintf("%s%d", prefix, i), name: name, typ: types[name]})
+	}
+	return keys
+}
+
+// Element ids as strings. Ids which are not strings or numbers, like the relation ids of JanusGraph, are JSON.
+func elementID(id interface{}) string {
+	return csvValue(id)
+}
+
+func xmlEscape(s string) string {
+	var builder strings.Builder
+	xml.EscapeText(&builder, []byte(s))
+	return builder.String()
+}
+
+// Writes the attribute values of the properties declared by keys.
+func writeAttributes(keys map[string]graphKey, properties map[string]interface{}, fn func(key graphKey, value string)) {
+	for _, name := range sortedKeys(properties) {
+		if key, ok := keys[name]; ok && properties[name] != nil {
+			fn(key, csvValue(properties[name]))
+		}
+	}
+}
+
+func keysByName(keys []graphKey) map[string]graphKey {
+	byName := make(map[string]graphKey, len(keys))
+	for _, key := range keys {
+		byName[key.name] = key
+	}
+	return byName
+}
+
+// graphMLWriter writes GraphML, with the labels in the labelV and labelE attributes like the GraphML writer of
+// TinkerPop.
+type graphMLWriter struct {
+	w        *bufio.Writer
+	nodeKeys map[string]graphKey
+	edgeKeys map[string]graphKey
+}
+
+func (g *graphMLWriter) begin(nodeKeys []graphKey, edgeKeys []graphKey) {
+	g.nodeKeys, g.edgeKeys = keysByName(nodeKeys), keysByName(edgeKeys)
+	g.w.WriteString(xml.Header)
+	g.w.WriteString(`<graphml xmlns="http://graphml.graphdrawing.org/xmlns">` + "\n")
+	g.w.WriteString(`  <key id="labelV" for="node" attr.name="labelV" attr.type="string"/>` + "\n")
+	g.w.WriteString(`  <key id="labelE" for="edge" attr.name="labelE" attr.type="string"/>` + "\n")
+	for _, key := range nodeKeys {
+		fmt.Fprintf(g.w, `  <key id="%s" for="node" attr.name="%s" attr.type="%s"/>`+"\n", key.id, xmlEscape(key.name), key.typ)
+	}
+	for _, key := range edgeKeys {
+		fmt.Fprintf(g.w, `  <key id="%s" for="edge" attr.name="%s" attr.type="%s"/>`+"\n", key.id, xmlEscape(key.name), key.typ)
+	}
+	g.w.WriteString(`  <graph id="G" edgedefault="directed">` + "\n")
+}
+
+func (g *graphMLWriter) node(id string, label string, properties map[string]interface{}) {
+	fmt.Fprintf(g.w, `    <node id="%s">`+"\n", xmlEscape(id))
+	fmt.Fprintf(g.w, `      <data key="labelV">%s</data>`+"\n", xmlEscape(label))
+	writeAttributes(g.nodeKeys, properties, func(key graphKey, value string) {
+		fmt.Fprintf(g.w, `      <data key="%s">%s</data>`+"\n", key.id, xmlEscape(value))
+	})
+	g.w.WriteString("    </node>\n")
+}
+
+func (g *graphMLWriter) beginEdges() {}
+
+func (g *graphMLWriter) edge(id string, source string, target string, label string, properties map[string]interface{}) {
+	fmt.Fprintf(g.w, `    <edge id="%s" source="%s" target="%s">`+"\n", xmlEscape(id), xmlEscape(source), xmlEscape(target))
+	fmt.Fprintf(g.w, `      <data key="labelE">%s</data>`+"\n", xmlEscape(label))
+	writeAttributes(g.edgeKeys, properties, func(key graphKey, value string) {
+		fmt.Fprintf(g.w, `      <data key="%s">%s</data>`+"\n", key.id, xmlEscape(value))
+	})
+	g.w.WriteString("    </edge>\n")
+}
+
+func (g *graphMLWriter) end() {
+	g.w.WriteString("  </graph>\n</graphml>\n")
+}
+
+// gexfWriter writes GEXF 1.3. The vertex and edge labels are the labels of the nodes and edges.
+type gexfWriter struct {
+	w        *bufio.Writer
+	nodeKeys map[string]graphKey
+	edgeKeys map[string]graphKey
+}
+
+func (g *gexfWriter) begin(nodeKeys []graphKey, edgeKeys []graphKey) {
+	g.nodeKeys, g.edgeKeys = keysByName(nodeKeys), keysByName(edgeKeys)
+	g.w.WriteString(xml.Header)
+	g.w.WriteString(`<gexf xmlns="http://gexf.net/1.3" version="1.3">` + "\n")
+	g.w.WriteString(`  <graph defaultedgetype="directed" mode="static">` + "\n")
+	for _, class := range []struct {
+		name string
+		keys []graphKey
+	}{{"node", nodeKeys}, {"edge", edgeKeys}} {
+		fmt.Fprintf(g.w, `    <attributes class="%s">`+"\n", class.name)
+		for _, key := range class.keys {
+			fmt.Fprintf(g.w, `      <attribute id="%s" title="%s" type="%s"/>`+"\n", key.id, xmlEscape(key.name), key.typ)
+		}
+		g.w.WriteString("    </attributes>\n")
+	}
+	g.w.WriteString("    <nodes>\n")
+}
+
+func (g *gexfWriter) node(id string, label string, properties map[string]interface{}) {
+	fmt.Fprintf(g.w, `      <node id="%s" label="%s">`+"\n", xmlEscape(id), xmlEscape(label))
+	g.attributes(g.nodeKeys, properties)
+	g.w.WriteString("      </node>\n")
+}
+
+func (g *gexfWriter) beginEdges() {
+	g.w.WriteString("    </nodes>\n    <edges>\n")
+}
+
+func (g *gexfWriter) edge(id string, source string, target string, label string, properties map[string]interface{}) {
+	fmt.Fprintf(g.w, `      <edge id="%s" source="%s" target="%s" label="%s">`+"\n", xmlEscape(id), xmlEscape(source), xmlEscape(target), xmlEscape(label))
+	g.attributes(g.edgeKeys, properties)
+	g.w.WriteString("      </edge>\n")
+}
+
+func (g *gexfWriter) attributes(keys map[string]graphKey, properties map[string]interface{}) {
+	first := true
+	writeAttributes(keys, properties, func(key graphKey, value string) {
+		if first {
+			g.w.WriteString("        <attvalues>\n")
+			first = false
+		}
+		fmt.Fprintf(g.w, `          <attvalue for="%s" value="%s"/>`+"\n", key.id, xmlEscape(value))
+	})
+	if !first {
+		g.w.WriteString("        </attvalues>\n")
+	}
+}
+
+func (g *gexfWriter) end() {
+	g.w.WriteString("    </edges>\n  </graph>\n</gexf>\n")
+}
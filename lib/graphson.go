@@ -0,0 +1,215 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Kinds of GraphElement.
+const (
+	ElementVertex = "vertex"
+	ElementEdge   = "edge"
+)
+
+// GraphElement is a vertex or an edge decoded from GraphSON, either a g:Vertex or g:Edge, or an elementMap().
+type GraphElement struct {
+	Kind  string      `json:"type"`
+	ID    interface{} `json:"id"`
+	Label string      `json:"label"`
+	// Endpoints of an edge.
+	OutV       interface{}            `json:"outV,omitempty"`
+	OutVLabel  string                 `json:"outVLabel,omitempty"`
+	InV        interface{}            `json:"inV,omitempty"`
+	InVLabel   string                 `json:"inVLabel,omitempty"`
+	Properties map[string]interface{} `json:"properties,omitempty"`
+}
+
+// DecodeGraphSON converts a GraphSON 3 value to plain values: numbers are json.Number, lists, sets and paths are
+// []interface{}, maps are map[string]interface{}, vertices, edges and element maps are *GraphElement, and the results
+// of profile() and explain() are *TraversalMetrics and *TraversalExplanation.
+func DecodeGraphSON(raw json.RawMessage) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return decodeGraphSONValue(value), nil
+}
+
+func decodeGraphSONValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, item := range v {
+			values[i] = decodeGraphSONValue(item)
+		}
+		return values
+	case map[string]interface{}:
+		typeName, ok := v["@type"].(string)
+		if !ok {
+			values := make(map[string]interface{}, len(v))
+			for key, item := range v {
+				values[key] = decodeGraphSONValue(item)
+			}
+			return values
+		}
+		return decodeTypedValue(typeName, v["@value"])
+	default:
+		return v
+	}
+}
+
+func decodeTypedValue(typeName string, value interface{}) interface{} {
+	switch typeName {
+	case "g:Map":
+		entries, _ := value.([]interface{})
+		return decodeMap(entries)
+	case "g:BulkSet":
+		// Pairs of value and bulk.
+		entries, _ := value.([]interface{})
+		values := []interface{}{}
+		for i := 0; i+1 < len(entries); i += 2 {
+			item := decodeGraphSONValue(entries[i])
+			number, _ := decodeGraphSONValue(entries[i+1]).(json.Number)
+			bulk, _ := number.Int64()
+			for j := int64(0); j < bulk; j++ {
+				values = append(values, item)
+			}
+		}
+		return values
+	case "g:Path":
+		fields, _ := value.(map[string]interface{})
+		return decodeGraphSONValue(fields["objects"])
+	case "g:Vertex":
+		fields, _ := value.(map[string]interface{})
+		element := &GraphElement{Kind: ElementVertex, ID: decodeGraphSONValue(fields["id"]), Label: stringValue(fields["label"])}
+		if properties, ok := fields["properties"].(map[string]interface{}); ok {
+			element.Properties = map[string]interface{}{}
+			for key, items := range properties {
+				// A list of vertex properties, multi-properties are kept as a list.
+				values, _ := decodeGraphSONValue(items).([]interface{})
+				if len(values) == 1 {
+					element.Properties[key] = values[0]
+				} else {
+					element.Properties[key] = values
+				}
+			}
+		}
+		return element
+	case "g:Edge":
+		fields, _ := value.(map[string]interface{})
+		element := &GraphElement{
+			Kind:      ElementEdge,
+			ID:        decodeGraphSONValue(fields["id"]),
+			Label:     stringValue(fields["label"]),
+			OutV:      decodeGraphSONValue(fields["outV"]),
+			OutVLabel: stringValue(fields["outVLabel"]),
+			InV:       decodeGraphSONValue(fields["inV"]),
+			InVLabel:  stringValue(fields["inVLabel"]),
+		}
+		if properties, ok := fields["properties"].(map[string]interface{}); ok {
+			element.Properties = map[string]interface{}{}
+			for key, property := range properties {
+				element.Properties[key] = decodeGraphSONValue(property)
+			}
+		}
+		return element
+	case "g:TraversalMetrics":
+		return decodeTraversalMetrics(decodeGraphSONValue(value))
+	case "g:Metrics":
+		return decodeStepMetrics(decodeGraphSONValue(value))
+	case "g:TraversalExplanation":
+		return decodeTraversalExplanation(decodeGraphSONValue(value))
+	case "g:VertexProperty", "g:Property":
+		fields, _ := value.(map[string]interface{})
+		return decodeGraphSONValue(fields["value"])
+	default:
+		// Scalars like g:Int64, g:UUID, g:T or g:Date keep their value.
+		return decodeGraphSONValue(value)
+	}
+}
+
+// Decodes the key value pairs of a g:Map. A map with g:T keys is the elementMap() of a vertex, or of an edge when it
+// also has g:Direction keys.
+func decodeMap(entries []interface{}) interface{} {
+	values := map[string]interface{}{}
+	var element *GraphElement
+	for i := 0; i+1 < len(entries); i += 2 {
+		key, value := entries[i], decodeGraphSONValue(entries[i+1])
+		typed, _ := key.(map[string]interface{})
+		switch typed["@type"] {
+		case "g:T":
+			if element == nil {
+				element = &GraphElement{Kind: ElementVertex, Properties: map[string]interface{}{}}
+			}
+			switch typed["@value"] {
+			case "id":
+				element.ID = value
+			case "label":
+				element.Label = stringValue(value)
+			}
+			continue
+		case "g:Direction":
+			if element == nil {
+				element = &GraphElement{Properties: map[string]interface{}{}}
+			}
+			element.Kind = ElementEdge
+			endpoint, _ := value.(*GraphElement)
+			if endpoint == nil {
+				continue
+			}
+			if typed["@value"] == "OUT" {
+				element.OutV, element.OutVLabel = endpoint.ID, endpoint.Label
+			} else {
+				element.InV, element.InVLabel = endpoint.ID, endpoint.Label
+			}
+			continue
+		}
+		values[mapKey(decodeGraphSONValue(key))] = value
+	}
+	if element == nil {
+		return values
+	}
+	for key, value := range values {
+		element.Properties[key] = value
+	}
+	return element
+}
+
+func mapKey(key interface{}) string {
+	switch k := key.(type) {
+	case string:
+		return k
+	case json.Number:
+		return k.String()
+	case *GraphElement:
+		return fmt.Sprint(k.ID)
+	default:
+		data, _ := json.Marshal(k)
+		return string(data)
+	}
+}
+
+func stringValue(value interface{}) string {
+	s, _ := decodeGraphSONValue(value).(string)
+	return s
+}
+
+// VisitElements calls fn for every vertex and edge in a decoded value, including the ones in lists, paths and map
+// values.
+func VisitElements(value interface{}, fn func(*GraphElement)) {
+	switch v := value.(type) {
+	case *GraphElement:
+		fn(v)
+	case []interface{}:
+		for _, item := range v {
+			VisitElements(item, fn)
+		}
+	case map[string]interface{}:
+		for _, item := range v {
+			VisitElements(item, fn)
+		}
+	}
+}
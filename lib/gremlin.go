@@ -1,15 +1,15 @@
 package lib
 
 import (
-	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"regexp"
-	"strings"
+	"net/http"
+	"time"
 
 	gremlingo "github.com/apache/tinkerpop/gremlin-go/driver"
-	jwt "github.com/appleboy/gin-jwt/v2"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 )
 
@@ -30,48 +30,49 @@ func (*loggerAdaptor) Logf(verbosity gremlingo.LogVerbosity, format string, v ..
 	}
 }
 
-func GetWsUrl(config *Config) string {
-	if config.GremlinServer.Url != "" {
-		return config.GremlinServer.Url
-	} else {
-		return "ws://" + config.GremlinServer.Host + config.GremlinServer.Path
+// Returns the gremlin credentials of the user for the backend, empty when the backend has no authentication.
+func gremlinCredentials(c *gin.Context, config *Config, backend *Backend) (string, string, error) {
+	switch backend.Auth {
+	case BackendAuthStatic:
+		return backend.Username, backend.Password, nil
+	case BackendAuthUser:
+	default:
+		return "", "", nil
 	}
+	// API tokens have no session, and no gremlin password.
+	session, ok := sessions.get(currentSessionID(c))
+	if !ok {
+		return "", "", fmt.Errorf("the request has no gremlin credentials, log in with a password")
+	}
+	return session.username, session.password, nil
 }
 
-func createConnectionFromContext(c *gin.Context, config *Config) (*gremlingo.DriverRemoteConnection, error) {
-	username := ""
-	password := ""
-	if config.Authentication.GremlinAuth {
-		claims := jwt.ExtractClaims(c)
-		username = claims["username"].(string)
-		pwtoken := claims["pwtoken"].(string)
-		var err error
-		password, err = Decrypt([]byte(config.Authentication.FrontendJWT.SecretKey), pwtoken)
-		if err != nil {
-			logrus.Warnf("authentication extraction from JWT failed: %v", err)
-			return nil, fmt.Errorf("authentication extraction from JWT failed")
-		}
+func acquireConnectionFromContext(c *gin.Context, config *Config, backend *Backend) (*pooledConnection, error) {
+	key, err := connectionKeyFromContext(c, config, backend)
+	if err != nil {
+		return nil, err
 	}
-	return createConnection(GetWsUrl(config), username, password, config.GremlinServer.SkipCertVerify)
+	return connections.acquire(key, backend.Pool)
 }
 
-func createConnection(wsUrl string, username string, password string, skipCertVerify bool) (*gremlingo.DriverRemoteConnection, error) {
-	return gremlingo.NewDriverRemoteConnection(
-		wsUrl,
-		func(settings *gremlingo.DriverRemoteConnectionSettings) {
-			settings.Logger = &loggerAdaptor{}
-			settings.SerializerType = gremlingo.GraphsonSerializer
-			if skipCertVerify {
-				settings.TlsConfig = &tls.Config{InsecureSkipVerify: true}
-			}
-			if username != "" {
-				settings.AuthInfo = gremlingo.BasicAuthInfo(username, password)
-			}
-		})
+// Returns the key of the pooled connections of the user, for the work which outlives the request.
+func connectionKeyFromContext(c *gin.Context, config *Config, backend *Backend) (connectionKey, error) {
+	username, password, err := gremlinCredentials(c, config, backend)
+	if err != nil {
+		return connectionKey{}, err
+	}
+	return connectionKey{
+		url:            backend.WsUrl(),
+		username:       username,
+		password:       password,
+		skipCertVerify: backend.SkipCertVerify,
+	}, nil
 }
 
-func GremlinAuthCheck(config *Config, username string, password string) error {
-	driverRemoteConnection, err := createConnection(GetWsUrl(config), username, password, config.GremlinServer.SkipCertVerify)
+// GremlinAuthCheck validates the credentials of a user against the backend.
+func GremlinAuthCheck(backend *Backend, username string, password string) error {
+	// Always dial a fresh connection, the credentials are not trusted until this check passes.
+	driverRemoteConnection, err := createConnection(backend.WsUrl(), username, password, backend.SkipCertVerify, backend.Pool)
 	// Handle error
 	if err != nil {
 		return fmt.Errorf("unable to connect to gremlin server: %v", err)
@@ -81,7 +82,7 @@ func GremlinAuthCheck(config *Config, username string, password string) error {
 
 	query := "1"
 	optionsBuilder := gremlingo.RequestOptionsBuilder{}
-	for key, value := range config.GremlinServer.Aliases {
+	for key, value := range backend.Aliases {
 		optionsBuilder.AddAliases(key, value)
 	}
 	resultSet, err := driverRemoteConnection.SubmitWithOptions(query, optionsBuilder.Create())
@@ -94,8 +95,7 @@ func GremlinAuthCheck(config *Config, username string, password string) error {
 	result, err := resultSet.All()
 	if err != nil {
 		logrus.Warnf("gremlin response error: %v", err)
-		msg, _ := parseGremlinError(err)
-		return fmt.Errorf("%s", msg)
+		return fmt.Errorf("%s", NewQueryError(err).Message)
 	}
 	if len(result) != 1 {
 		return fmt.Errorf("gremlin returns more than one result: %d", len(result))
@@ -105,21 +105,26 @@ func GremlinAuthCheck(config *Config, username string, password string) error {
 
 // Checks whether the server can run any gremlin query.
 // When v is not empty, checks the g.V() returns something.
-func Healthcheck(c *gin.Context, config *Config) (bool, error) {
-	driverRemoteConnection, err := createConnectionFromContext(c, config)
+func Healthcheck(c *gin.Context, config *Config, backend *Backend) (healthy bool, err error) {
+	defer func() {
+		observeHealthcheck(backend.Name, healthy, err)
+	}()
+	if err := CheckBackendAccess(c, backend); err != nil {
+		return false, err
+	}
+	conn, err := acquireConnectionFromContext(c, config, backend)
 	// Handle error
 	if err != nil {
 		return false, err
 	}
-	// Cleanup
-	defer driverRemoteConnection.Close()
+	defer conn.Release()
 
 	query := "g.V().id().limit(10)"
 	optionsBuilder := gremlingo.RequestOptionsBuilder{}
-	for key, value := range config.GremlinServer.Aliases {
+	for key, value := range backend.Aliases {
 		optionsBuilder.AddAliases(key, value)
 	}
-	resultSet, err := driverRemoteConnection.SubmitWithOptions(query, optionsBuilder.Create())
+	resultSet, err := conn.driver.SubmitWithOptions(query, optionsBuilder.Create())
 	if err != nil {
 		return false, err
 	}
@@ -127,12 +132,13 @@ func Healthcheck(c *gin.Context, config *Config) (bool, error) {
 	if resultSet.IsEmpty() {
 		return false, nil
 	}
+	// Always drain the result set, the connection is shared with other requests.
+	result, err := resultSet.All()
+	if err != nil {
+		logrus.Debugf("error when getting all the results of the query: %v", err)
+	}
 	// Print the result
 	if logrus.IsLevelEnabled(logrus.DebugLevel) {
-		result, err := resultSet.All()
-		if err != nil {
-			logrus.Debugf("error when getting all the results of the query: %v", err)
-		}
 		for _, r := range result {
 			logrus.Debug(r)
 		}
@@ -147,71 +153,145 @@ type GsonResponse struct {
 	Value []json.RawMessage `json:"@value"`
 }
 
-func Submit(c *gin.Context, config *Config, query string) (*GsonResponse, error) {
-	// Use graphson serializer and the client side will handle gson directly.
-	driverRemoteConnection, err := createConnectionFromContext(c, config)
-	// Handle error
+// QueryRequest is a gremlin script submitted on behalf of the user of the request context.
+type QueryRequest struct {
+	Query string
+	// Name of the backend, the default backend when empty.
+	Backend string
+	// Optional request id, used to cancel the query with CancelQuery. A random one is generated when empty.
+	RequestID string
+	// GraphSON values by binding name, see ParseBindings.
+	Bindings map[string]interface{}
+	// Evaluation timeout of the gremlin server, the timeout of the server when zero.
+	Timeout time.Duration
+}
+
+func Submit(c *gin.Context, config *Config, req QueryRequest) (*GsonResponse, error) {
+	var response GsonResponse
+	_, err := SubmitStream(c, config, req, func(batch *GsonResponse) error {
+		response.Type = batch.Type
+		response.Value = append(response.Value, batch.Value...)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	// Cleanup
-	defer driverRemoteConnection.Close()
+	return &response, nil
+}
 
-	optionsBuilder := gremlingo.RequestOptionsBuilder{}
-	for key, value := range config.GremlinServer.Aliases {
-		optionsBuilder.AddAliases(key, value)
+// SubmitStream runs the query and calls onBatch for every partial response as soon as the gremlin server sends it.
+// When the result set is exhausted, the status attributes of the final response are returned.
+// The query is cancelled when the http client goes away or CancelQuery is called with its request id.
+func SubmitStream(c *gin.Context, config *Config, req QueryRequest, onBatch func(batch *GsonResponse) error) (_ map[string]interface{}, err error) {
+	requestID := uuid.New()
+	if req.RequestID != "" {
+		var err error
+		requestID, err = uuid.Parse(req.RequestID)
+		if err != nil {
+			return nil, &QueryError{Status: http.StatusBadRequest, Message: fmt.Sprintf("invalid request id %q: %v", req.RequestID, err)}
+		}
 	}
-	resultSet, err := driverRemoteConnection.SubmitWithOptions(query, optionsBuilder.Create())
+
+	backend, err := config.Backend(req.Backend)
 	if err != nil {
+		return nil, &QueryError{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+	if err := CheckBackendAccess(c, backend); err != nil {
 		return nil, err
 	}
-	result, err := resultSet.All()
+	readOnly := CurrentRole(c) == RoleReader
+	aliases := backend.AliasesFor(readOnly)
+	if readOnly {
+		if err := CheckReadOnly(req.Query, aliases, req.Bindings); err != nil {
+			return nil, err
+		}
+	}
+	username := CurrentUsername(c)
+	query, err := inflight.register(username, requestID.String())
 	if err != nil {
-		msg, _ := parseGremlinError(err)
-		return nil, fmt.Errorf("%s", msg)
+		return nil, err
 	}
+	defer inflight.unregister(username, requestID.String())
 
-	var response GsonResponse
-	for _, r := range result {
-		gson := r.GetString()
-		var responseSlice GsonResponse
-		err := json.Unmarshal([]byte(gson), &responseSlice)
+	if _, held := c.Get(querySlotKey); !held {
+		release, err := queryLimits.acquire(c.Request.Context(), username, config.Limits)
 		if err != nil {
-			return nil, fmt.Errorf("error when parsing gson response: %v", err)
+			return nil, err
 		}
-		response.Type = responseSlice.Type
-		response.Value = append(response.Value, responseSlice.Value...)
+		defer release()
 	}
-	return &response, nil
-}
 
-func parseGremlinError(err error) (string, string) {
-	stacktrace := ""
-	errorMsg := err.Error()
-	errorCode := strings.Split(err.Error(), ":")[0]
-	if errorCode == "E0502" {
-		re := regexp.MustCompile(`(?s)E0502: error in read loop, error message \'(.*)\'\. statusCode`)
-		match := re.FindStringSubmatch(errorMsg)
-		if match != nil && len(match[1]) > 0 {
-			errorMsg = match[1]
+	start := time.Now()
+	defer func() {
+		if !errors.Is(err, ErrQueryCancelled) {
+			observeGremlinQuery(backend.Name, start, err)
 		}
-		statusRe := regexp.MustCompile(`(?s)\{code:(\d+) message:(.*) attributes:map\[(.*)\]\}`)
-		statusMatch := statusRe.FindStringSubmatch(errorMsg)
-		if statusMatch != nil && len(statusMatch[2]) > 0 {
-			errorMsg = statusMatch[2]
+	}()
+
+	// Use graphson serializer and the client side will handle gson directly.
+	conn, err := acquireConnectionFromContext(c, config, backend)
+	// Handle error
+	if err != nil {
+		return nil, newUnavailableError(err)
+	}
+	defer conn.Release()
+
+	// The connections are shared by the users with the same gremlin credentials, so the request id of the user is
+	// not sent to the gremlin server, another user could have the same one in flight on the connection.
+	optionsBuilder := gremlingo.RequestOptionsBuilder{}
+	optionsBuilder.SetRequestId(uuid.New())
+	if len(req.Bindings) > 0 {
+		optionsBuilder.SetBindings(req.Bindings)
+	}
+	if req.Timeout > 0 {
+		optionsBuilder.SetEvaluationTimeout(int(req.Timeout.Milliseconds()))
+	}
+	for key, value := range aliases {
+		optionsBuilder.AddAliases(key, value)
+	}
+	resultSet, err := conn.driver.SubmitWithOptions(req.Query, optionsBuilder.Create())
+	if err != nil {
+		return nil, newUnavailableError(err)
+	}
+
+	inflight.submitted(query, resultSet)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-c.Request.Context().Done():
+			logrus.Debugf("client went away, cancelling query %s", requestID)
+			inflight.cancel(query)
+		case <-done:
 		}
-		if statusMatch != nil && len(statusMatch[3]) > 0 {
-			stacktrace = statusMatch[3]
+	}()
+
+	// With the graphson serializer every result is the raw gson of one response message.
+	var batchErr error
+	for r := range resultSet.Channel() {
+		if batchErr != nil {
+			// Keep draining, otherwise the read loop of the shared connection is blocked.
+			continue
 		}
-	} else {
-		rsRe := regexp.MustCompile(`(?s)gremlingo\.responseStatus=\{\d+ (.*) map\[(.*)\]\}`)
-		match := rsRe.FindStringSubmatch(errorMsg)
-		if match != nil && len(match[1]) > 0 {
-			errorMsg = match[1]
+		var batch GsonResponse
+		if err := json.Unmarshal([]byte(r.GetString()), &batch); err != nil {
+			batchErr = fmt.Errorf("error when parsing gson response: %v", err)
+			continue
 		}
-		if match != nil && len(match[2]) > 0 {
-			stacktrace = match[2]
+		batchErr = onBatch(&batch)
+	}
+	if inflight.isCancelled(query) {
+		return nil, ErrQueryCancelled
+	}
+	if err := resultSet.GetError(); err != nil {
+		queryError := NewQueryError(err)
+		if queryError.RequestID != "" {
+			queryError.RequestID = requestID.String()
 		}
+		return nil, queryError
+	}
+	if batchErr != nil {
+		return nil, batchErr
 	}
-	return errorMsg, stacktrace
+	return resultSet.GetStatusAttributes(), nil
 }
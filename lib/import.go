@@ -0,0 +1,615 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	gremlingo "github.com/apache/tinkerpop/gremlin-go/driver"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// States of an ImportJob.
+const (
+	ImportRunning   = "running"
+	ImportSucceeded = "succeeded"
+	// Some rows could not be written, see the failures of the job.
+	ImportPartial   = "partial"
+	ImportFailed    = "failed"
+	ImportCancelled = "cancelled"
+)
+
+const (
+	DefaultImportBatchSize = 100
+	MaxImportBatchSize     = 10000
+	// Failures kept by a job, the next ones are only counted.
+	maxImportFailures = 100
+	// Finished jobs kept in memory.
+	maxImportJobs = 100
+)
+
+// ImportFile is an uploaded file, saved to a temporary file.
+type ImportFile struct {
+	// Name of the uploaded file.
+	Name string
+	Path string
+}
+
+// ImportRequest loads a GraphML file, or CSV files of vertices and edges, into a backend. The files are removed
+// when the job ends.
+type ImportRequest struct {
+	Backend string
+	GraphML *ImportFile
+	// CSV files, at least one of them is required.
+	Vertices *ImportFile
+	Edges    *ImportFile
+	// Vertex property holding the ids of the file, for the graphs which cannot choose the ids of their elements like
+	// JanusGraph. When empty the ids of the file are the ids of the elements.
+	IDProperty string
+	BatchSize  int
+}
+
+func (req *ImportRequest) files() []*ImportFile {
+	files := []*ImportFile{}
+	for _, file := range []*ImportFile{req.GraphML, req.Vertices, req.Edges} {
+		if file != nil {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+func (req *ImportRequest) removeFiles() {
+	for _, file := range req.files() {
+		if err := os.Remove(file.Path); err != nil {
+			logrus.Warnf("unable to remove import file: %v", err)
+		}
+	}
+}
+
+// ImportCounts counts the rows of one kind of elements.
+type ImportCounts struct {
+	Read    int `json:"read"`
+	Written int `json:"written"`
+	Failed  int `json:"failed"`
+}
+
+// ImportFailure is a row which could not be read or written.
+type ImportFailure struct {
+	File string `json:"file"`
+	// Line of a CSV file, or position of the node or edge in a GraphML file.
+	Row    int    `json:"row"`
+	ID     string `json:"id,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// ImportJob is the progress of an import running in the background.
+type ImportJob struct {
+	ID         string          `json:"id"`
+	Username   string          `json:"username"`
+	Backend    string          `json:"backend"`
+	Files      []string        `json:"files"`
+	IDProperty string          `json:"idProperty,omitempty"`
+	State      string          `json:"state"`
+	Error      string          `json:"error,omitempty"`
+	Started    time.Time       `json:"started"`
+	Finished   *time.Time      `json:"finished,omitempty"`
+	Vertices   ImportCounts    `json:"vertices"`
+	Edges      ImportCounts    `json:"edges"`
+	Failures   []ImportFailure `json:"failures"`
+	// Cancels the context of a running job.
+	cancel context.CancelFunc
+}
+
+// importJobs keeps the running jobs and the last finished ones. The jobs are only modified under the mutex.
+type importJobs struct {
+	mutex sync.Mutex
+	jobs  []*ImportJob
+}
+
+var imports = &importJobs{}
+
+func (j *importJobs) add(job *ImportJob) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.jobs = append(j.jobs, job)
+	finished := 0
+	for _, job := range j.jobs {
+		if job.Finished != nil {
+			finished++
+		}
+	}
+	kept := j.jobs[:0]
+	for _, job := range j.jobs {
+		if job.Finished != nil && finished > maxImportJobs {
+			finished--
+			continue
+		}
+		kept = append(kept, job)
+	}
+	j.jobs = kept
+}
+
+func (j *importJobs) update(job *ImportJob, fn func(job *ImportJob)) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	fn(job)
+}
+
+func snapshotImportJob(job *ImportJob) ImportJob {
+	snapshot := *job
+	snapshot.Files = append([]string{}, job.Files...)
+	snapshot.Failures = append([]ImportFailure{}, job.Failures...)
+	return snapshot
+}
+
+// GetImportJob returns the progress of a job.
+func GetImportJob(id string) (ImportJob, bool) {
+	imports.mutex.Lock()
+	defer imports.mutex.Unlock()
+	for _, job := range imports.jobs {
+		if job.ID == id {
+			return snapshotImportJob(job), true
+		}
+	}
+	return ImportJob{}, false
+}
+
+// CancelImportJob stops a running job after its current batch. The rows already written are kept.
+func CancelImportJob(id string) (ImportJob, bool) {
+	imports.mutex.Lock()
+	defer imports.mutex.Unlock()
+	for _, job := range imports.jobs {
+		if job.ID == id {
+			if job.Finished == nil {
+				job.cancel()
+			}
+			return snapshotImportJob(job), true
+		}
+	}
+	return ImportJob{}, false
+}
+
+// ListImportJobs returns the jobs, newest first.
+func ListImportJobs() []ImportJob {
+	imports.mutex.Lock()
+	defer imports.mutex.Unlock()
+	jobs := make([]ImportJob, 0, len(imports.jobs))
+	for i := len(imports.jobs) - 1; i >= 0; i-- {
+		jobs = append(jobs, snapshotImportJob(imports.jobs[i]))
+	}
+	return jobs
+}
+
+// Name of the binding holding the rows of a batch.
+const importRowsBinding = "rows"
+
+// Builds the script merging a batch of rows. Every row is a map with the search criteria in "match", the properties
+// set on creation in "create" and on match in "props". With an id property the edges find their vertices with the
+// "out" and "in" maps.
+//
+// The bytecode is translated to a script, since the connections use the GraphSON serializer. The rows are sent as
+// a binding, so the script is the same for every batch and compiled once by the gremlin server.
+func importScript(kind string, idProperty string) (string, error) {
+	row := func(key string) *gremlingo.GraphTraversal {
+		return gremlingo.T__.Select("row").Select(key)
+	}
+	t := gremlingo.NewDefaultGraphTraversalSource().
+		Inject((&gremlingo.Bindings{}).Of(importRowsBinding, nil)).Unfold().As("row")
+	if kind == ElementVertex {
+		t = t.MergeV(row("match"))
+	} else {
+		t = t.MergeE(row("match"))
+		if idProperty != "" {
+			t = t.Option(gremlingo.Merge.OutV, row("out")).Option(gremlingo.Merge.InV, row("in"))
+		}
+	}
+	t = t.Option(gremlingo.Merge.OnCreate, row("create")).Option(gremlingo.Merge.OnMatch, row("props")).Count()
+	return gremlingo.NewTranslator("g").Translate(t.Bytecode)
+}
+
+// Typed keys of the merge maps.
+var (
+	importKeyID    = json.RawMessage(`{"@type":"g:T","@value":"id"}`)
+	importKeyLabel = json.RawMessage(`{"@type":"g:T","@value":"label"}`)
+	importKeyOut   = json.RawMessage(`{"@type":"g:Direction","@value":"OUT"}`)
+	importKeyIn    = json.RawMessage(`{"@type":"g:Direction","@value":"IN"}`)
+	importMergeOut = json.RawMessage(`{"@type":"g:Merge","@value":"outV"}`)
+	importMergeIn  = json.RawMessage(`{"@type":"g:Merge","@value":"inV"}`)
+)
+
+// graphsonMap is a g:Map built from its keys and values.
+type graphsonMap []json.RawMessage
+
+func (m *graphsonMap) put(key json.RawMessage, value json.RawMessage) {
+	*m = append(*m, key, value)
+}
+
+func (m *graphsonMap) putString(key string, value json.RawMessage) {
+	keyBytes, _ := json.Marshal(key)
+	m.put(keyBytes, value)
+}
+
+func (m graphsonMap) raw() json.RawMessage {
+	if m == nil {
+		m = graphsonMap{}
+	}
+	// The keys and values are valid JSON.
+	data, _ := typed("g:Map", []json.RawMessage(m))
+	return data
+}
+
+// Ids of the file made of digits are longs, like the ids of TinkerGraph and JanusGraph.
+func importID(id string) json.RawMessage {
+	if i, err := strconv.ParseInt(id, 10, 64); err == nil {
+		value, _ := typed("g:Int64", i)
+		return value
+	}
+	value, _ := json.Marshal(id)
+	return value
+}
+
+// Builds the map of a row for the script of importScript.
+func importBinding(kind string, idProperty string, row *importRow) (json.RawMessage, error) {
+	match, props := graphsonMap{}, graphsonMap{}
+	label := row.label
+	if label == "" {
+		label = kind
+	}
+	labelValue, _ := json.Marshal(label)
+	match.put(importKeyLabel, labelValue)
+	for _, key := range sortedKeys(row.properties) {
+		props.putString(key, row.properties[key])
+	}
+
+	values := graphsonMap{}
+	if kind == ElementVertex {
+		if row.id == "" {
+			return nil, errors.New("missing id")
+		}
+		if idProperty == "" {
+			match.put(importKeyID, importID(row.id))
+		} else {
+			match.putString(idProperty, importID(row.id))
+		}
+	} else {
+		if row.outV == "" || row.inV == "" {
+			return nil, errors.New("missing outV or inV")
+		}
+		if row.id != "" {
+			if idProperty == "" {
+				match.put(importKeyID, importID(row.id))
+			} else {
+				match.putString(idProperty, importID(row.id))
+			}
+		}
+		if idProperty == "" {
+			match.put(importKeyOut, importID(row.outV))
+			match.put(importKeyIn, importID(row.inV))
+		} else {
+			match.put(importKeyOut, importMergeOut)
+			match.put(importKeyIn, importMergeIn)
+			out, in := graphsonMap{}, graphsonMap{}
+			out.putString(idProperty, importID(row.outV))
+			in.putString(idProperty, importID(row.inV))
+			values.putString("out", out.raw())
+			values.putString("in", in.raw())
+		}
+	}
+	// The properties on creation are merged with the search criteria.
+	values.putString("match", match.raw())
+	values.putString("create", props.raw())
+	values.putString("props", props.raw())
+	return values.raw(), nil
+}
+
+// StartImport checks the files of the request and imports them in the background. The request context is only
+// used to resolve the gremlin credentials of the user and for the audit log, the job has its own context which is
+// cancelled by CancelImportJob.
+func StartImport(c *gin.Context, config *Config, req ImportRequest) (_ ImportJob, err error) {
+	defer func() {
+		if err != nil {
+			req.removeFiles()
+		}
+	}()
+	backend, err := config.Backend(req.Backend)
+	if err != nil {
+		return ImportJob{}, &QueryError{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+	if err := CheckBackendAccess(c, backend); err != nil {
+		return ImportJob{}, err
+	}
+	if req.BatchSize == 0 {
+		req.BatchSize = DefaultImportBatchSize
+	}
+	if req.BatchSize < 0 || req.BatchSize > MaxImportBatchSize {
+		return ImportJob{}, &QueryError{Status: http.StatusBadRequest, Message: fmt.Sprintf("invalid batch size %d, expected 1 to %d", req.BatchSize, MaxImportBatchSize)}
+	}
+	type importSource struct {
+		file  *ImportFile
+		kinds []string
+		read  importReader
+	}
+	var sources []importSource
+	if req.GraphML != nil {
+		if req.Vertices != nil || req.Edges != nil {
+			return ImportJob{}, &QueryError{Status: http.StatusBadRequest, Message: "either a GraphML file or CSV files are expected"}
+		}
+		sources = append(sources, importSource{req.GraphML, []string{ElementVertex, ElementEdge}, graphMLReader(req.GraphML.Path)})
+	}
+	for _, source := range []importSource{{file: req.Vertices, kinds: []string{ElementVertex}}, {file: req.Edges, kinds: []string{ElementEdge}}} {
+		if source.file == nil {
+			continue
+		}
+		if err := checkCSVFile(source.file.Path, source.kinds[0]); err != nil {
+			return ImportJob{}, &QueryError{Status: http.StatusBadRequest, Message: fmt.Sprintf("invalid %s: %v", source.file.Name, err)}
+		}
+		source.read = csvReader(source.file.Path)
+		sources = append(sources, source)
+	}
+	if len(sources) == 0 {
+		return ImportJob{}, &QueryError{Status: http.StatusBadRequest, Message: "a GraphML file or CSV files of vertices and edges are required"}
+	}
+
+	scripts := map[string]string{}
+	for _, kind := range []string{ElementVertex, ElementEdge} {
+		if scripts[kind], err = importScript(kind, req.IDProperty); err != nil {
+			return ImportJob{}, err
+		}
+	}
+	key, err := connectionKeyFromContext(c, config, backend)
+	if err != nil {
+		return ImportJob{}, newUnavailableError(err)
+	}
+	// Fails early when the backend is unreachable. The batches take a pooled connection each.
+	conn, err := connections.acquire(key, backend.Pool)
+	if err != nil {
+		return ImportJob{}, newUnavailableError(err)
+	}
+	conn.Release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	job := &ImportJob{
+		ID:         uuid.New().String(),
+		Username:   CurrentUsername(c),
+		Backend:    backend.Name,
+		IDProperty: req.IDProperty,
+		State:      ImportRunning,
+		Started:    time.Now(),
+		Failures:   []ImportFailure{},
+		cancel:     cancel,
+	}
+	for _, file := range req.files() {
+		job.Files = append(job.Files, file.Name)
+	}
+	imports.add(job)
+	run := &importRun{
+		job:     job,
+		config:  config,
+		backend: backend,
+		ctx:     ctx,
+		key:     key,
+		scripts: scripts,
+		req:     req,
+	}
+	// The request context is reused after the request, the copy is safe to keep.
+	auditContext := c.Copy()
+	go func() {
+		defer req.removeFiles()
+		defer cancel()
+		var err error
+		for _, source := range sources {
+			for _, kind := range source.kinds {
+				if err = run.importRows(source.file.Name, kind, source.read); err != nil {
+					break
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		if ctx.Err() != nil {
+			err = errImportCancelled
+		}
+		run.finish(auditContext, err)
+	}()
+	return snapshotImportJob(job), nil
+}
+
+var errImportCancelled = errors.New("import cancelled")
+
+type importRun struct {
+	job     *ImportJob
+	config  *Config
+	backend *Backend
+	ctx     context.Context
+	// Key of the pooled connections of the user who started the job.
+	key     connectionKey
+	scripts map[string]string
+	req     ImportRequest
+}
+
+type importBatchRow struct {
+	row     *importRow
+	binding json.RawMessage
+}
+
+// Reads the rows of one kind and writes them in batches. Returns the errors of the file, the rows which cannot be
+// written are counted as failed.
+func (r *importRun) importRows(fileName string, kind string, read importReader) error {
+	counts := func(job *ImportJob) *ImportCounts {
+		if kind == ElementVertex {
+			return &job.Vertices
+		}
+		return &job.Edges
+	}
+	fail := func(job *ImportJob, row *importRow, reason string) {
+		counts(job).Failed++
+		if len(job.Failures) < maxImportFailures {
+			job.Failures = append(job.Failures, ImportFailure{File: fileName, Row: row.line, ID: row.id, Reason: reason})
+		}
+	}
+
+	batch := make([]importBatchRow, 0, r.req.BatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		bindings := make([]json.RawMessage, len(batch))
+		for i, item := range batch {
+			bindings[i] = item.binding
+		}
+		err := r.submit(kind, bindings)
+		if r.ctx.Err() != nil {
+			// Cancelled, the rows are neither written nor failed.
+			batch = batch[:0]
+			return
+		}
+		if err == nil {
+			imports.update(r.job, func(job *ImportJob) {
+				counts(job).Written += len(batch)
+			})
+			batch = batch[:0]
+			return
+		}
+		if len(batch) == 1 {
+			imports.update(r.job, func(job *ImportJob) {
+				fail(job, batch[0].row, NewQueryError(err).Message)
+			})
+			batch = batch[:0]
+			return
+		}
+		// The rows may have been partly written, merging them again one by one finds the failing ones.
+		logrus.Debugf("import batch failed, retrying the rows one by one: %v", err)
+		for _, item := range batch {
+			if r.ctx.Err() != nil {
+				break
+			}
+			err := r.submit(kind, []json.RawMessage{item.binding})
+			imports.update(r.job, func(job *ImportJob) {
+				if err != nil {
+					fail(job, item.row, NewQueryError(err).Message)
+				} else {
+					counts(job).Written++
+				}
+			})
+		}
+		batch = batch[:0]
+	}
+
+	err := read(kind, func(row *importRow, err error) error {
+		if r.ctx.Err() != nil {
+			return r.ctx.Err()
+		}
+		var binding json.RawMessage
+		if err == nil {
+			binding, err = importBinding(kind, r.req.IDProperty, row)
+		}
+		imports.update(r.job, func(job *ImportJob) {
+			counts(job).Read++
+			if err != nil {
+				fail(job, row, err.Error())
+			}
+		})
+		if err != nil {
+			return nil
+		}
+		batch = append(batch, importBatchRow{row: row, binding: binding})
+		if len(batch) >= r.req.BatchSize {
+			flush()
+		}
+		return nil
+	})
+	flush()
+	if err != nil {
+		return fmt.Errorf("%s: %v", fileName, err)
+	}
+	return nil
+}
+
+// Merges a batch of rows. The batches count against the concurrent queries of the user, and take a pooled connection
+// for their duration only.
+func (r *importRun) submit(kind string, rows []json.RawMessage) (err error) {
+	release, err := queryLimits.acquire(r.ctx, r.job.Username, r.config.Limits)
+	if err != nil {
+		return err
+	}
+	defer release()
+	conn, err := connections.acquire(r.key, r.backend.Pool)
+	if err != nil {
+		return newUnavailableError(err)
+	}
+	defer conn.Release()
+	start := time.Now()
+	defer func() {
+		observeGremlinQuery(r.backend.Name, start, err)
+	}()
+
+	list, err := typed("g:List", rows)
+	if err != nil {
+		return err
+	}
+	optionsBuilder := gremlingo.RequestOptionsBuilder{}
+	optionsBuilder.SetBindings(map[string]interface{}{importRowsBinding: list})
+	for key, value := range r.backend.Aliases {
+		optionsBuilder.AddAliases(key, value)
+	}
+	resultSet, err := conn.driver.SubmitWithOptions(r.scripts[kind], optionsBuilder.Create())
+	if err != nil {
+		return newUnavailableError(err)
+	}
+	// Always drain the result set, the connection is shared with other requests.
+	if _, err := resultSet.All(); err != nil {
+		return NewQueryError(err)
+	}
+	if err := resultSet.GetError(); err != nil {
+		return NewQueryError(err)
+	}
+	return nil
+}
+
+func (r *importRun) finish(c *gin.Context, err error) {
+	var job ImportJob
+	imports.update(r.job, func(j *ImportJob) {
+		finished := time.Now()
+		j.Finished = &finished
+		switch {
+		case errors.Is(err, errImportCancelled):
+			j.State = ImportCancelled
+			j.Error = err.Error()
+		case err != nil:
+			j.State = ImportFailed
+			j.Error = err.Error()
+		case j.Vertices.Failed > 0 || j.Edges.Failed > 0:
+			j.State = ImportPartial
+		default:
+			j.State = ImportSucceeded
+		}
+		job = snapshotImportJob(j)
+	})
+	logrus.Infof("import %s by %s finished: %s, %d vertices and %d edges written, %d failed", job.ID, job.Username, job.State,
+		job.Vertices.Written, job.Edges.Written, job.Vertices.Failed+job.Edges.Failed)
+
+	entry := AuditEntry{
+		Event:       AuditImport,
+		Backend:     job.Backend,
+		Query:       r.scripts[ElementVertex] + "; " + r.scripts[ElementEdge],
+		Bindings:    map[string]interface{}{"files": job.Files, "idProperty": job.IDProperty},
+		ResultCount: job.Vertices.Written + job.Edges.Written,
+		DurationMs:  job.Finished.Sub(job.Started).Milliseconds(),
+		Error:       job.Error,
+	}
+	if entry.Error == "" && job.State == ImportPartial {
+		entry.Error = fmt.Sprintf("%d rows failed", job.Vertices.Failed+job.Edges.Failed)
+	}
+	Audit(c, entry)
+}
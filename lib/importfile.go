@@ -0,0 +1,311 @@
+package lib
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// importRow is a vertex or an edge read from an import file. The properties are GraphSON values.
+type importRow struct {
+	// Line of the CSV file, or position of the node or edge in the GraphML file.
+	line       int
+	id         string
+	label      string
+	outV       string
+	inV        string
+	properties map[string]json.RawMessage
+}
+
+// Reads the rows of one kind of an import file. Rows which cannot be read are passed with an error, fn stops the
+// reading by returning an error.
+type importReader func(kind string, fn func(row *importRow, err error) error) error
+
+// Converts a value of an import file to GraphSON. The types are the GraphML attr.type values.
+func importValue(typ string, value string) (json.RawMessage, error) {
+	switch typ {
+	case "", "string":
+		return json.Marshal(value)
+	case "boolean":
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid boolean %q", value)
+		}
+		return json.Marshal(b)
+	case "int":
+		i, err := strconv.ParseInt(strings.TrimSpace(value), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid int %q", value)
+		}
+		return typed("g:Int32", i)
+	case "long":
+		i, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid long %q", value)
+		}
+		return typed("g:Int64", i)
+	case "float", "double":
+		f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", typ, value)
+		}
+		if typ == "float" {
+			return typed("g:Float", f)
+		}
+		return typed("g:Double", f)
+	default:
+		return nil, fmt.Errorf("unknown type %q", typ)
+	}
+}
+
+var importTypes = map[string]bool{"string": true, "boolean": true, "int": true, "long": true, "float": true, "double": true}
+
+// csvColumn is a column of an import CSV file. The header of a property can name a type after a colon, like
+// "age:int". Properties are strings by default.
+type csvColumn struct {
+	name string
+	typ  string
+}
+
+// Reads the header of a CSV file written by the export, or by hand. The columns id, label, outV and inV are the
+// element columns, a "type" column is only used to skip the rows of the other kind, and the "property:" prefix of
+// the properties named like an element column is removed.
+func readCSVHeader(reader *csv.Reader) ([]csvColumn, error) {
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("empty CSV file")
+	}
+	if err != nil {
+		return nil, err
+	}
+	columns := make([]csvColumn, len(header))
+	for i, name := range header {
+		name = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+		if isElementColumn(name) {
+			columns[i] = csvColumn{name: name}
+			continue
+		}
+		name = strings.TrimPrefix(name, "property:")
+		if index := strings.LastIndexByte(name, ':'); index > 0 {
+			typ := strings.ToLower(name[index+1:])
+			if !importTypes[typ] {
+				return nil, fmt.Errorf("invalid type of column %q, expected string, boolean, int, long, float or double", header[i])
+			}
+			columns[i] = csvColumn{name: "property:" + name[:index], typ: typ}
+		} else {
+			columns[i] = csvColumn{name: "property:" + name}
+		}
+	}
+	return columns, nil
+}
+
+func hasColumn(columns []csvColumn, name string) bool {
+	for _, column := range columns {
+		if column.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCSVFile checks that the file has the columns required for the kind of its rows.
+func checkCSVFile(path string, kind string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	columns, err := readCSVHeader(csv.NewReader(file))
+	if err != nil {
+		return err
+	}
+	required := []string{"id"}
+	if kind == ElementEdge {
+		required = []string{"outV", "inV"}
+	}
+	for _, name := range required {
+		if !hasColumn(columns, name) {
+			return fmt.Errorf("missing %s column", name)
+		}
+	}
+	return nil
+}
+
+// csvReader reads the vertices or the edges of a CSV file.
+func csvReader(path string) importReader {
+	return func(kind string, fn func(row *importRow, err error) error) error {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		reader := csv.NewReader(file)
+		reader.FieldsPerRecord = -1
+		columns, err := readCSVHeader(reader)
+		if err != nil {
+			return err
+		}
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				return nil
+			}
+			var parseError *csv.ParseError
+			if errors.As(err, &parseError) {
+				if err := fn(&importRow{line: parseError.Line}, parseError.Err); err != nil {
+					return err
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			line, _ := reader.FieldPos(0)
+			row, skip, err := csvRow(columns, record, kind)
+			if skip {
+				continue
+			}
+			row.line = line
+			if err := fn(row, err); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func csvRow(columns []csvColumn, record []string, kind string) (*importRow, bool, error) {
+	row := &importRow{properties: map[string]json.RawMessage{}}
+	if len(record) != len(columns) {
+		return row, false, fmt.Errorf("expected %d fields, got %d", len(columns), len(record))
+	}
+	for i, column := range columns {
+		value := record[i]
+		switch column.name {
+		case "type":
+			if value != "" && value != kind {
+				return row, true, nil
+			}
+		case "id":
+			row.id = value
+		case "label":
+			row.label = value
+		case "outV":
+			row.outV = value
+		case "inV":
+			row.inV = value
+		default:
+			if value == "" {
+				continue
+			}
+			property, err := importValue(column.typ, value)
+			if err != nil {
+				return row, false, fmt.Errorf("column %s: %v", strings.TrimPrefix(column.name, "property:"), err)
+			}
+			row.properties[strings.TrimPrefix(column.name, "property:")] = property
+		}
+	}
+	return row, false, nil
+}
+
+type graphMLKey struct {
+	ID   string `xml:"id,attr"`
+	Name string `xml:"attr.name,attr"`
+	Type string `xml:"attr.type,attr"`
+}
+
+type graphMLElement struct {
+	ID     string `xml:"id,attr"`
+	Source string `xml:"source,attr"`
+	Target string `xml:"target,attr"`
+	Data   []struct {
+		Key   string `xml:"key,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"data"`
+}
+
+// Attributes holding the labels: labelV and labelE are written by TinkerPop and by the export, labels by neo4j.
+var graphMLLabelAttributes = map[string]bool{"labelV": true, "labelE": true, "labels": true, "label": true}
+
+// graphMLReader reads the nodes or the edges of a GraphML file. The file is streamed, the keys are declared before
+// the graph.
+func graphMLReader(path string) importReader {
+	return func(kind string, fn func(row *importRow, err error) error) error {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		elementName := "node"
+		if kind == ElementEdge {
+			elementName = "edge"
+		}
+		keys := map[string]graphMLKey{}
+		decoder := xml.NewDecoder(file)
+		position := 0
+		for {
+			token, err := decoder.Token()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("invalid GraphML: %v", err)
+			}
+			start, ok := token.(xml.StartElement)
+			if !ok {
+				continue
+			}
+			switch start.Name.Local {
+			case "key":
+				var key graphMLKey
+				if err := decoder.DecodeElement(&key, &start); err != nil {
+					return fmt.Errorf("invalid GraphML key: %v", err)
+				}
+				keys[key.ID] = key
+			case "node", "edge":
+				if start.Name.Local != elementName {
+					if err := decoder.Skip(); err != nil {
+						return fmt.Errorf("invalid GraphML: %v", err)
+					}
+					continue
+				}
+				var element graphMLElement
+				if err := decoder.DecodeElement(&element, &start); err != nil {
+					return fmt.Errorf("invalid GraphML %s: %v", elementName, err)
+				}
+				position++
+				row, err := graphMLRow(keys, &element, kind)
+				row.line = position
+				if err := fn(row, err); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func graphMLRow(keys map[string]graphMLKey, element *graphMLElement, kind string) (*importRow, error) {
+	row := &importRow{id: element.ID, outV: element.Source, inV: element.Target, properties: map[string]json.RawMessage{}}
+	for _, data := range element.Data {
+		key, ok := keys[data.Key]
+		if !ok {
+			return row, fmt.Errorf("undeclared key %q", data.Key)
+		}
+		if graphMLLabelAttributes[key.Name] {
+			// Neo4j writes the labels of the nodes as ":Label1:Label2", only the first one is kept.
+			row.label = strings.Split(strings.TrimPrefix(data.Value, ":"), ":")[0]
+			continue
+		}
+		property, err := importValue(key.Type, data.Value)
+		if err != nil {
+			return row, fmt.Errorf("%s: %v", key.Name, err)
+		}
+		row.properties[key.Name] = property
+	}
+	return row, nil
+}
@@ -0,0 +1,104 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	gremlingo "github.com/apache/tinkerpop/gremlin-go/driver"
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	ErrQueryCancelled = errors.New("query cancelled")
+	ErrQueryNotFound  = errors.New("query not found")
+)
+
+type inflightQuery struct {
+	resultSet gremlingo.ResultSet
+	cancelled bool
+}
+
+// Request ids are chosen by the clients, they are only unique per user.
+type inflightKey struct {
+	username  string
+	requestID string
+}
+
+// In-flight queries by user and request id, so that they can be cancelled from another http request.
+type inflightQueries struct {
+	mutex   sync.Mutex
+	queries map[inflightKey]*inflightQuery
+}
+
+var inflight = &inflightQueries{queries: map[inflightKey]*inflightQuery{}}
+
+// Reserves the request id of the user before the query is submitted. A request id the user already has in flight
+// is rejected, it would otherwise hide the other query from CancelQuery.
+func (q *inflightQueries) register(username string, requestID string) (*inflightQuery, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	key := inflightKey{username: username, requestID: requestID}
+	if _, ok := q.queries[key]; ok {
+		return nil, &QueryError{Status: http.StatusConflict, Message: fmt.Sprintf("a query with request id %s is already running", requestID)}
+	}
+	query := &inflightQuery{}
+	q.queries[key] = query
+	return query, nil
+}
+
+// Attaches the result set of the submitted query, cancelled right away when the query was cancelled meanwhile.
+func (q *inflightQueries) submitted(query *inflightQuery, resultSet gremlingo.ResultSet) {
+	q.mutex.Lock()
+	query.resultSet = resultSet
+	cancelled := query.cancelled
+	q.mutex.Unlock()
+	if cancelled {
+		resultSet.Cancel()
+	}
+}
+
+func (q *inflightQueries) unregister(username string, requestID string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	delete(q.queries, inflightKey{username: username, requestID: requestID})
+}
+
+func (q *inflightQueries) cancel(query *inflightQuery) {
+	q.mutex.Lock()
+	query.cancelled = true
+	resultSet := query.resultSet
+	q.mutex.Unlock()
+	if resultSet != nil {
+		resultSet.Cancel()
+	}
+}
+
+func (q *inflightQueries) isCancelled(query *inflightQuery) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return query.cancelled
+}
+
+// CancelQuery abandons the in-flight query with the given request id. Users can only cancel their own queries.
+// The gremlin server has no cancel operation for scripts, the evaluation is bounded by its evaluationTimeout.
+func CancelQuery(c *gin.Context, requestID string) error {
+	inflight.mutex.Lock()
+	query, ok := inflight.queries[inflightKey{username: CurrentUsername(c), requestID: requestID}]
+	inflight.mutex.Unlock()
+	if !ok {
+		return ErrQueryNotFound
+	}
+	inflight.cancel(query)
+	return nil
+}
+
+// CurrentUsername returns the username claim of the logged in user.
+func CurrentUsername(c *gin.Context) string {
+	if username, ok := jwt.ExtractClaims(c)["username"].(string); ok {
+		return username
+	}
+	return ""
+}
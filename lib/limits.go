@@ -0,0 +1,214 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// LimitsConfig protects the gremlin servers from busy users. Zero disables a limit.
+type LimitsConfig struct {
+	// Maximum number of gremlin queries running at once for a single user.
+	MaxConcurrentQueriesPerUser int `yaml:"maxConcurrentQueriesPerUser" default:"0"`
+	// Maximum number of gremlin queries running at once for all users.
+	MaxConcurrentQueries int `yaml:"maxConcurrentQueries" default:"0"`
+	// Maximum number of query requests per minute for a single user.
+	RequestsPerMinute int `yaml:"requestsPerMinute" default:"0"`
+	// How long a query waits for a free slot before being rejected. Zero rejects right away.
+	QueueTimeout time.Duration `yaml:"queueTimeout" default:"30s"`
+}
+
+// Retry-After of the queries rejected by a concurrency limit, in seconds.
+const concurrencyRetryAfter = 1
+
+var limitRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "limit_rejections_total",
+	Help:      "Requests rejected by a limit: user_concurrency, global_concurrency, rate or login.",
+}, []string{"limit"})
+
+func init() {
+	metricsRegistry.MustRegister(limitRejections)
+}
+
+// LimitError is returned when a query is over a limit.
+type LimitError struct {
+	Message string
+	// Seconds before the request should be retried.
+	RetryAfter int
+}
+
+func (e *LimitError) Error() string {
+	return e.Message
+}
+
+// Set on the requests holding a query slot, see AcquireQuerySlot.
+const querySlotKey = "querySlot"
+
+// AcquireQuerySlot takes a slot of the concurrency limits for all the queries of the request, e.g. its parallel
+// batches, which would otherwise compete for the slots with each other. The returned function must be called once the
+// queries end.
+func AcquireQuerySlot(c *gin.Context, config *Config) (func(), error) {
+	release, err := queryLimits.acquire(c.Request.Context(), CurrentUsername(c), config.Limits)
+	if err != nil {
+		return nil, err
+	}
+	c.Set(querySlotKey, true)
+	return release, nil
+}
+
+func rejectWithLimitError(c *gin.Context, err *LimitError) {
+	c.Header("Retry-After", strconv.Itoa(err.RetryAfter))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, err.Message)
+}
+
+// queryLimiter counts the running queries in total and by user. Waiting queries are woken up whenever a query ends.
+type queryLimiter struct {
+	mutex   sync.Mutex
+	total   int
+	perUser map[string]int
+	// Closed and replaced when a query ends.
+	released chan struct{}
+}
+
+var queryLimits = &queryLimiter{perUser: map[string]int{}, released: make(chan struct{})}
+
+// acquire waits until the query of the user is within the limits. The returned function must be called once the
+// query ends.
+func (l *queryLimiter) acquire(ctx context.Context, username string, limits LimitsConfig) (func(), error) {
+	var timeout <-chan time.Time
+	if limits.QueueTimeout > 0 {
+		timer := time.NewTimer(limits.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		l.mutex.Lock()
+		userFull := limits.MaxConcurrentQueriesPerUser > 0 && l.perUser[username] >= limits.MaxConcurrentQueriesPerUser
+		globalFull := limits.MaxConcurrentQueries > 0 && l.total >= limits.MaxConcurrentQueries
+		if !userFull && !globalFull {
+			l.total++
+			l.perUser[username]++
+			l.mutex.Unlock()
+			return func() { l.release(username) }, nil
+		}
+		released := l.released
+		l.mutex.Unlock()
+
+		if timeout == nil {
+			return nil, newConcurrencyError(userFull, limits)
+		}
+		select {
+		case <-released:
+		case <-timeout:
+			return nil, newConcurrencyError(userFull, limits)
+		case <-ctx.Done():
+			return nil, ErrQueryCancelled
+		}
+	}
+}
+
+func (l *queryLimiter) release(username string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.total--
+	l.perUser[username]--
+	if l.perUser[username] <= 0 {
+		delete(l.perUser, username)
+	}
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+func newConcurrencyError(userFull bool, limits LimitsConfig) *LimitError {
+	if userFull {
+		limitRejections.WithLabelValues("user_concurrency").Inc()
+		return &LimitError{
+			Message:    fmt.Sprintf("too many concurrent queries, the limit is %d per user", limits.MaxConcurrentQueriesPerUser),
+			RetryAfter: concurrencyRetryAfter,
+		}
+	}
+	limitRejections.WithLabelValues("global_concurrency").Inc()
+	return &LimitError{Message: "the gremlin server is busy, too many concurrent queries", RetryAfter: concurrencyRetryAfter}
+}
+
+// Remaining requests of a user, refilled continuously up to the requests per minute.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimiter keeps a token bucket per user. Full buckets are dropped, they are the same as new ones.
+type rateLimiter struct {
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+var requestRates = &rateLimiter{buckets: map[string]*tokenBucket{}}
+
+// allow takes a token of the user, or returns how long to wait for the next one.
+func (l *rateLimiter) allow(username string, perMinute int, now time.Time) (bool, time.Duration) {
+	capacity := float64(perMinute)
+	perSecond := capacity / 60
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if now.Sub(l.swept) > time.Minute {
+		l.sweep(capacity, perSecond, now)
+	}
+	bucket, ok := l.buckets[username]
+	if !ok {
+		bucket = &tokenBucket{tokens: capacity, updated: now}
+		l.buckets[username] = bucket
+	}
+	bucket.tokens = math.Min(capacity, bucket.tokens+now.Sub(bucket.updated).Seconds()*perSecond)
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / perSecond * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+func (l *rateLimiter) sweep(capacity float64, perSecond float64, now time.Time) {
+	for username, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*perSecond >= capacity {
+			delete(l.buckets, username)
+		}
+	}
+	l.swept = now
+}
+
+// RateLimitMiddleware rejects the requests of a user over LimitsConfig.RequestsPerMinute with 429.
+func RateLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v, exists := c.Get("conf")
+		if !exists {
+			c.Next()
+			return
+		}
+		perMinute := v.(*Config).Limits.RequestsPerMinute
+		if perMinute <= 0 {
+			c.Next()
+			return
+		}
+		ok, wait := requestRates.allow(CurrentUsername(c), perMinute, time.Now())
+		if !ok {
+			limitRejections.WithLabelValues("rate").Inc()
+			rejectWithLimitError(c, &LimitError{
+				Message:    fmt.Sprintf("too many requests, the limit is %d per minute", perMinute),
+				RetryAfter: int(math.Ceil(wait.Seconds())),
+			})
+			return
+		}
+		c.Next()
+	}
+}
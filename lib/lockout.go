@@ -0,0 +1,122 @@
+package lib
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LockoutConfig slows down and then locks out the logins after failed attempts, by client IP and by username, so
+// that passwords cannot be guessed through /login, and the gremlin servers are not flooded with authentications.
+type LockoutConfig struct {
+	Enabled bool `yaml:"enabled" default:"true"`
+	// Failed attempts allowed without delay.
+	FreeAttempts int `yaml:"freeAttempts" default:"3"`
+	// Delay after the first failed attempt over the free attempts, doubled by each failed attempt.
+	BaseDelay time.Duration `yaml:"baseDelay" default:"1s"`
+	MaxDelay  time.Duration `yaml:"maxDelay" default:"1m"`
+	// Failed attempts locking out a username, and a client IP, which can be shared by many users.
+	MaxFailuresPerUser int `yaml:"maxFailuresPerUser" default:"10"`
+	MaxFailuresPerIP   int `yaml:"maxFailuresPerIP" default:"30"`
+	// How long a lockout lasts.
+	Duration time.Duration `yaml:"duration" default:"15m"`
+	// Failed attempts are forgotten after this time without failure.
+	Window time.Duration `yaml:"window" default:"15m"`
+}
+
+// Failed attempts of a username or client IP.
+type loginFailureCount struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// loginThrottle counts the failed logins by key, "ip:<ip>" or "user:<username>". The counts without failure in the
+// window are dropped.
+type loginThrottle struct {
+	mutex  sync.Mutex
+	counts map[string]*loginFailureCount
+	swept  time.Time
+}
+
+var loginAttempts = &loginThrottle{counts: map[string]*loginFailureCount{}}
+
+func loginThrottleKeys(clientIP string, username string) []string {
+	return []string{"ip:" + clientIP, "user:" + username}
+}
+
+func (config *LockoutConfig) maxFailures(key string) int {
+	if strings.HasPrefix(key, "ip:") {
+		return config.MaxFailuresPerIP
+	}
+	return config.MaxFailuresPerUser
+}
+
+// check returns a LimitError while the client IP or the username must wait.
+func (t *loginThrottle) check(clientIP string, username string, now time.Time) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var wait time.Duration
+	for _, key := range loginThrottleKeys(clientIP, username) {
+		if count, ok := t.counts[key]; ok && count.blockedUntil.After(now) {
+			wait = time.Duration(math.Max(float64(wait), float64(count.blockedUntil.Sub(now))))
+		}
+	}
+	if wait == 0 {
+		return nil
+	}
+	limitRejections.WithLabelValues("login").Inc()
+	return &LimitError{
+		Message:    "too many failed logins, retry later",
+		RetryAfter: int(math.Ceil(wait.Seconds())),
+	}
+}
+
+// failed records a failed login, and returns the keys locked out by this failure.
+func (t *loginThrottle) failed(clientIP string, username string, config LockoutConfig, now time.Time) []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if now.Sub(t.swept) > config.Window {
+		t.sweep(config.Window, now)
+	}
+	var locked []string
+	for _, key := range loginThrottleKeys(clientIP, username) {
+		count, ok := t.counts[key]
+		if !ok || now.Sub(count.lastFailure) > config.Window {
+			count = &loginFailureCount{}
+			t.counts[key] = count
+		}
+		count.failures++
+		count.lastFailure = now
+		switch {
+		case count.failures >= config.maxFailures(key):
+			// The count starts again after the lockout.
+			count.failures = 0
+			count.blockedUntil = now.Add(config.Duration)
+			locked = append(locked, key)
+		case count.failures > config.FreeAttempts:
+			exponent := math.Min(float64(count.failures-config.FreeAttempts-1), 30)
+			delay := time.Duration(math.Min(float64(config.BaseDelay)*math.Pow(2, exponent), float64(config.MaxDelay)))
+			count.blockedUntil = now.Add(delay)
+		}
+	}
+	return locked
+}
+
+// succeeded forgets the failed attempts of the username. The failures of the client IP are kept, a user could
+// otherwise reset them with its own password between guesses.
+func (t *loginThrottle) succeeded(username string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.counts, "user:"+username)
+}
+
+func (t *loginThrottle) sweep(window time.Duration, now time.Time) {
+	for key, count := range t.counts {
+		if now.Sub(count.lastFailure) > window && !count.blockedUntil.After(now) {
+			delete(t.counts, key)
+		}
+	}
+	t.swept = now
+}
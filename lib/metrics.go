@@ -0,0 +1,208 @@
+package lib
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "puppygraph_ui"
+
+// MetricsConfig controls the prometheus endpoint. It is off by default, its labels have the backend names and the
+// usernames.
+type MetricsConfig struct {
+	Enabled bool `yaml:"enabled" default:"false"`
+	// Bearer token required to scrape /metrics. Empty leaves the endpoint open.
+	Token string `yaml:"token" default:""`
+}
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "status"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of the HTTP requests by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+	gremlinQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "gremlin_query_duration_seconds",
+		Help:      "Latency of the gremlin queries by backend, from submission to the last result.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300},
+	}, []string{"backend"})
+	gremlinErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "gremlin_errors_total",
+		Help:      "Failed gremlin queries by backend and gremlin status code. The code is 0 when the gremlin server did not respond.",
+	}, []string{"backend", "code"})
+	propsBatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "props_batches_total",
+		Help:      "Batches of the property prefetch requests by backend.",
+	}, []string{"backend"})
+	propsBatchSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "props_batch_size",
+		Help:      "Number of ids in the batches of the property prefetch requests.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 11),
+	}, []string{"backend"})
+	loginFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "login_failures_total",
+		Help:      "Failed logins.",
+	})
+	healthChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "health_checks_total",
+		Help:      "Health checks of the gremlin backends by result: healthy, empty or error.",
+	}, []string{"backend", "result"})
+	backendHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "backend_healthy",
+		Help:      "Result of the last health check of the backend, 1 when healthy.",
+	}, []string{"backend"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+		httpRequestDuration,
+		gremlinQueryDuration,
+		gremlinErrors,
+		propsBatches,
+		propsBatchSize,
+		loginFailures,
+		healthChecks,
+		backendHealthy,
+		poolCollector{},
+	)
+}
+
+// MetricsMiddleware counts the requests and their latency. Requests without a route are counted as "unmatched", so
+// that scanners cannot create a series per path.
+func MetricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequests.WithLabelValues(route, c.Request.Method, strconv.Itoa(c.Writer.Status())).Inc()
+		httpRequestDuration.WithLabelValues(route, c.Request.Method).Observe(time.Since(start).Seconds())
+	}
+}
+
+// MetricsHandler serves the metrics in the prometheus text format, behind the bearer token of the config if any.
+func MetricsHandler(config MetricsConfig) gin.HandlerFunc {
+	handler := promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+	return func(c *gin.Context) {
+		if config.Token != "" {
+			token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(config.Token)) != 1 {
+				c.Header("WWW-Authenticate", "Bearer")
+				c.JSON(http.StatusUnauthorized, "Invalid metrics token")
+				return
+			}
+		}
+		handler.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+func observeGremlinQuery(backend string, start time.Time, err error) {
+	gremlinQueryDuration.WithLabelValues(backend).Observe(time.Since(start).Seconds())
+	if err != nil {
+		gremlinErrors.WithLabelValues(backend, strconv.Itoa(NewQueryError(err).Code)).Inc()
+	}
+}
+
+// ObservePropsBatch counts a batch of ids of a property prefetch request.
+func ObservePropsBatch(backend string, size int) {
+	propsBatches.WithLabelValues(backend).Inc()
+	propsBatchSize.WithLabelValues(backend).Observe(float64(size))
+}
+
+func observeHealthcheck(backend string, healthy bool, err error) {
+	result := "healthy"
+	switch {
+	case err != nil:
+		result = "error"
+	case !healthy:
+		result = "empty"
+	}
+	healthChecks.WithLabelValues(backend, result).Inc()
+	value := 0.0
+	if healthy {
+		value = 1
+	}
+	backendHealthy.WithLabelValues(backend).Set(value)
+}
+
+var (
+	poolDriversDesc = prometheus.NewDesc(metricsNamespace+"_pool_drivers",
+		"Gremlin drivers kept open by gremlin server url, one per credential.", []string{"url"}, nil)
+	poolInflightDesc = prometheus.NewDesc(metricsNamespace+"_pool_inflight_requests",
+		"Requests holding a gremlin driver by gremlin server url.", []string{"url"}, nil)
+	poolConnectionsDesc = prometheus.NewDesc(metricsNamespace+"_pool_connections",
+		"Open websocket connections by gremlin server url.", []string{"url"}, nil)
+	poolActiveResultsDesc = prometheus.NewDesc(metricsNamespace+"_pool_active_results",
+		"Results in progress on the websocket connections by gremlin server url.", []string{"url"}, nil)
+	poolMaxActiveResultsDesc = prometheus.NewDesc(metricsNamespace+"_pool_connection_active_results_max",
+		"Results in progress on the busiest websocket connection by gremlin server url.", []string{"url"}, nil)
+)
+
+// poolCollector reports the connections of the connection manager when scraped.
+type poolCollector struct{}
+
+func (poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolDriversDesc
+	ch <- poolInflightDesc
+	ch <- poolConnectionsDesc
+	ch <- poolActiveResultsDesc
+	ch <- poolMaxActiveResultsDesc
+}
+
+func (poolCollector) Collect(ch chan<- prometheus.Metric) {
+	type urlStats struct {
+		drivers, inflight, connections, activeResults, maxActiveResults int
+	}
+	stats := map[string]*urlStats{}
+	for _, pc := range connections.snapshot() {
+		s, ok := stats[pc.url]
+		if !ok {
+			s = &urlStats{}
+			stats[pc.url] = s
+		}
+		s.drivers++
+		s.inflight += pc.inflight
+		for _, active := range pc.activeResults {
+			s.connections++
+			s.activeResults += active
+			if active > s.maxActiveResults {
+				s.maxActiveResults = active
+			}
+		}
+	}
+	for url, s := range stats {
+		ch <- prometheus.MustNewConstMetric(poolDriversDesc, prometheus.GaugeValue, float64(s.drivers), url)
+		ch <- prometheus.MustNewConstMetric(poolInflightDesc, prometheus.GaugeValue, float64(s.inflight), url)
+		ch <- prometheus.MustNewConstMetric(poolConnectionsDesc, prometheus.GaugeValue, float64(s.connections), url)
+		ch <- prometheus.MustNewConstMetric(poolActiveResultsDesc, prometheus.GaugeValue, float64(s.activeResults), url)
+		ch <- prometheus.MustNewConstMetric(poolMaxActiveResultsDesc, prometheus.GaugeValue, float64(s.maxActiveResults), url)
+	}
+}
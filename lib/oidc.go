@@ -0,0 +1,273 @@
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// OIDCConfig is the OpenID Connect single sign-on, enabled when the issuer is set. The users log in with the
+// authorization code flow on /login/oidc, and get the same JWT as the users of /login.
+type OIDCConfig struct {
+	// Issuer URL of the provider, its configuration is discovered from /.well-known/openid-configuration.
+	Issuer       string `yaml:"issuer" envconfig:"OIDC_ISSUER" default:""`
+	ClientID     string `yaml:"clientId" envconfig:"OIDC_CLIENT_ID" default:""`
+	ClientSecret string `yaml:"clientSecret" envconfig:"OIDC_CLIENT_SECRET" default:""`
+	// URL of /login/oidc/callback registered at the provider, e.g. https://puppygraph.example.com/login/oidc/callback.
+	RedirectURL string   `yaml:"redirectUrl" envconfig:"OIDC_REDIRECT_URL" default:""`
+	Scopes      []string `yaml:"scopes" envconfig:"OIDC_SCOPES" default:"openid,profile,email"`
+	// Claim of the ID token identifying the user, the subject when the claim is missing. The username is
+	// oidc:<issuer>#<claim value>.
+	UsernameClaim string `yaml:"usernameClaim" envconfig:"OIDC_USERNAME_CLAIM" default:"sub"`
+	// Claim of the ID token with the groups or roles of the user, a string or a list of strings.
+	RoleClaim string `yaml:"roleClaim" envconfig:"OIDC_ROLE_CLAIM" default:"groups"`
+	// Roles by value of the role claim, e.g. puppygraph-admins:admin,analysts:reader.
+	RoleMapping map[string]string `yaml:"roleMapping" envconfig:"OIDC_ROLE_MAPPING" default:""`
+	// Role of the users without a mapped role. Empty refuses them.
+	DefaultRole string `yaml:"defaultRole" envconfig:"OIDC_DEFAULT_ROLE" default:""`
+}
+
+// Prefix of the usernames of the OIDC users. The local users, the admin user and the client certificates cannot
+// have it, so that an OIDC user never gets their history, saved queries, tokens or role.
+const oidcUsernamePrefix = "oidc:"
+
+func oidcUsername(issuer string, name string) string {
+	return oidcUsernamePrefix + issuer + "#" + name
+}
+
+func reservedUsername(username string) bool {
+	return strings.HasPrefix(username, oidcUsernamePrefix)
+}
+
+// Enabled tells whether the users can log in with the provider.
+func (config *OIDCConfig) Enabled() bool {
+	return config.Issuer != ""
+}
+
+// Returns the role of the claims: admin when any value of the role claim maps to admin, otherwise reader when any
+// maps to reader, otherwise the default role.
+func (config *OIDCConfig) role(claims map[string]interface{}) string {
+	var values []string
+	switch v := claims[config.RoleClaim].(type) {
+	case string:
+		values = []string{v}
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	role := config.DefaultRole
+	for _, value := range values {
+		switch config.RoleMapping[value] {
+		case RoleAdmin:
+			return RoleAdmin
+		case RoleReader:
+			role = RoleReader
+		}
+	}
+	return role
+}
+
+// The provider configuration is discovered on the first login, and again after a failure, so that the server
+// starts while the provider is down.
+type oidcProviders struct {
+	mu        sync.Mutex
+	providers map[string]*oidc.Provider
+}
+
+var providers = &oidcProviders{providers: map[string]*oidc.Provider{}}
+
+const oidcDiscoveryTimeout = 10 * time.Second
+
+func (p *oidcProviders) get(ctx context.Context, issuer string) (*oidc.Provider, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if provider, ok := p.providers[issuer]; ok {
+		return provider, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, oidcDiscoveryTimeout)
+	defer cancel()
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+	p.providers[issuer] = provider
+	return provider, nil
+}
+
+func oauth2Config(config *OIDCConfig, provider *oidc.Provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     config.ClientID,
+		ClientSecret: config.ClientSecret,
+		RedirectURL:  config.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       config.Scopes,
+	}
+}
+
+// The state, nonce and PKCE verifier of a login are kept in a cookie until the callback.
+const (
+	oidcCookieName   = "oidc_login"
+	oidcCookieMaxAge = 10 * 60
+)
+
+// Path of the login cookie, the directory of the callback as seen by the browser, which is behind a path prefix when
+// the UI is.
+func (config *OIDCConfig) cookiePath() string {
+	redirectURL, err := url.Parse(config.RedirectURL)
+	if err != nil || redirectURL.Path == "" {
+		return "/"
+	}
+	return path.Dir(redirectURL.Path)
+}
+
+// Path of the UI, two levels above the login cookie path.
+func (config *OIDCConfig) uiPath() string {
+	return strings.TrimSuffix(path.Dir(path.Dir(config.cookiePath())), "/") + "/"
+}
+
+func randomString() (string, error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// OIDCLoginHandler redirects the browser to the authorization endpoint of the provider.
+func OIDCLoginHandler(c *gin.Context) {
+	v, exists := c.Get("conf")
+	if !exists {
+		c.JSON(http.StatusInternalServerError, "Cannot load config")
+		return
+	}
+	config := &v.(*Config).Authentication.OIDC
+	provider, err := providers.get(c.Request.Context(), config.Issuer)
+	if err != nil {
+		logrus.Errorf("OIDC discovery of %s failed: %v", config.Issuer, err)
+		c.JSON(http.StatusBadGateway, gin.H{"code": http.StatusBadGateway, "message": "identity provider unavailable"})
+		return
+	}
+	state, err := randomString()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	nonce, err := randomString()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcCookieName, strings.Join([]string{state, nonce, verifier}, "."), oidcCookieMaxAge, config.cookiePath(), "", c.Request.TLS != nil, true)
+	authURL := oauth2Config(config, provider).AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// OIDCCallbackHandler exchanges the authorization code for the ID token of the user, then logs the user in with a
+// JWT of the middleware, like the /login handler of the middleware. The browser is sent back to the UI.
+func OIDCCallbackHandler(mw *jwt.GinJWTMiddleware) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v, exists := c.Get("conf")
+		if !exists {
+			c.JSON(http.StatusInternalServerError, "Cannot load config")
+			return
+		}
+		conf := v.(*Config)
+
+		username, role, err := oidcUser(c, &conf.Authentication.OIDC)
+		entry := AuditEntry{Event: AuditLogin, Username: username}
+		if err != nil {
+			entry.Event = AuditLoginFailed
+			entry.Error = err.Error()
+			loginFailures.Inc()
+			Audit(c, entry)
+			c.JSON(http.StatusUnauthorized, gin.H{"code": http.StatusUnauthorized, "message": err.Error()})
+			return
+		}
+		Audit(c, entry)
+
+		// OIDC users have no password, the backends with gremlin authentication reject them.
+		sessionID, err := sessions.create(username, "", mw.Timeout)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, err.Error())
+			return
+		}
+		token, _, err := mw.TokenGenerator(&user{Username: username, SessionID: sessionID, Role: role})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, jwt.ErrFailedTokenCreation.Error())
+			return
+		}
+		setJWTCookie(c, mw, token)
+		c.Redirect(http.StatusFound, conf.Authentication.OIDC.uiPath())
+	}
+}
+
+// Verifies the callback of the provider and returns the username and the role of the user.
+func oidcUser(c *gin.Context, config *OIDCConfig) (string, string, error) {
+	cookie, err := c.Cookie(oidcCookieName)
+	if err != nil {
+		return "", "", fmt.Errorf("missing login state, the login expired or was started in another browser")
+	}
+	c.SetCookie(oidcCookieName, "", -1, config.cookiePath(), "", c.Request.TLS != nil, true)
+	saved := strings.Split(cookie, ".")
+	if len(saved) != 3 || c.Query("state") != saved[0] {
+		return "", "", fmt.Errorf("invalid login state")
+	}
+	if errorCode := c.Query("error"); errorCode != "" {
+		return "", "", fmt.Errorf("identity provider error: %s", strings.TrimSpace(errorCode+" "+c.Query("error_description")))
+	}
+	nonce, verifier := saved[1], saved[2]
+
+	provider, err := providers.get(c.Request.Context(), config.Issuer)
+	if err != nil {
+		return "", "", fmt.Errorf("identity provider unavailable: %v", err)
+	}
+	token, err := oauth2Config(config, provider).Exchange(c.Request.Context(), c.Query("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		return "", "", fmt.Errorf("authorization code exchange failed: %v", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return "", "", fmt.Errorf("missing ID token")
+	}
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: config.ClientID}).Verify(c.Request.Context(), rawIDToken)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid ID token: %v", err)
+	}
+	if idToken.Nonce != nonce {
+		return "", "", fmt.Errorf("invalid ID token nonce")
+	}
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return "", "", fmt.Errorf("invalid ID token claims: %v", err)
+	}
+
+	name, _ := claims[config.UsernameClaim].(string)
+	if name == "" {
+		name = idToken.Subject
+	}
+	username := oidcUsername(idToken.Issuer, name)
+	role := config.role(claims)
+	if role == "" {
+		return username, "", fmt.Errorf("user %s has no role", username)
+	}
+	return username, role, nil
+}
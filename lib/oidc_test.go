@@ -0,0 +1,257 @@
+package lib
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// mockProvider is an OpenID provider with discovery, keys and a token endpoint. The authorization endpoint is not
+// served, the tests read the parameters of the redirect to it.
+type mockProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	// Code challenge and nonce of the authorization request, set by the test.
+	challenge string
+	nonce     string
+	// Claims of the ID token, besides iss, aud, exp and iat.
+	claims map[string]interface{}
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &mockProvider{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"issuer":                                p.server.URL,
+			"authorization_endpoint":                p.server.URL + "/authorize",
+			"token_endpoint":                        p.server.URL + "/token",
+			"jwks_uri":                              p.server.URL + "/keys",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if r.FormValue("code") != "code" || base64.RawURLEncoding.EncodeToString(sum[:]) != p.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		writeJSON(w, map[string]interface{}{"access_token": "access", "token_type": "Bearer", "id_token": p.idToken(t)})
+	})
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+func (p *mockProvider) idToken(t *testing.T) string {
+	claims := map[string]interface{}{
+		"iss":   p.server.URL,
+		"aud":   "puppygraph",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": p.nonce,
+	}
+	for name, value := range p.claims {
+		claims[name] = value
+	}
+	encode := func(value interface{}) string {
+		data, err := json.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"}) + "." + encode(claims)
+	sum := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (p *mockProvider) config() *Config {
+	config := &Config{}
+	config.Authentication.OIDC = OIDCConfig{
+		Issuer:        p.server.URL,
+		ClientID:      "puppygraph",
+		RedirectURL:   "https://puppygraph.example.com/ui/login/oidc/callback",
+		Scopes:        []string{"openid"},
+		UsernameClaim: "sub",
+		RoleClaim:     "groups",
+		RoleMapping:   map[string]string{"admins": RoleAdmin, "analysts": RoleReader},
+	}
+	return config
+}
+
+// Runs /login/oidc and returns the login cookie and the query of the redirect to the provider.
+func (p *mockProvider) login(t *testing.T, config *Config) (*http.Cookie, url.Values) {
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodGet, "/login/oidc", nil)
+	c.Set("conf", config)
+	OIDCLoginHandler(c)
+
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("login status %d: %s", recorder.Code, recorder.Body)
+	}
+	location, err := url.Parse(recorder.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(location.String(), p.server.URL+"/authorize?") {
+		t.Fatalf("redirect to %s, expected the authorization endpoint", location)
+	}
+	cookies := recorder.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcCookieName {
+		t.Fatalf("expected the login cookie, got %v", cookies)
+	}
+	if cookies[0].Path != "/ui/login/oidc" || !cookies[0].HttpOnly {
+		t.Errorf("login cookie path %q, http only %v", cookies[0].Path, cookies[0].HttpOnly)
+	}
+	return cookies[0], location.Query()
+}
+
+// Runs oidcUser on the callback of the provider.
+func callback(config *Config, cookie *http.Cookie, state string) (string, string, error) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/login/oidc/callback?code=code&state="+url.QueryEscape(state), nil)
+	c.Request.AddCookie(cookie)
+	return oidcUser(c, &config.Authentication.OIDC)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	p := newMockProvider(t)
+	config := p.config()
+	cookie, query := p.login(t, config)
+
+	if query.Get("client_id") != "puppygraph" || query.Get("response_type") != "code" {
+		t.Errorf("unexpected authorization request %v", query)
+	}
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		t.Errorf("missing PKCE challenge in %v", query)
+	}
+	saved := strings.Split(cookie.Value, ".")
+	if len(saved) != 3 || saved[0] != query.Get("state") || saved[1] != query.Get("nonce") {
+		t.Fatalf("login cookie %q does not match the state and nonce of %v", cookie.Value, query)
+	}
+	p.challenge, p.nonce = query.Get("code_challenge"), query.Get("nonce")
+	p.claims = map[string]interface{}{"sub": "1234", "groups": []string{"analysts", "admins"}}
+
+	username, role, err := callback(config, cookie, query.Get("state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "oidc:"+p.server.URL+"#1234" {
+		t.Errorf("username %q, expected the namespaced subject", username)
+	}
+	if role != RoleAdmin {
+		t.Errorf("role %q, expected admin", role)
+	}
+}
+
+func TestOIDCLoginRejected(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	p := newMockProvider(t)
+
+	for _, test := range []struct {
+		name  string
+		setup func()
+		state string
+		error string
+	}{
+		{
+			name:  "state",
+			state: "forged",
+			error: "invalid login state",
+		},
+		{
+			name:  "nonce",
+			setup: func() { p.nonce = "replayed" },
+			error: "invalid ID token nonce",
+		},
+		{
+			name:  "PKCE",
+			setup: func() { p.challenge = "other" },
+			error: "authorization code exchange failed",
+		},
+		{
+			name:  "unmapped role",
+			setup: func() { p.claims["groups"] = "guests" },
+			error: "has no role",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config := p.config()
+			cookie, query := p.login(t, config)
+			p.challenge, p.nonce = query.Get("code_challenge"), query.Get("nonce")
+			p.claims = map[string]interface{}{"sub": "1234", "groups": "analysts"}
+			if test.setup != nil {
+				test.setup()
+			}
+			state := query.Get("state")
+			if test.state != "" {
+				state = test.state
+			}
+			_, _, err := callback(config, cookie, state)
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("error %v, expected %q", err, test.error)
+			}
+		})
+	}
+}
+
+func TestOIDCRole(t *testing.T) {
+	config := &OIDCConfig{RoleClaim: "groups", RoleMapping: map[string]string{"admins": RoleAdmin, "analysts": RoleReader}}
+	for _, test := range []struct {
+		groups      interface{}
+		defaultRole string
+		role        string
+	}{
+		{[]interface{}{"analysts", "admins"}, "", RoleAdmin},
+		{"analysts", "", RoleReader},
+		{[]interface{}{"guests"}, "", ""},
+		{nil, "", ""},
+		{"guests", RoleReader, RoleReader},
+	} {
+		config.DefaultRole = test.defaultRole
+		if role := config.role(map[string]interface{}{"groups": test.groups}); role != test.role {
+			t.Errorf("role of %v with default %q is %q, expected %q", test.groups, test.defaultRole, role, test.role)
+		}
+	}
+}
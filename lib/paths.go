@@ -0,0 +1,117 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PathsConfig bounds the path searches.
+type PathsConfig struct {
+	MaxDepth int `yaml:"maxDepth" default:"6"`
+	// Maximum number of paths of a search.
+	MaxPaths int `yaml:"maxPaths" default:"10"`
+	// Evaluation timeout of a search on the gremlin server.
+	Timeout time.Duration `yaml:"timeout" default:"30s"`
+}
+
+// PathsRequest searches the shortest simple paths from a vertex to another. Ids are plain JSON or typed GraphSON values.
+type PathsRequest struct {
+	Source json.RawMessage `json:"source"`
+	Target json.RawMessage `json:"target"`
+	// Maximum number of edges of a path, PathsConfig.MaxDepth when zero.
+	MaxDepth int `json:"maxDepth"`
+	// out, in or both.
+	Direction  string   `json:"direction"`
+	EdgeLabels []string `json:"edgeLabels"`
+	// Number of paths, the shortest ones.
+	K       int    `json:"k"`
+	Backend string `json:"backend"`
+}
+
+const (
+	pathsSourceBinding   = "pathsSource"
+	pathsTargetBinding   = "pathsTarget"
+	pathsLabelsBinding   = "pathsLabels"
+	pathsMaxDepthBinding = "pathsMaxDepth"
+	pathsKBinding        = "pathsK"
+)
+
+// Builds the script of a search, every value of the request is a binding. The repeat() runs breadth first, the
+// first paths reaching the target are the shortest ones.
+func (req *PathsRequest) script(config *Config) (string, map[string]json.RawMessage, error) {
+	if len(req.Source) == 0 || len(req.Target) == 0 {
+		return "", nil, fmt.Errorf("missing source or target")
+	}
+	if req.Direction == "" {
+		req.Direction = "both"
+	}
+	steps, ok := expandSteps[req.Direction]
+	if !ok {
+		return "", nil, fmt.Errorf("invalid direction %q, expected out, in or both", req.Direction)
+	}
+	if req.MaxDepth == 0 {
+		req.MaxDepth = config.Paths.MaxDepth
+	}
+	if req.MaxDepth < 0 || req.MaxDepth > config.Paths.MaxDepth {
+		return "", nil, fmt.Errorf("invalid maxDepth %d, expected 1 to %d", req.MaxDepth, config.Paths.MaxDepth)
+	}
+	if req.K == 0 {
+		req.K = 1
+	}
+	if req.K < 0 || req.K > config.Paths.MaxPaths {
+		return "", nil, fmt.Errorf("invalid k %d, expected 1 to %d", req.K, config.Paths.MaxPaths)
+	}
+
+	bindings := map[string]json.RawMessage{pathsSourceBinding: req.Source, pathsTargetBinding: req.Target}
+	bindings[pathsMaxDepthBinding], _ = json.Marshal(req.MaxDepth)
+	bindings[pathsKBinding], _ = json.Marshal(req.K)
+
+	edges := steps[0]
+	if len(req.EdgeLabels) > 0 {
+		edges += fmt.Sprintf(".hasLabel(within(%s))", pathsLabelsBinding)
+		bindings[pathsLabelsBinding], _ = json.Marshal(req.EdgeLabels)
+	}
+	script := fmt.Sprintf("g.V(%s).repeat(%s.%s.simplePath())", pathsSourceBinding, edges, steps[1]) +
+		fmt.Sprintf(".until(or(hasId(%s), loops().is(%s))).hasId(%s)", pathsTargetBinding, pathsMaxDepthBinding, pathsTargetBinding) +
+		fmt.Sprintf(".path().by(elementMap()).limit(%s)", pathsKBinding)
+	return script, bindings, nil
+}
+
+// FindPaths runs the search of the request and returns the paths found, the shortest first.
+func FindPaths(c *gin.Context, config *Config, req *PathsRequest) (*Subgraph, error) {
+	backend, err := config.Backend(req.Backend)
+	if err != nil {
+		return nil, &QueryError{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+	script, raw, err := req.script(config)
+	if err != nil {
+		return nil, &QueryError{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+	bindings, err := ParseBindings(backend, raw)
+	if err != nil {
+		return nil, &QueryError{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+
+	result := newSubgraph()
+	known := map[string]map[string]bool{ElementVertex: {}, ElementEdge: {}}
+	query := QueryRequest{Query: script, Backend: backend.Name, Bindings: bindings, Timeout: config.Paths.Timeout}
+	_, err = SubmitStream(c, config, query, func(batch *GsonResponse) error {
+		for _, item := range batch.Value {
+			value, err := DecodeGraphSON(item)
+			if err != nil {
+				return fmt.Errorf("invalid path: %v", err)
+			}
+			objects, _ := value.([]interface{})
+			result.addPath(objects, known, 0)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
@@ -0,0 +1,179 @@
+package lib
+
+import (
+	"crypto/tls"
+	"sync"
+	"time"
+
+	gremlingo "github.com/apache/tinkerpop/gremlin-go/driver"
+	"github.com/sirupsen/logrus"
+)
+
+const poolJanitorInterval = 30 * time.Second
+
+// Connections are keyed by credential, since gremlin server binds the SASL authentication to the websocket.
+// Admin (no gremlin auth) requests share the key with an empty username.
+type connectionKey struct {
+	url            string
+	username       string
+	password       string
+	skipCertVerify bool
+}
+
+type pooledConnection struct {
+	manager     *connectionManager
+	key         connectionKey
+	driver      *gremlingo.DriverRemoteConnection
+	ready       chan struct{}
+	err         error
+	inflight    int
+	lastUsed    time.Time
+	idleTimeout time.Duration
+}
+
+// Release hands the connection back to the manager. The connection must not be used afterwards.
+func (pc *pooledConnection) Release() {
+	pc.manager.release(pc)
+}
+
+// connectionManager keeps one long-lived DriverRemoteConnection per credential. Each DriverRemoteConnection has
+// its own load balancing pool of websockets capped by PoolConfig.MaximumConcurrentConnections, and is closed once it
+// has been idle for PoolConfig.IdleTimeout.
+type connectionManager struct {
+	mutex       sync.Mutex
+	connections map[connectionKey]*pooledConnection
+	janitor     sync.Once
+}
+
+var connections = &connectionManager{connections: map[connectionKey]*pooledConnection{}}
+
+func (m *connectionManager) acquire(key connectionKey, pool PoolConfig) (*pooledConnection, error) {
+	m.janitor.Do(func() {
+		go m.evictLoop()
+	})
+
+	m.mutex.Lock()
+	pc, ok := m.connections[key]
+	if ok {
+		pc.inflight++
+		m.mutex.Unlock()
+		<-pc.ready
+		if pc.err != nil {
+			m.release(pc)
+			return nil, pc.err
+		}
+		return pc, nil
+	}
+	pc = &pooledConnection{
+		manager:     m,
+		key:         key,
+		ready:       make(chan struct{}),
+		inflight:    1,
+		lastUsed:    time.Now(),
+		idleTimeout: pool.IdleTimeout,
+	}
+	m.connections[key] = pc
+	m.mutex.Unlock()
+
+	// Dial outside of the lock so that a slow handshake only blocks requests using the same credential.
+	driver, err := createConnection(key.url, key.username, key.password, key.skipCertVerify, pool)
+	m.mutex.Lock()
+	pc.driver, pc.err = driver, err
+	if err != nil {
+		if m.connections[key] == pc {
+			delete(m.connections, key)
+		}
+		pc.inflight--
+		m.mutex.Unlock()
+		close(pc.ready)
+		return nil, err
+	}
+	m.mutex.Unlock()
+	logrus.Debugf("gremlin connection opened for %s (user: %q)", key.url, key.username)
+	close(pc.ready)
+	return pc, nil
+}
+
+func (m *connectionManager) release(pc *pooledConnection) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	pc.inflight--
+	pc.lastUsed = time.Now()
+}
+
+// Usage of a driver at one point in time.
+type connectionStats struct {
+	url      string
+	inflight int
+	// Active results of every open websocket of the driver.
+	activeResults []int
+}
+
+func (m *connectionManager) snapshot() []connectionStats {
+	var drivers []*pooledConnection
+	var stats []connectionStats
+	m.mutex.Lock()
+	for key, pc := range m.connections {
+		if pc.driver == nil {
+			continue
+		}
+		drivers = append(drivers, pc)
+		stats = append(stats, connectionStats{url: key.url, inflight: pc.inflight})
+	}
+	m.mutex.Unlock()
+
+	// Outside of the lock, the driver has its own lock.
+	for i, pc := range drivers {
+		stats[i].activeResults = pc.driver.ActiveResults()
+	}
+	return stats
+}
+
+func (m *connectionManager) evictLoop() {
+	ticker := time.NewTicker(poolJanitorInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.evictIdle(time.Now())
+	}
+}
+
+func (m *connectionManager) evictIdle(now time.Time) {
+	var idle []*pooledConnection
+	m.mutex.Lock()
+	for key, pc := range m.connections {
+		if pc.driver == nil || pc.inflight > 0 || pc.idleTimeout <= 0 {
+			continue
+		}
+		if now.Sub(pc.lastUsed) >= pc.idleTimeout {
+			delete(m.connections, key)
+			idle = append(idle, pc)
+		}
+	}
+	m.mutex.Unlock()
+
+	for _, pc := range idle {
+		logrus.Debugf("closing idle gremlin connection for %s (user: %q)", pc.key.url, pc.key.username)
+		pc.driver.Close()
+	}
+}
+
+func createConnection(wsUrl string, username string, password string, skipCertVerify bool, pool PoolConfig) (*gremlingo.DriverRemoteConnection, error) {
+	return gremlingo.NewDriverRemoteConnection(
+		wsUrl,
+		func(settings *gremlingo.DriverRemoteConnectionSettings) {
+			settings.Logger = &loggerAdaptor{}
+			settings.SerializerType = gremlingo.GraphsonSerializer
+			if skipCertVerify {
+				settings.TlsConfig = &tls.Config{InsecureSkipVerify: true}
+			}
+			if username != "" {
+				settings.AuthInfo = gremlingo.BasicAuthInfo(username, password)
+			}
+			if pool.MaximumConcurrentConnections > 0 {
+				settings.MaximumConcurrentConnections = pool.MaximumConcurrentConnections
+			}
+			if pool.NewConnectionThreshold > 0 {
+				settings.NewConnectionThreshold = pool.NewConnectionThreshold
+			}
+		})
+}
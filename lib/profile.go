@@ -0,0 +1,197 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// TraversalMetrics is the result of the profile() step.
+type TraversalMetrics struct {
+	DurationMs float64        `json:"durationMs"`
+	Steps      []*StepMetrics `json:"steps"`
+}
+
+// StepMetrics are the metrics of a step of a profiled traversal, with the metrics of its child traversals.
+type StepMetrics struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Number of elements and of traversers, traversers have a bulk of elements.
+	Count      int64   `json:"count"`
+	Traversers int64   `json:"traversers"`
+	DurationMs float64 `json:"durationMs"`
+	// Percent of the duration of the traversal.
+	Percent     float64                `json:"percent"`
+	Annotations map[string]interface{} `json:"annotations,omitempty"`
+	Nested      []*StepMetrics         `json:"nested,omitempty"`
+}
+
+// TraversalExplanation is the result of the explain() step: the steps of the traversal before and after each
+// traversal strategy.
+type TraversalExplanation struct {
+	Original     []string               `json:"original"`
+	Intermediate []*StrategyExplanation `json:"intermediate"`
+	Final        []string               `json:"final"`
+}
+
+// StrategyExplanation is the traversal after a strategy is applied.
+type StrategyExplanation struct {
+	Strategy  string   `json:"strategy"`
+	Category  string   `json:"category"`
+	Traversal []string `json:"traversal"`
+}
+
+// Profile is the profile of a query, and its explanation when the backend supports explain().
+type Profile struct {
+	Metrics     *TraversalMetrics     `json:"metrics"`
+	Explanation *TraversalExplanation `json:"explanation,omitempty"`
+	// Why the explanation is missing.
+	ExplainError string `json:"explainError,omitempty"`
+}
+
+// The GraphSON metrics are maps: "dur" is in milliseconds, "metrics" has the nested metrics.
+func decodeTraversalMetrics(value interface{}) *TraversalMetrics {
+	fields, _ := value.(map[string]interface{})
+	metrics := &TraversalMetrics{DurationMs: floatValue(fields["dur"]), Steps: []*StepMetrics{}}
+	nested, _ := fields["metrics"].([]interface{})
+	for _, item := range nested {
+		if step, ok := item.(*StepMetrics); ok {
+			metrics.Steps = append(metrics.Steps, step)
+		}
+	}
+	return metrics
+}
+
+func decodeStepMetrics(value interface{}) *StepMetrics {
+	fields, _ := value.(map[string]interface{})
+	step := &StepMetrics{ID: stringValue(fields["id"]), Name: stringValue(fields["name"]), DurationMs: floatValue(fields["dur"])}
+	counts, _ := fields["counts"].(map[string]interface{})
+	step.Count = int64(floatValue(counts["elementCount"]))
+	step.Traversers = int64(floatValue(counts["traverserCount"]))
+	annotations, _ := fields["annotations"].(map[string]interface{})
+	for key, annotation := range annotations {
+		if key == "percentDur" {
+			step.Percent = floatValue(annotation)
+			continue
+		}
+		if step.Annotations == nil {
+			step.Annotations = map[string]interface{}{}
+		}
+		step.Annotations[key] = annotation
+	}
+	nested, _ := fields["metrics"].([]interface{})
+	for _, item := range nested {
+		if child, ok := item.(*StepMetrics); ok {
+			step.Nested = append(step.Nested, child)
+		}
+	}
+	return step
+}
+
+func decodeTraversalExplanation(value interface{}) *TraversalExplanation {
+	fields, _ := value.(map[string]interface{})
+	explanation := &TraversalExplanation{
+		Original:     stringValues(fields["original"]),
+		Intermediate: []*StrategyExplanation{},
+		Final:        stringValues(fields["final"]),
+	}
+	intermediate, _ := fields["intermediate"].([]interface{})
+	for _, item := range intermediate {
+		strategy, _ := item.(map[string]interface{})
+		explanation.Intermediate = append(explanation.Intermediate, &StrategyExplanation{
+			Strategy:  stringValue(strategy["strategy"]),
+			Category:  stringValue(strategy["category"]),
+			Traversal: stringValues(strategy["traversal"]),
+		})
+	}
+	return explanation
+}
+
+func floatValue(value interface{}) float64 {
+	number, _ := value.(json.Number)
+	f, _ := number.Float64()
+	return f
+}
+
+func stringValues(value interface{}) []string {
+	items, _ := value.([]interface{})
+	values := make([]string, 0, len(items))
+	for _, item := range items {
+		values = append(values, stringValue(item))
+	}
+	return values
+}
+
+// Terminal steps ending a query, replaced by profile() or explain().
+var terminalStep = regexp.MustCompile(`\.(toList|toSet|next|iterate|profile|explain)\(\)$`)
+
+// Ends the traversal of the query with the step. The query must be a single traversal.
+func wrapTraversal(query string, step string) (string, error) {
+	query = strings.TrimRight(strings.TrimSpace(query), ";")
+	for terminalStep.MatchString(query) {
+		query = strings.TrimSpace(terminalStep.ReplaceAllString(query, ""))
+	}
+	if query == "" {
+		return "", fmt.Errorf("empty query")
+	}
+	return fmt.Sprintf("%s.%s()", query, step), nil
+}
+
+// ProfileQuery runs the traversal of the request with profile(), then with explain(). The profile runs the
+// traversal, the explanation only applies the traversal strategies. Backends which cannot explain a traversal still
+// return the profile, with the error of the explanation.
+func ProfileQuery(c *gin.Context, config *Config, req QueryRequest) (*Profile, error) {
+	profileQuery := req
+	var err error
+	profileQuery.Query, err = wrapTraversal(req.Query, "profile")
+	if err != nil {
+		return nil, &QueryError{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+	response, err := Submit(c, config, profileQuery)
+	if err != nil {
+		return nil, err
+	}
+	profile := &Profile{}
+	for _, item := range response.Value {
+		value, err := DecodeGraphSON(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid profile: %v", err)
+		}
+		if metrics, ok := value.(*TraversalMetrics); ok {
+			profile.Metrics = metrics
+			break
+		}
+	}
+	if profile.Metrics == nil {
+		return nil, &QueryError{Status: http.StatusBadRequest, Message: "the query did not return traversal metrics, expected a single traversal"}
+	}
+
+	explainQuery := req
+	// The request id of the client belongs to the profile.
+	explainQuery.RequestID = uuid.NewString()
+	explainQuery.Query, _ = wrapTraversal(req.Query, "explain")
+	response, err = Submit(c, config, explainQuery)
+	if err != nil {
+		profile.ExplainError = NewQueryError(err).Message
+		return profile, nil
+	}
+	for _, item := range response.Value {
+		value, err := DecodeGraphSON(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid explanation: %v", err)
+		}
+		if explanation, ok := value.(*TraversalExplanation); ok {
+			profile.Explanation = explanation
+			break
+		}
+	}
+	if profile.Explanation == nil {
+		profile.ExplainError = "the query did not return a traversal explanation"
+	}
+	return profile, nil
+}
@@ -0,0 +1,502 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	graphsonMimeType    = "application/vnd.gremlin-v3.0+json"
+	graphBinaryMimeType = "application/vnd.graphbinary-v1.0"
+	graphBinaryVersion  = 0x81
+	graphBinaryString   = 0x03
+	graphBinaryNull     = 0xfe
+)
+
+var proxyUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1 << 16,
+	WriteBufferSize: 1 << 16,
+}
+
+// ProxyGremlin forwards a request of a logged in user to the gremlin server. Websocket connections are proxied
+// message by message, so that the SASL challenge of the gremlin server is answered with the credentials of the user
+// and the aliases are applied to graphson requests. Other requests go to the HTTP endpoint of the gremlin server.
+// The backend is selected with the "backend" query parameter.
+func ProxyGremlin(c *gin.Context, config *Config) {
+	backend, err := config.Backend(c.Query("backend"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := CheckBackendAccess(c, backend); err != nil {
+		c.JSON(http.StatusForbidden, err.Error())
+		return
+	}
+	username, password, err := gremlinCredentials(c, config, backend)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, err.Error())
+		return
+	}
+	if websocket.IsWebSocketUpgrade(c.Request) {
+		proxyWebsocket(c, backend, username, password, CurrentRole(c) == RoleReader)
+	} else {
+		proxyHttp(c, backend, username, password, CurrentRole(c) == RoleReader)
+	}
+}
+
+type gremlinProxy struct {
+	c             *gin.Context
+	backend       string
+	aliases       map[string]string
+	username      string
+	password      string
+	client        *websocket.Conn
+	upstream      *websocket.Conn
+	upstreamMutex sync.Mutex
+	clientMutex   sync.Mutex
+	readOnly      bool
+
+	// Audit entries of the requests waiting for their final response, by request id.
+	pendingMutex sync.Mutex
+	pending      map[string]*pendingRequest
+}
+
+func proxyWebsocket(c *gin.Context, backend *Backend, username string, password string, readOnly bool) {
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 45 * time.Second,
+		TLSClientConfig:  &tls.Config{InsecureSkipVerify: backend.SkipCertVerify},
+	}
+	upstream, _, err := dialer.Dial(backend.WsUrl(), nil)
+	if err != nil {
+		logrus.Warnf("gremlin proxy: unable to connect to gremlin server: %v", err)
+		c.JSON(http.StatusServiceUnavailable, newUnavailableError(err))
+		return
+	}
+	client, err := proxyUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// The upgrader has already replied to the client.
+		upstream.Close()
+		return
+	}
+
+	proxy := &gremlinProxy{
+		c:        c,
+		backend:  backend.Name,
+		aliases:  backend.AliasesFor(readOnly),
+		username: username,
+		password: password,
+		client:   client,
+		upstream: upstream,
+		readOnly: readOnly,
+		pending:  map[string]*pendingRequest{},
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		proxy.pumpRequests()
+		upstream.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		proxy.pumpResponses()
+		client.Close()
+	}()
+	wg.Wait()
+	proxy.auditPending("connection closed")
+}
+
+func (p *gremlinProxy) writeUpstream(messageType int, data []byte) error {
+	p.upstreamMutex.Lock()
+	defer p.upstreamMutex.Unlock()
+	return p.upstream.WriteMessage(messageType, data)
+}
+
+func (p *gremlinProxy) writeClient(messageType int, data []byte) error {
+	p.clientMutex.Lock()
+	defer p.clientMutex.Unlock()
+	return p.client.WriteMessage(messageType, data)
+}
+
+func (p *gremlinProxy) pumpRequests() {
+	for {
+		messageType, data, err := p.client.ReadMessage()
+		if err != nil {
+			return
+		}
+		forward, reply := p.rewriteRequest(data)
+		p.trackRequest(data, reply)
+		if reply != nil {
+			messageType := websocket.TextMessage
+			if reply[0] == graphBinaryVersion {
+				messageType = websocket.BinaryMessage
+			}
+			if err := p.writeClient(messageType, reply); err != nil {
+				return
+			}
+		}
+		if forward == nil {
+			continue
+		}
+		if err := p.writeUpstream(messageType, forward); err != nil {
+			logrus.Debugf("gremlin proxy: write to gremlin server failed: %v", err)
+			return
+		}
+	}
+}
+
+func (p *gremlinProxy) pumpResponses() {
+	for {
+		messageType, data, err := p.upstream.ReadMessage()
+		if err != nil {
+			return
+		}
+		if p.username != "" {
+			if requestID, isBinary, ok := authenticationChallenge(data); ok {
+				if err := p.writeUpstream(websocket.BinaryMessage, p.authenticationRequest(requestID, isBinary)); err != nil {
+					logrus.Debugf("gremlin proxy: authentication failed: %v", err)
+					return
+				}
+				continue
+			}
+		}
+		p.trackResponse(data)
+		if err := p.writeClient(messageType, data); err != nil {
+			return
+		}
+	}
+}
+
+// Returns the request to forward to the gremlin server, nil to drop it, and the response to send to the client
+// instead, if any.
+//
+// Requests are prefixed by the length of the mime type and the mime type. Graphson requests get the configured
+// aliases, graphbinary requests are forwarded as is. When the proxy authenticates on behalf of the user,
+// authentication requests of the client are dropped. The requests of readers are restricted: they get the read-only
+// aliases instead of their own, scripts must pass CheckReadOnly, and bytecode must pass CheckReadOnlyBytecode and gets
+// the ReadOnlyStrategy. Graphbinary requests of readers are rejected, since the proxy does not decode graphbinary, and
+// so are the requests of readers which cannot be decoded or have other ops than eval, bytecode and authentication.
+func (p *gremlinProxy) rewriteRequest(data []byte) ([]byte, []byte) {
+	if len(data) == 0 || len(data) < 1+int(data[0]) {
+		if p.readOnly {
+			return nil, graphsonErrorResponse(nil, gremlinMalformedRequest, "invalid request: missing mime type")
+		}
+		return data, nil
+	}
+	prefix := data[:1+int(data[0])]
+	if !strings.Contains(string(prefix[1:]), "json") {
+		if p.readOnly {
+			var requestID uuid.UUID
+			if len(data) >= len(prefix)+17 {
+				// version, request id
+				requestID, _ = uuid.FromBytes(data[len(prefix)+1 : len(prefix)+17])
+			}
+			return nil, graphBinaryErrorResponse(requestID, gremlinUnauthorized, "read-only users must use the graphson serializer")
+		}
+		return data, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data[len(prefix):]))
+	decoder.UseNumber()
+	var message map[string]interface{}
+	if err := decoder.Decode(&message); err != nil {
+		if p.readOnly {
+			return nil, graphsonErrorResponse(nil, gremlinMalformedRequest, fmt.Sprintf("invalid request: %v", err))
+		}
+		return data, nil
+	}
+	op, _ := message["op"].(string)
+	if op == "authentication" && p.username != "" {
+		return nil, nil
+	}
+	if len(p.aliases) == 0 && !p.readOnly {
+		return data, nil
+	}
+	args, ok := message["args"].(map[string]interface{})
+	if !ok {
+		if p.readOnly {
+			return nil, graphsonErrorResponse(message["requestId"], gremlinMalformedRequest, "invalid request: missing args")
+		}
+		return data, nil
+	}
+
+	if p.readOnly {
+		switch op {
+		case "eval":
+			script, _ := args["gremlin"].(string)
+			bindings, _ := args["bindings"].(map[string]interface{})
+			if err := CheckReadOnly(script, p.aliases, bindings); err != nil {
+				return nil, graphsonErrorResponse(message["requestId"], gremlinUnauthorized, err.Error())
+			}
+		case "bytecode":
+			if err := CheckReadOnlyBytecode(args["gremlin"]); err != nil {
+				return nil, graphsonErrorResponse(message["requestId"], gremlinUnauthorized, err.Error())
+			}
+			if !addReadOnlyStrategy(args["gremlin"]) {
+				return nil, graphsonErrorResponse(message["requestId"], gremlinMalformedRequest, "invalid bytecode")
+			}
+		case "authentication":
+			// Only credentials, answered by the gremlin server.
+		default:
+			return nil, graphsonErrorResponse(message["requestId"], gremlinUnauthorized, fmt.Sprintf("op %q is not allowed for read-only users", op))
+		}
+	}
+
+	if len(p.aliases) > 0 || p.readOnly {
+		aliases, ok := args["aliases"].(map[string]interface{})
+		// The aliases of readers are not theirs to choose, they could name a source without the ReadOnlyStrategy.
+		if !ok || p.readOnly {
+			aliases = map[string]interface{}{}
+		}
+		for key, value := range p.aliases {
+			aliases[key] = value
+		}
+		args["aliases"] = aliases
+	}
+	body, err := json.Marshal(message)
+	if err != nil {
+		if p.readOnly {
+			return nil, graphsonErrorResponse(message["requestId"], gremlinMalformedRequest, fmt.Sprintf("invalid request: %v", err))
+		}
+		return data, nil
+	}
+	return append(append([]byte{}, prefix...), body...), nil
+}
+
+// Adds the ReadOnlyStrategy to the source instructions of graphson bytecode.
+func addReadOnlyStrategy(gremlin interface{}) bool {
+	bytecode, ok := gremlin.(map[string]interface{})
+	if !ok || bytecode["@type"] != "g:Bytecode" {
+		return false
+	}
+	value, ok := bytecode["@value"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	source, _ := value["source"].([]interface{})
+	strategy := map[string]interface{}{"@type": "g:ReadOnlyStrategy", "@value": map[string]interface{}{}}
+	value["source"] = append(source, []interface{}{"withStrategies", strategy})
+	return true
+}
+
+func graphsonErrorResponse(requestID interface{}, code int, message string) []byte {
+	if typed, ok := requestID.(map[string]interface{}); ok {
+		requestID = typed["@value"]
+	}
+	response, _ := json.Marshal(map[string]interface{}{
+		"requestId": requestID,
+		"status":    map[string]interface{}{"code": code, "message": message, "attributes": map[string]interface{}{}},
+		"result":    map[string]interface{}{"data": nil, "meta": map[string]interface{}{}},
+	})
+	return response
+}
+
+func graphBinaryErrorResponse(requestID uuid.UUID, code int, message string) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteByte(graphBinaryVersion)
+	// nullable request id
+	buffer.WriteByte(0)
+	buffer.Write(requestID[:])
+	binary.Write(&buffer, binary.BigEndian, int32(code))
+	// nullable status message
+	buffer.WriteByte(0)
+	binary.Write(&buffer, binary.BigEndian, int32(len(message)))
+	buffer.WriteString(message)
+	// status attributes, result meta
+	binary.Write(&buffer, binary.BigEndian, int32(0))
+	binary.Write(&buffer, binary.BigEndian, int32(0))
+	// null result data
+	buffer.Write([]byte{graphBinaryNull, 1})
+	return buffer.Bytes()
+}
+
+// Returns the request id of a response with the 407 authenticate status, in graphbinary or graphson format.
+func authenticationChallenge(data []byte) (uuid.UUID, bool, bool) {
+	if len(data) >= 22 && data[0] == graphBinaryVersion {
+		// version, nullable flag, request id, status code
+		if binary.BigEndian.Uint32(data[18:22]) != gremlinAuthenticate {
+			return uuid.Nil, true, false
+		}
+		requestID, err := uuid.FromBytes(data[2:18])
+		return requestID, true, err == nil
+	}
+	var response struct {
+		RequestID string `json:"requestId"`
+		Status    struct {
+			Code int `json:"code"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal(data, &response); err != nil || response.Status.Code != gremlinAuthenticate {
+		return uuid.Nil, false, false
+	}
+	requestID, err := uuid.Parse(response.RequestID)
+	return requestID, false, err == nil
+}
+
+// Builds the SASL PLAIN response to the challenge, in the format the client is using.
+func (p *gremlinProxy) authenticationRequest(requestID uuid.UUID, isBinary bool) []byte {
+	sasl := base64.StdEncoding.EncodeToString([]byte("\x00" + p.username + "\x00" + p.password))
+
+	var buffer bytes.Buffer
+	if !isBinary {
+		buffer.WriteByte(byte(len(graphsonMimeType)))
+		buffer.WriteString(graphsonMimeType)
+		body, _ := json.Marshal(map[string]interface{}{
+			"requestId": requestID.String(),
+			"op":        "authentication",
+			"processor": "",
+			"args":      map[string]interface{}{"sasl": sasl},
+		})
+		buffer.Write(body)
+		return buffer.Bytes()
+	}
+
+	writeString := func(s string) {
+		binary.Write(&buffer, binary.BigEndian, uint32(len(s)))
+		buffer.WriteString(s)
+	}
+	writeQualifiedString := func(s string) {
+		buffer.WriteByte(graphBinaryString)
+		buffer.WriteByte(0)
+		writeString(s)
+	}
+	buffer.WriteByte(byte(len(graphBinaryMimeType)))
+	buffer.WriteString(graphBinaryMimeType)
+	buffer.WriteByte(graphBinaryVersion)
+	buffer.Write(requestID[:])
+	writeString("authentication")
+	writeString("")
+	binary.Write(&buffer, binary.BigEndian, uint32(1))
+	writeQualifiedString("sasl")
+	writeQualifiedString(sasl)
+	return buffer.Bytes()
+}
+
+func proxyHttp(c *gin.Context, backend *Backend, username string, password string, readOnly bool) {
+	target, err := url.Parse(backend.WsUrl())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, "Invalid gremlin server url")
+		return
+	}
+	switch target.Scheme {
+	case "wss":
+		target.Scheme = "https"
+	default:
+		target.Scheme = "http"
+	}
+
+	entry := AuditEntry{Event: AuditGremlin, Backend: backend.Name}
+	switch c.Request.Method {
+	case http.MethodGet:
+		entry.Query = c.Query("gremlin")
+		if readOnly {
+			// GET requests cannot carry the read-only aliases.
+			err = &QueryError{Status: http.StatusMethodNotAllowed, Message: "read-only users must POST their queries"}
+		}
+	case http.MethodPost:
+		entry.Query, entry.Bindings, err = rewriteHttpRequest(c.Request, backend.AliasesFor(readOnly), readOnly)
+	default:
+		if readOnly {
+			// Only the POST requests are checked.
+			err = &QueryError{Status: http.StatusMethodNotAllowed, Message: "read-only users must POST their queries"}
+		}
+	}
+	if err != nil {
+		queryError := NewQueryError(err)
+		if queryError.Status == http.StatusBadGateway {
+			queryError.Status = http.StatusBadRequest
+		}
+		entry.Error = queryError.Message
+		Audit(c, entry)
+		c.JSON(queryError.Status, queryError)
+		return
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			req.URL.Path = target.Path
+			req.Host = target.Host
+			req.Header.Set("Origin", target.Scheme+"://"+target.Host)
+			// Never leak the session of the UI to the gremlin server.
+			req.Header.Del("Authorization")
+			req.Header.Del("Cookie")
+			if username != "" {
+				req.SetBasicAuth(username, password)
+			}
+		},
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: backend.SkipCertVerify},
+		},
+	}
+	start := time.Now()
+	proxy.ServeHTTP(c.Writer, c.Request)
+	entry.DurationMs = time.Since(start).Milliseconds()
+	if status := c.Writer.Status(); status >= http.StatusBadRequest {
+		entry.Error = fmt.Sprintf("%d %s", status, http.StatusText(status))
+	}
+	Audit(c, entry)
+}
+
+// Returns the script and bindings of the request body. The aliases are added to the body.
+func rewriteHttpRequest(req *http.Request, configAliases map[string]string, readOnly bool) (string, interface{}, error) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var message map[string]interface{}
+	if err := decoder.Decode(&message); err != nil {
+		if readOnly || len(configAliases) > 0 {
+			return "", nil, fmt.Errorf("invalid request body: %v", err)
+		}
+		// Let the gremlin server reply to what it does not understand.
+		return "", nil, nil
+	}
+	script, _ := message["gremlin"].(string)
+	bindings := message["bindings"]
+	if readOnly {
+		scriptBindings, _ := bindings.(map[string]interface{})
+		if err := CheckReadOnly(script, configAliases, scriptBindings); err != nil {
+			return script, bindings, err
+		}
+	}
+	if len(configAliases) == 0 && !readOnly {
+		return script, bindings, nil
+	}
+	aliases, ok := message["aliases"].(map[string]interface{})
+	if !ok || readOnly {
+		aliases = map[string]interface{}{}
+	}
+	for key, value := range configAliases {
+		aliases[key] = value
+	}
+	message["aliases"] = aliases
+	if body, err = json.Marshal(message); err != nil {
+		return "", nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	return script, bindings, nil
+}
@@ -0,0 +1,230 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Status code of the partial responses of the gremlin server.
+const gremlinPartialContent = 206
+
+type pendingRequest struct {
+	entry AuditEntry
+	start time.Time
+}
+
+// Starts the audit entry of a websocket request. Rejected requests are recorded right away.
+func (p *gremlinProxy) trackRequest(data []byte, reply []byte) {
+	if len(data) == 0 || len(data) < 1+int(data[0]) {
+		return
+	}
+	prefix := data[:1+int(data[0])]
+	body := data[len(prefix):]
+
+	entry := AuditEntry{Event: AuditGremlin, Backend: p.backend}
+	if strings.Contains(string(prefix[1:]), "json") {
+		var message struct {
+			RequestID interface{} `json:"requestId"`
+			Op        string      `json:"op"`
+			Args      struct {
+				Gremlin  json.RawMessage `json:"gremlin"`
+				Bindings json.RawMessage `json:"bindings"`
+			} `json:"args"`
+		}
+		if err := json.Unmarshal(body, &message); err != nil || message.Op == "authentication" {
+			return
+		}
+		entry.RequestID = graphsonRequestID(message.RequestID)
+		var script string
+		if err := json.Unmarshal(message.Args.Gremlin, &script); err == nil {
+			entry.Query = script
+		} else {
+			// Bytecode is recorded as graphson.
+			entry.Query = string(message.Args.Gremlin)
+		}
+		if len(message.Args.Bindings) > 0 {
+			entry.Bindings = message.Args.Bindings
+		}
+	} else {
+		requestID, op, script, ok := parseGraphBinaryRequest(body)
+		if !ok || op == "authentication" {
+			return
+		}
+		entry.RequestID = requestID
+		entry.Query = script
+	}
+
+	if reply != nil {
+		if _, message := responseStatus(reply); message != "" {
+			entry.Error = message
+		}
+		Audit(p.c, entry)
+		return
+	}
+	p.pendingMutex.Lock()
+	defer p.pendingMutex.Unlock()
+	p.pending[entry.RequestID] = &pendingRequest{entry: entry, start: time.Now()}
+}
+
+// Counts the results of a response and records the audit entry on the final response.
+func (p *gremlinProxy) trackResponse(data []byte) {
+	requestID, code, message, count := parseResponse(data)
+	if requestID == "" {
+		return
+	}
+	p.pendingMutex.Lock()
+	pending, ok := p.pending[requestID]
+	if ok {
+		pending.entry.ResultCount += count
+		if code != gremlinPartialContent {
+			delete(p.pending, requestID)
+		}
+	}
+	p.pendingMutex.Unlock()
+	if !ok || code == gremlinPartialContent {
+		return
+	}
+	pending.entry.DurationMs = time.Since(pending.start).Milliseconds()
+	if code >= 300 {
+		pending.entry.Error = message
+		if pending.entry.Error == "" {
+			pending.entry.Error = fmt.Sprintf("gremlin server status %d", code)
+		}
+	}
+	Audit(p.c, pending.entry)
+}
+
+// Records the requests without a final response.
+func (p *gremlinProxy) auditPending(reason string) {
+	p.pendingMutex.Lock()
+	defer p.pendingMutex.Unlock()
+	for requestID, pending := range p.pending {
+		pending.entry.DurationMs = time.Since(pending.start).Milliseconds()
+		pending.entry.Error = reason
+		Audit(p.c, pending.entry)
+		delete(p.pending, requestID)
+	}
+}
+
+// Request ids are plain strings or typed g:UUID values.
+func graphsonRequestID(requestID interface{}) string {
+	switch v := requestID.(type) {
+	case string:
+		return v
+	case map[string]interface{}:
+		if id, ok := v["@value"].(string); ok {
+			return id
+		}
+	}
+	return ""
+}
+
+func responseStatus(data []byte) (int, string) {
+	_, code, message, _ := parseResponse(data)
+	return code, message
+}
+
+// Returns the request id, status code, status message and number of results of a graphbinary or graphson response.
+// The results are only counted for graphson.
+func parseResponse(data []byte) (string, int, string, int) {
+	if len(data) >= 22 && data[0] == graphBinaryVersion {
+		// version, nullable flag, request id, status code, nullable status message
+		requestID, err := uuid.FromBytes(data[2:18])
+		if err != nil {
+			return "", 0, "", 0
+		}
+		code := int(int32(binary.BigEndian.Uint32(data[18:22])))
+		message := ""
+		if len(data) >= 27 && data[22] == 0 {
+			length := int(binary.BigEndian.Uint32(data[23:27]))
+			if length >= 0 && len(data) >= 27+length {
+				message = string(data[27 : 27+length])
+			}
+		}
+		return requestID.String(), code, message, 0
+	}
+
+	var response struct {
+		RequestID interface{} `json:"requestId"`
+		Status    struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"status"`
+		Result struct {
+			Data struct {
+				Value []json.RawMessage `json:"@value"`
+			} `json:"data"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(data, &response); err != nil {
+		return "", 0, "", 0
+	}
+	return graphsonRequestID(response.RequestID), response.Status.Code, response.Status.Message, len(response.Result.Data.Value)
+}
+
+// Decodes the request id, the op and the script of a graphbinary request. The script is only found when the args
+// before it are strings, bytecode is not decoded.
+func parseGraphBinaryRequest(body []byte) (string, string, string, bool) {
+	reader := bytes.NewReader(body)
+	version, err := reader.ReadByte()
+	if err != nil || version != graphBinaryVersion {
+		return "", "", "", false
+	}
+	var id [16]byte
+	if _, err := reader.Read(id[:]); err != nil {
+		return "", "", "", false
+	}
+	requestID := uuid.UUID(id).String()
+
+	readString := func() (string, bool) {
+		var length int32
+		if err := binary.Read(reader, binary.BigEndian, &length); err != nil || length < 0 || int(length) > reader.Len() {
+			return "", false
+		}
+		value := make([]byte, length)
+		reader.Read(value)
+		return string(value), true
+	}
+	readQualifiedString := func() (string, bool) {
+		typeCode, err := reader.ReadByte()
+		if err != nil || typeCode != graphBinaryString {
+			return "", false
+		}
+		if nullFlag, err := reader.ReadByte(); err != nil || nullFlag != 0 {
+			return "", false
+		}
+		return readString()
+	}
+
+	op, ok := readString()
+	if !ok {
+		return requestID, "", "", true
+	}
+	if _, ok := readString(); !ok {
+		return requestID, op, "", true
+	}
+	var count int32
+	if err := binary.Read(reader, binary.BigEndian, &count); err != nil {
+		return requestID, op, "", true
+	}
+	for i := int32(0); i < count; i++ {
+		key, ok := readQualifiedString()
+		if !ok {
+			break
+		}
+		value, ok := readQualifiedString()
+		if !ok {
+			break
+		}
+		if key == "gremlin" {
+			return requestID, op, value, true
+		}
+	}
+	return requestID, op, "", true
+}
@@ -0,0 +1,453 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var ErrReadOnly = errors.New("read-only users cannot mutate the graph")
+
+// Not 403, the UI logs the user out on 401 and 403.
+const readOnlyStatus = http.StatusBadRequest
+
+// Steps, predicates and terminal methods of the traversals of readers. None of them mutates the graph, nor runs
+// code of the request.
+var readOnlySteps = stringSet(
+	// sources
+	"V", "E", "inject", "with", "withSideEffect", "withBulk", "withPath", "withSack",
+	// steps
+	"aggregate", "all", "and", "any", "as", "asDate", "asString", "barrier", "both", "bothE", "bothV", "branch", "by",
+	"cap", "choose", "coalesce", "coin", "combine", "concat", "conjoin", "constant", "count", "cyclicPath", "dateAdd",
+	"dateDiff", "dedup", "difference", "disjunct", "element", "elementMap", "emit", "fail", "filter", "flatMap", "fold",
+	"format", "from", "group", "groupCount", "has", "hasId", "hasKey", "hasLabel", "hasNot", "hasValue", "id",
+	"identity", "in", "inE", "inV", "index", "intersect", "is", "key", "label", "length", "limit", "local", "loops",
+	"lTrim", "map", "match", "math", "max", "mean", "min", "none", "not", "option", "optional", "or", "order",
+	"otherV", "out", "outE", "outV", "path", "product", "project", "properties", "propertyMap", "range", "repeat",
+	"replace", "reverse", "rTrim", "sack", "sample", "select", "sideEffect", "simplePath", "skip", "split", "store",
+	"substring", "sum", "tail", "timeLimit", "times", "to", "toLower", "toUpper", "tree", "trim", "unfold", "union",
+	"until", "value", "valueMap", "values", "where",
+	// terminal steps
+	"explain", "hasNext", "iterate", "next", "profile", "toBulkSet", "toList", "toSet", "tryNext",
+	// predicates
+	"between", "containing", "endingWith", "eq", "gt", "gte", "inside", "lt", "lte", "negate", "neq", "notContaining",
+	"notEndingWith", "notRegex", "notStartingWith", "outside", "regex", "startingWith", "within", "without",
+)
+
+// Members of the Gremlin enums, by enum. They can also be used without the enum, e.g. desc or local.
+var readOnlyEnums = map[string]map[string]bool{
+	"T":           stringSet("id", "label", "key", "value"),
+	"Order":       stringSet("asc", "desc", "shuffle", "incr", "decr"),
+	"Scope":       stringSet("local", "global"),
+	"Column":      stringSet("keys", "values"),
+	"Direction":   stringSet("OUT", "IN", "BOTH", "from", "to"),
+	"Pop":         stringSet("first", "last", "all", "mixed"),
+	"Operator":    stringSet("sum", "minus", "mult", "div", "min", "max", "assign", "and", "or", "addAll", "sumLong"),
+	"Pick":        stringSet("any", "none"),
+	"WithOptions": stringSet("tokens", "none", "ids", "labels", "keys", "values", "all", "indexer", "list", "map"),
+}
+
+// Classes whose methods are steps or predicates, e.g. __.out() or P.gt(1).
+var readOnlyClasses = stringSet("__", "P", "TextP")
+
+var readOnlyEnumMembers = func() map[string]bool {
+	members := map[string]bool{}
+	for _, enum := range readOnlyEnums {
+		for member := range enum {
+			members[member] = true
+		}
+	}
+	return members
+}()
+
+func stringSet(values ...string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
+
+func readOnlyError(format string, args ...interface{}) error {
+	return &QueryError{Status: readOnlyStatus, Message: fmt.Sprintf("%v: %s", ErrReadOnly, fmt.Sprintf(format, args...))}
+}
+
+// CheckReadOnly accepts the scripts of readers made only of traversals of the read-only steps: the traversal
+// sources (g and the aliases), anonymous traversals, predicates, enums, literals, lists and the bindings of the
+// request. Everything else is rejected, closures, Groovy methods and classes, operators, assignments and strings with
+// interpolation included, since any of them can run code on the gremlin server.
+func CheckReadOnly(script string, aliases map[string]string, bindings map[string]interface{}) error {
+	// Groovy decodes the unicode escapes before parsing, they could end a comment or a string.
+	if strings.Contains(script, `\u`) {
+		return readOnlyError("unicode escapes are not allowed")
+	}
+	tokens, err := scanScript(script)
+	if err != nil {
+		return err
+	}
+	sources := map[string]bool{"g": true}
+	for name := range aliases {
+		sources[name] = true
+	}
+	parser := &readOnlyParser{tokens: tokens, sources: sources, bindings: bindings}
+	return parser.parseScript()
+}
+
+type scriptTokenKind int
+
+const (
+	tokenIdent scriptTokenKind = iota
+	tokenNumber
+	tokenString
+	tokenPunct
+)
+
+type scriptToken struct {
+	kind scriptTokenKind
+	text string
+	// Whether a new line separates the token from the previous one.
+	newLine bool
+}
+
+// Splits a script into identifiers, numbers, strings and the punctuation of traversals. Comments are skipped.
+func scanScript(script string) ([]scriptToken, error) {
+	var tokens []scriptToken
+	newLine := false
+	for i := 0; i < len(script); {
+		ch := script[i]
+		start := i
+		switch {
+		case ch == '\n':
+			newLine = true
+			i++
+			continue
+		case ch == ' ' || ch == '\t' || ch == '\r':
+			i++
+			continue
+		case strings.HasPrefix(script[i:], "//"):
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				return tokens, nil
+			}
+			i += end
+			continue
+		case strings.HasPrefix(script[i:], "/*"):
+			end := strings.Index(script[i+2:], "*/")
+			if end < 0 {
+				return nil, readOnlyError("unterminated comment")
+			}
+			if strings.Contains(script[i:i+2+end], "\n") {
+				newLine = true
+			}
+			i += end + 4
+			continue
+		case ch == '\'' || ch == '"':
+			quote := script[i : i+1]
+			if strings.HasPrefix(script[i:], strings.Repeat(quote, 3)) {
+				quote = strings.Repeat(quote, 3)
+			}
+			i += len(quote)
+			for {
+				if i >= len(script) {
+					return nil, readOnlyError("unterminated string")
+				}
+				if strings.HasPrefix(script[i:], quote) {
+					i += len(quote)
+					break
+				}
+				// Double quoted strings are GStrings, which evaluate ${...}.
+				if script[i] == '$' && quote[0] == '"' {
+					return nil, readOnlyError("string interpolation is not allowed")
+				}
+				if script[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			tokens = append(tokens, scriptToken{kind: tokenString, text: script[start:i], newLine: newLine})
+		case ch >= '0' && ch <= '9':
+			for i < len(script) && (isDigit(script[i]) || script[i] == '_') {
+				i++
+			}
+			if i+1 < len(script) && script[i] == '.' && isDigit(script[i+1]) {
+				i++
+				for i < len(script) && isDigit(script[i]) {
+					i++
+				}
+			}
+			if i < len(script) && (script[i] == 'e' || script[i] == 'E') {
+				i++
+				if i < len(script) && (script[i] == '+' || script[i] == '-') {
+					i++
+				}
+				for i < len(script) && isDigit(script[i]) {
+					i++
+				}
+			}
+			if i < len(script) && strings.IndexByte("lLiIdDfFgGnN", script[i]) >= 0 {
+				i++
+			}
+			if i < len(script) && isIdentChar(script[i]) {
+				return nil, readOnlyError("invalid number %s", script[start:i+1])
+			}
+			tokens = append(tokens, scriptToken{kind: tokenNumber, text: script[start:i], newLine: newLine})
+		case isIdentChar(ch):
+			for i < len(script) && (isIdentChar(script[i]) || isDigit(script[i])) {
+				i++
+			}
+			tokens = append(tokens, scriptToken{kind: tokenIdent, text: script[start:i], newLine: newLine})
+		case strings.IndexByte(".,()[];:-", ch) >= 0:
+			i++
+			tokens = append(tokens, scriptToken{kind: tokenPunct, text: script[start:i], newLine: newLine})
+		default:
+			return nil, readOnlyError("%q is not allowed", ch)
+		}
+		newLine = false
+	}
+	return tokens, nil
+}
+
+func isDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+func isIdentChar(ch byte) bool {
+	return ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch == '_'
+}
+
+// readOnlyParser checks the tokens of a script against the grammar of the read-only traversals:
+//
+//	script     = statement { (";" | new line) statement }
+//	statement  = expression { "." step arguments }
+//	expression = literal | "-" number | list | step arguments | source | "__" | "P" | "TextP" | enum "." member
+//	             | member | binding
+//	list       = "[" [ expression [ ":" expression ] { "," expression [ ":" expression ] } ] "]"
+//	arguments  = "(" [ statement { "," statement } ] ")"
+type readOnlyParser struct {
+	tokens   []scriptToken
+	pos      int
+	sources  map[string]bool
+	bindings map[string]interface{}
+}
+
+func (p *readOnlyParser) peek() (scriptToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return scriptToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *readOnlyParser) next() (scriptToken, error) {
+	token, ok := p.peek()
+	if !ok {
+		return scriptToken{}, readOnlyError("unexpected end of script")
+	}
+	p.pos++
+	return token, nil
+}
+
+func (p *readOnlyParser) nextIs(text string) bool {
+	token, ok := p.peek()
+	return ok && token.kind == tokenPunct && token.text == text
+}
+
+func (p *readOnlyParser) expect(text string) error {
+	token, err := p.next()
+	if err != nil {
+		return err
+	}
+	if token.kind != tokenPunct || token.text != text {
+		return readOnlyError("expected %s, got %s", text, token.text)
+	}
+	return nil
+}
+
+func (p *readOnlyParser) parseScript() error {
+	separated := true
+	for p.pos < len(p.tokens) {
+		if p.nextIs(";") {
+			p.pos++
+			separated = true
+			continue
+		}
+		// Groovy command expressions, e.g. g.addV 'person', have no parentheses.
+		if token, _ := p.peek(); !separated && !token.newLine {
+			return readOnlyError("unexpected %s", token.text)
+		}
+		if err := p.parseStatement(); err != nil {
+			return err
+		}
+		separated = false
+	}
+	return nil
+}
+
+func (p *readOnlyParser) parseStatement() error {
+	if err := p.parseExpression(); err != nil {
+		return err
+	}
+	for p.nextIs(".") {
+		p.pos++
+		token, err := p.next()
+		if err != nil {
+			return err
+		}
+		if token.kind != tokenIdent {
+			return readOnlyError("dynamic method calls are not allowed")
+		}
+		if err := p.parseStep(token.text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A step and its arguments. Properties without parentheses are Groovy getters, they are not allowed.
+func (p *readOnlyParser) parseStep(name string) error {
+	if !readOnlySteps[name] || !p.nextIs("(") {
+		return readOnlyError("%s is not allowed", name)
+	}
+	return p.parseArguments()
+}
+
+func (p *readOnlyParser) parseArguments() error {
+	if err := p.expect("("); err != nil {
+		return err
+	}
+	if p.nextIs(")") {
+		p.pos++
+		return nil
+	}
+	for {
+		if err := p.parseStatement(); err != nil {
+			return err
+		}
+		if p.nextIs(",") {
+			p.pos++
+			continue
+		}
+		return p.expect(")")
+	}
+}
+
+func (p *readOnlyParser) parseExpression() error {
+	token, err := p.next()
+	if err != nil {
+		return err
+	}
+	switch token.kind {
+	case tokenString, tokenNumber:
+		return nil
+	case tokenPunct:
+		switch token.text {
+		case "-":
+			if number, err := p.next(); err != nil || number.kind != tokenNumber {
+				return readOnlyError("operators are not allowed")
+			}
+			return nil
+		case "[":
+			return p.parseList()
+		}
+		return readOnlyError("unexpected %s", token.text)
+	}
+
+	name := token.text
+	switch {
+	case name == "true" || name == "false" || name == "null":
+		return nil
+	case p.nextIs("("):
+		// A step of an anonymous traversal or a predicate, e.g. out() or gt(1).
+		return p.parseStep(name)
+	case p.sources[name] || readOnlyClasses[name]:
+		return nil
+	case readOnlyEnums[name] != nil:
+		if err := p.expect("."); err != nil {
+			return err
+		}
+		member, err := p.next()
+		if err != nil {
+			return err
+		}
+		if !readOnlyEnums[name][member.text] {
+			return readOnlyError("%s.%s is not allowed", name, member.text)
+		}
+		return nil
+	case readOnlyEnumMembers[name]:
+		return nil
+	}
+	if _, ok := p.bindings[name]; ok {
+		return nil
+	}
+	return readOnlyError("%s is not allowed", name)
+}
+
+func (p *readOnlyParser) parseList() error {
+	if p.nextIs("]") {
+		p.pos++
+		return nil
+	}
+	for {
+		if err := p.parseStatement(); err != nil {
+			return err
+		}
+		if p.nextIs(":") {
+			p.pos++
+			if err := p.parseStatement(); err != nil {
+				return err
+			}
+		}
+		if p.nextIs(",") {
+			p.pos++
+			continue
+		}
+		return p.expect("]")
+	}
+}
+
+// Source instructions of the bytecode of readers, on top of the read-only steps. The strategies cannot be changed,
+// withoutStrategies could remove the ReadOnlyStrategy.
+var readOnlyBytecodeSources = stringSet("V", "E", "inject", "with", "withSideEffect", "withBulk", "withPath", "withSack")
+
+// CheckReadOnlyBytecode accepts graphson bytecode made only of the read-only steps, without lambdas, which run code
+// on the gremlin server whatever the strategies. Nested traversals are checked too.
+func CheckReadOnlyBytecode(value interface{}) error {
+	switch typed := value.(type) {
+	case []interface{}:
+		for _, item := range typed {
+			if err := CheckReadOnlyBytecode(item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		switch typed["@type"] {
+		case "g:Lambda":
+			return readOnlyError("lambdas are not allowed")
+		case "g:Bytecode":
+			bytecode, _ := typed["@value"].(map[string]interface{})
+			for _, part := range []string{"source", "step"} {
+				instructions, _ := bytecode[part].([]interface{})
+				for _, instruction := range instructions {
+					operator, _ := instruction.([]interface{})
+					if len(operator) == 0 {
+						return readOnlyError("invalid bytecode")
+					}
+					name, _ := operator[0].(string)
+					if part == "source" && !readOnlyBytecodeSources[name] || part == "step" && !readOnlySteps[name] {
+						return readOnlyError("%s is not allowed", name)
+					}
+					if err := CheckReadOnlyBytecode(operator[1:]); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+		for _, item := range typed {
+			if err := CheckReadOnlyBytecode(item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,362 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Bindings of the generated scripts, as CheckReadOnly gets them.
+func scriptBindings(bindings map[string]json.RawMessage) map[string]interface{} {
+	result := make(map[string]interface{}, len(bindings))
+	for name, value := range bindings {
+		result[name] = value
+	}
+	return result
+}
+
+type readOnlyScript struct {
+	name     string
+	script   string
+	bindings map[string]interface{}
+}
+
+// The scripts of the expand, paths, profile and schema endpoints, which readers run.
+func generatedScripts(t *testing.T) []readOnlyScript {
+	config := &Config{}
+	config.Expand.MaxHops = 3
+	config.Expand.MaxResults = 500
+	config.Paths.MaxDepth = 6
+	config.Paths.MaxPaths = 10
+	var scripts []readOnlyScript
+
+	for _, req := range []ExpandRequest{
+		{IDs: []json.RawMessage{json.RawMessage(`1`)}},
+		{
+			IDs:        []json.RawMessage{json.RawMessage(`"a"`)},
+			Direction:  "both",
+			EdgeLabels: []string{"knows"},
+			Hops:       2,
+			Limit:      10,
+			Filters:    []ExpandFilter{{Prop: "weight", Op: "gte", Value: json.RawMessage(`0.5`)}, {Prop: "since", Op: "neq", Value: json.RawMessage(`2000`)}},
+		},
+	} {
+		script, bindings, err := req.script(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scripts = append(scripts, readOnlyScript{"expand " + req.Direction, script, scriptBindings(bindings)})
+	}
+
+	for _, req := range []PathsRequest{
+		{Source: json.RawMessage(`1`), Target: json.RawMessage(`2`)},
+		{Source: json.RawMessage(`1`), Target: json.RawMessage(`2`), Direction: "in", EdgeLabels: []string{"knows"}, K: 3},
+	} {
+		script, bindings, err := req.script(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scripts = append(scripts, readOnlyScript{"paths " + req.Direction, script, scriptBindings(bindings)})
+	}
+
+	for _, step := range []string{"profile", "explain"} {
+		script, err := wrapTraversal("g.V().has('person', 'name', 'marko').out('knows').toList()", step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scripts = append(scripts, readOnlyScript{step, script, nil})
+	}
+
+	schemaBindings := map[string]interface{}{"schemaLabel": json.RawMessage(`"person"`), "schemaSampleSize": json.RawMessage(`100`)}
+	for _, query := range []string{schemaVertexCountsQuery, schemaEdgeCountsQuery} {
+		scripts = append(scripts, readOnlyScript{"schema counts", query, nil})
+	}
+	for _, query := range []string{schemaVertexSampleQuery, schemaEdgeSampleQuery} {
+		scripts = append(scripts, readOnlyScript{"schema sample", query, schemaBindings})
+	}
+	return scripts
+}
+
+func TestCheckReadOnlyAccepted(t *testing.T) {
+	aliases := map[string]string{"g2": "g_readonly"}
+	tests := []readOnlyScript{
+		{"steps", "g.V().has('person', 'name', 'marko').out('knows').values('age').toList()", nil},
+		{"predicates", "g.V().has('age', gt(30)).has('name', within('marko', 'josh')).has('lang', TextP.startingWith('ja'))", nil},
+		{"enums", "g.V().order().by('age', desc).by(T.id, Order.asc).limit(2).valueMap().with(WithOptions.tokens)", nil},
+		{"anonymous traversals", "g.V().local(__.out().limit(2)).choose(has('age'), values('age'), constant(0))", nil},
+		{"group by label", "g.V().group().by(label).by(count())", nil},
+		{"literals", "g.inject(1, -2, 3L, 1.5d, 1e3, true, null, 'a', \"b\", '''c''', ['x': 1, 'y': [1, 2]])", nil},
+		{"escaped dollar", `g.V().has('name', "a\$b")`, nil},
+		{"single quoted dollar", "g.V().has('name', '${x}')", nil},
+		{"statements", "g.V().count();g.E().count()\ng.V().limit(1)", nil},
+		{"comments", "// vertices\ng.V() /* all */ .count()", nil},
+		{"multi line traversal", "g.V()\n  .out()\n  .count()", nil},
+		{"alias", "g2.V().count()", nil},
+		{"bindings", "g.V(ids).has('age', gt(minAge))", map[string]interface{}{"ids": 1, "minAge": 30}},
+	}
+	tests = append(tests, generatedScripts(t)...)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := CheckReadOnly(test.script, aliases, test.bindings); err != nil {
+				t.Errorf("%s rejected: %v", test.script, err)
+			}
+		})
+	}
+}
+
+func TestCheckReadOnlyRejected(t *testing.T) {
+	for _, test := range []readOnlyScript{
+		{"addV", "g.addV('person')", nil},
+		{"drop", "g.V().drop()", nil},
+		{"property", "g.V().property('name', 'x')", nil},
+		{"nested mutation", "g.V().sideEffect(addE('knows').to(V(1)))", nil},
+		{"mutation after new line", "g.V().has('a', 'b')\n.drop()", nil},
+		{"closure", "g.V().filter{ it.get() }", nil},
+		{"lambda", "g.V().map(Lambda.function('it.get()'))", nil},
+		{"unicode escape", `g.V().has('name', '\u0027).drop()//')`, nil},
+		{"GString", `g.V().has('name', "${System.exit(0)}")`, nil},
+		{"GString variable", `g.V().has('name', "$x")`, nil},
+		{"assignment", "x = g.V().next()", nil},
+		{"operator", "g.V().count() + 1", nil},
+		{"negated binding", "g.V().limit(-x)", map[string]interface{}{"x": 1}},
+		{"Groovy class", "System.exit(0)", nil},
+		{"constructor", "new File('/etc/passwd').text", nil},
+		{"getter", "g.V().next().id", nil},
+		{"Groovy method", "g.V().next().getClass()", nil},
+		{"dynamic method", "g.V().'drop'()", nil},
+		{"command expression", "g.V().values 'name'", nil},
+		{"statements without separator", "g.V().count() g.E().count()", nil},
+		{"strategies", "g.withoutStrategies(ReadOnlyStrategy).V().drop()", nil},
+		{"other source", "graph.traversal().V()", nil},
+		{"unknown alias", "g3.V()", nil},
+		{"unknown binding", "g.V(vertexIds)", nil},
+		{"enum class", "T.class", nil},
+		{"unknown enum member", "g.V().order().by('a', Order.foo)", nil},
+		{"unterminated string", "g.V().has('name', 'marko)", nil},
+		{"unterminated comment", "g.V() /* count", nil},
+		{"invalid number", "g.V(1x)", nil},
+		{"unclosed arguments", "g.V(", nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := CheckReadOnly(test.script, map[string]string{"g2": "g_readonly"}, test.bindings)
+			if err == nil {
+				t.Fatalf("%s accepted", test.script)
+			}
+			if !strings.Contains(err.Error(), ErrReadOnly.Error()) {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+}
+
+// Returns graphson bytecode with the instructions, e.g. [["V"], ["out", "knows"]].
+func bytecode(source []interface{}, steps []interface{}) map[string]interface{} {
+	return map[string]interface{}{"@type": "g:Bytecode", "@value": map[string]interface{}{"source": source, "step": steps}}
+}
+
+func TestCheckReadOnlyBytecode(t *testing.T) {
+	lambda := map[string]interface{}{"@type": "g:Lambda", "@value": map[string]interface{}{"script": "it.get()", "language": "gremlin-groovy", "arguments": 1}}
+	for _, test := range []struct {
+		name     string
+		bytecode interface{}
+		ok       bool
+	}{
+		{"steps", bytecode(nil, []interface{}{[]interface{}{"V"}, []interface{}{"out", "knows"}, []interface{}{"count"}}), true},
+		{"nested traversal", bytecode(nil, []interface{}{[]interface{}{"V"}, []interface{}{"local", bytecode(nil, []interface{}{[]interface{}{"out"}})}}), true},
+		{"sources", bytecode([]interface{}{[]interface{}{"withSideEffect", "a", 1}}, []interface{}{[]interface{}{"V"}}), true},
+		{"drop", bytecode(nil, []interface{}{[]interface{}{"V"}, []interface{}{"drop"}}), false},
+		{"nested mutation", bytecode(nil, []interface{}{[]interface{}{"V"}, []interface{}{"sideEffect", bytecode(nil, []interface{}{[]interface{}{"addV", "x"}})}}), false},
+		{"lambda", bytecode(nil, []interface{}{[]interface{}{"V"}, []interface{}{"map", lambda}}), false},
+		{"withoutStrategies", bytecode([]interface{}{[]interface{}{"withoutStrategies", "ReadOnlyStrategy"}}, []interface{}{[]interface{}{"V"}}), false},
+		{"withStrategies", bytecode([]interface{}{[]interface{}{"withStrategies", "x"}}, []interface{}{[]interface{}{"V"}}), false},
+		{"empty instruction", bytecode(nil, []interface{}{[]interface{}{}}), false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := CheckReadOnlyBytecode(test.bytecode); (err == nil) != test.ok {
+				t.Errorf("error %v, expected accepted %v", err, test.ok)
+			}
+		})
+	}
+}
+
+// A websocket request, prefixed by the length of the mime type and the mime type.
+func proxyFrame(mimeType string, body string) []byte {
+	return append(append([]byte{byte(len(mimeType))}, mimeType...), body...)
+}
+
+func graphsonRequest(t *testing.T, op string, args interface{}) []byte {
+	body, err := json.Marshal(map[string]interface{}{"requestId": "6457ad8d-0ac0-4d3f-9fb7-8c8d1d8dd1a7", "op": op, "processor": "", "args": args})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proxyFrame(graphsonMimeType, string(body))
+}
+
+// Returns the status code of a graphson response.
+func graphsonStatus(t *testing.T, response []byte) int {
+	var decoded struct {
+		Status struct {
+			Code int `json:"code"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal(response, &decoded); err != nil {
+		t.Fatalf("invalid response %q: %v", response, err)
+	}
+	return decoded.Status.Code
+}
+
+// Returns the args of a forwarded graphson request.
+func forwardedArgs(t *testing.T, forward []byte) map[string]interface{} {
+	var message struct {
+		Args map[string]interface{} `json:"args"`
+	}
+	if err := json.Unmarshal(forward[1+int(forward[0]):], &message); err != nil {
+		t.Fatalf("invalid forwarded request %q: %v", forward, err)
+	}
+	return message.Args
+}
+
+func TestRewriteRequestReadOnly(t *testing.T) {
+	p := &gremlinProxy{readOnly: true, aliases: map[string]string{"g": "g_readonly"}}
+
+	t.Run("eval", func(t *testing.T) {
+		forward, reply := p.rewriteRequest(graphsonRequest(t, "eval", map[string]interface{}{
+			"gremlin": "g.V().count()",
+			"aliases": map[string]interface{}{"g": "g_writable", "w": "g_writable"},
+		}))
+		if forward == nil || reply != nil {
+			t.Fatalf("read-only script rejected: %s", reply)
+		}
+		aliases, _ := forwardedArgs(t, forward)["aliases"].(map[string]interface{})
+		if len(aliases) != 1 || aliases["g"] != "g_readonly" {
+			t.Errorf("aliases %v, expected only the read-only aliases", aliases)
+		}
+	})
+
+	t.Run("bytecode", func(t *testing.T) {
+		forward, reply := p.rewriteRequest(graphsonRequest(t, "bytecode", map[string]interface{}{
+			"gremlin": bytecode(nil, []interface{}{[]interface{}{"V"}, []interface{}{"count"}}),
+		}))
+		if forward == nil || reply != nil {
+			t.Fatalf("read-only bytecode rejected: %s", reply)
+		}
+		gremlin, _ := forwardedArgs(t, forward)["gremlin"].(map[string]interface{})
+		value, _ := gremlin["@value"].(map[string]interface{})
+		if source, _ := value["source"].([]interface{}); !strings.Contains(mustJSON(t, source), "g:ReadOnlyStrategy") {
+			t.Errorf("source %v, expected the ReadOnlyStrategy", source)
+		}
+	})
+
+	for _, test := range []struct {
+		name   string
+		frame  []byte
+		status int
+	}{
+		{"mutation", graphsonRequest(t, "eval", map[string]interface{}{"gremlin": "g.V().drop()"}), gremlinUnauthorized},
+		{"lambda bytecode", graphsonRequest(t, "bytecode", map[string]interface{}{
+			"gremlin": bytecode(nil, []interface{}{[]interface{}{"V"}, []interface{}{"map", map[string]interface{}{"@type": "g:Lambda", "@value": map[string]interface{}{"script": "it"}}}}),
+		}), gremlinUnauthorized},
+		{"invalid bytecode", graphsonRequest(t, "bytecode", map[string]interface{}{"gremlin": "g.V().drop()"}), gremlinMalformedRequest},
+		{"other op", graphsonRequest(t, "close", map[string]interface{}{"gremlin": "g.V().drop()"}), gremlinUnauthorized},
+		{"args not a map", graphsonRequest(t, "eval", []interface{}{"g.V().drop()"}), gremlinMalformedRequest},
+		{"missing args", graphsonRequest(t, "eval", nil), gremlinMalformedRequest},
+		{"malformed JSON", proxyFrame(graphsonMimeType, `{"op": "eval", "args": {"gremlin": "g.V().drop()"`), gremlinMalformedRequest},
+		{"frame shorter than its mime type", append([]byte{byte(len(graphsonMimeType))}, "application"...), gremlinMalformedRequest},
+		{"empty frame", []byte{}, gremlinMalformedRequest},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			forward, reply := p.rewriteRequest(test.frame)
+			if forward != nil {
+				t.Fatalf("request forwarded: %q", forward)
+			}
+			if status := graphsonStatus(t, reply); status != test.status {
+				t.Errorf("status %d, expected %d", status, test.status)
+			}
+		})
+	}
+
+	for _, test := range []struct {
+		name  string
+		frame []byte
+	}{
+		{"graphbinary", proxyFrame(graphBinaryMimeType, "\x81\x64\x57\xad\x8d\x0a\xc0\x4d\x3f\x9f\xb7\x8c\x8d\x1d\x8d\xd1\xa7rest of the request")},
+		{"short graphbinary", proxyFrame(graphBinaryMimeType, "\x81\x64")},
+		{"short non JSON", proxyFrame("text/plain", "g.V().drop()")},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			forward, reply := p.rewriteRequest(test.frame)
+			if forward != nil {
+				t.Fatalf("request forwarded: %q", forward)
+			}
+			if len(reply) == 0 || reply[0] != graphBinaryVersion {
+				t.Errorf("reply %q, expected a graphbinary error", reply)
+			}
+		})
+	}
+}
+
+func TestRewriteRequest(t *testing.T) {
+	p := &gremlinProxy{aliases: map[string]string{"g": "g_main"}, username: "alice"}
+
+	malformed := proxyFrame(graphsonMimeType, `{"op": "eval"`)
+	if forward, reply := p.rewriteRequest(malformed); !bytes.Equal(forward, malformed) || reply != nil {
+		t.Errorf("malformed request of a writer not forwarded as is: %q, %q", forward, reply)
+	}
+	binary := proxyFrame(graphBinaryMimeType, "\x81")
+	if forward, reply := p.rewriteRequest(binary); !bytes.Equal(forward, binary) || reply != nil {
+		t.Errorf("graphbinary request of a writer not forwarded as is: %q, %q", forward, reply)
+	}
+	// The proxy answers the challenges of the gremlin server itself.
+	if forward, reply := p.rewriteRequest(graphsonRequest(t, "authentication", map[string]interface{}{"sasl": "x"})); forward != nil || reply != nil {
+		t.Errorf("authentication of the client forwarded: %q, %q", forward, reply)
+	}
+	forward, _ := p.rewriteRequest(graphsonRequest(t, "eval", map[string]interface{}{"gremlin": "g.V().drop()", "aliases": map[string]interface{}{"h": "g_other"}}))
+	aliases, _ := forwardedArgs(t, forward)["aliases"].(map[string]interface{})
+	if aliases["g"] != "g_main" || aliases["h"] != "g_other" {
+		t.Errorf("aliases %v, expected the configured aliases added to the aliases of the request", aliases)
+	}
+}
+
+func TestRewriteHttpRequestReadOnly(t *testing.T) {
+	aliases := map[string]string{"g": "g_readonly"}
+	for _, test := range []struct {
+		name string
+		body string
+		ok   bool
+	}{
+		{"read-only", `{"gremlin": "g.V().count()", "aliases": {"g": "g_writable"}}`, true},
+		{"mutation", `{"gremlin": "g.V().drop()"}`, false},
+		{"malformed", `{"gremlin": "g.V().drop()"`, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/gremlin", strings.NewReader(test.body))
+			_, _, err := rewriteHttpRequest(req, aliases, true)
+			if (err == nil) != test.ok {
+				t.Fatalf("error %v, expected accepted %v", err, test.ok)
+			}
+			if !test.ok {
+				return
+			}
+			var message struct {
+				Aliases map[string]string `json:"aliases"`
+			}
+			if err := json.NewDecoder(req.Body).Decode(&message); err != nil {
+				t.Fatal(err)
+			}
+			if len(message.Aliases) != 1 || message.Aliases["g"] != "g_readonly" {
+				t.Errorf("aliases %v, expected only the read-only aliases", message.Aliases)
+			}
+		})
+	}
+}
+
+func mustJSON(t *testing.T, value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
@@ -0,0 +1,93 @@
+package lib
+
+import (
+	"os"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ConfigWatcher holds the current config. When there is a config file, the file is polled and the fields which are
+// safe to change at runtime are reloaded, see reload. Other changes need a restart.
+type ConfigWatcher struct {
+	current atomic.Pointer[Config]
+	modTime time.Time
+	size    int64
+}
+
+// WatchConfig starts polling the config file of conf, if any.
+func WatchConfig(conf *Config) *ConfigWatcher {
+	w := &ConfigWatcher{}
+	w.current.Store(conf)
+	if conf.ConfigFile == "" || conf.ConfigReloadInterval == 0 {
+		return w
+	}
+	if info, err := os.Stat(conf.ConfigFile); err == nil {
+		w.modTime, w.size = info.ModTime(), info.Size()
+	}
+	go func() {
+		ticker := time.NewTicker(conf.ConfigReloadInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			w.poll(conf.ConfigFile)
+		}
+	}()
+	return w
+}
+
+// Current returns the latest config. The returned config is never modified, requests should use the same config
+// from start to end.
+func (w *ConfigWatcher) Current() *Config {
+	return w.current.Load()
+}
+
+func (w *ConfigWatcher) poll(path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		logrus.Warnf("unable to check config file: %v", err)
+		return
+	}
+	if info.ModTime().Equal(w.modTime) && info.Size() == w.size {
+		return
+	}
+	w.modTime, w.size = info.ModTime(), info.Size()
+	w.reload()
+}
+
+func (w *ConfigWatcher) reload() {
+	loaded, err := loadConfig()
+	if err != nil {
+		logrus.Errorf("config reload failed, keeping the current config: %v", err)
+		return
+	}
+
+	next := *w.Current()
+	// The aliases and the backends are looked up per request.
+	next.GremlinServer.Aliases = loaded.GremlinServer.Aliases
+	next.GremlinServer.ReadOnlyAliases = loaded.GremlinServer.ReadOnlyAliases
+	next.Backends = loaded.Backends
+	// The prefetch sizes and the limits apply to the next submitted queries.
+	next.Prefetch = loaded.Prefetch
+	next.Limits = loaded.Limits
+	// The login lockout applies to the next failed logins, the counters are kept.
+	next.Lockout = loaded.Lockout
+	// The schema sampling applies to the next schema refresh.
+	next.Schema = loaded.Schema
+	// The expansion and path search bounds, and the export limits, apply to the next requests.
+	next.Expand = loaded.Expand
+	next.Paths = loaded.Paths
+	next.Export = loaded.Export
+	// The customization is served with the next ui config request.
+	next.Customization = loaded.Customization
+	if err := next.validate(); err != nil {
+		logrus.Errorf("config reload failed, keeping the current config: %v", err)
+		return
+	}
+	if !reflect.DeepEqual(&next, loaded) {
+		logrus.Warn("config file has changes which are only applied after a restart")
+	}
+	w.current.Store(&next)
+	logrus.Info("config reloaded")
+}
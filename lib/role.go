@@ -0,0 +1,62 @@
+package lib
+
+import (
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+)
+
+// User roles, carried in the "role" claim of the JWT.
+const (
+	RoleAdmin = "admin"
+	// Readers can only run queries which do not mutate the graph.
+	RoleReader = "reader"
+)
+
+func validRole(role string) bool {
+	return role == RoleAdmin || role == RoleReader
+}
+
+// Returns the role of a user logging in.
+func loginRole(config *Config, username string) string {
+	if !config.Authentication.GremlinAuth {
+		return config.Authentication.Admin.Role
+	}
+	if role, ok := config.Authentication.UserRoles[username]; ok {
+		return role
+	}
+	return config.Authentication.DefaultRole
+}
+
+// Returns the current role of a logged in user, which may have changed since the login: the role of USER_ROLES with
+// USE_GREMLIN_AUTH, of the users file, or of the admin user. Disabled users and users removed from the users file
+// are rejected. OIDC users keep the role of their login.
+func currentUserRole(c *gin.Context, config *Config, username string, role string) (string, error) {
+	if reservedUsername(username) {
+		return role, nil
+	}
+	if config.Authentication.GremlinAuth {
+		return loginRole(config, username), nil
+	}
+	if v, exists := c.Get("users"); exists {
+		user, ok := v.(*UserStore).User(username)
+		if !ok {
+			return "", ErrUserNotFound
+		}
+		if user.Disabled {
+			return "", ErrUserDisabled
+		}
+		return user.Role, nil
+	}
+	if username != config.Authentication.Admin.Username {
+		return "", ErrUserNotFound
+	}
+	return config.Authentication.Admin.Role, nil
+}
+
+// CurrentRole returns the role claim of the logged in user. Tokens without a role are readers.
+func CurrentRole(c *gin.Context) string {
+	if role, ok := jwt.ExtractClaims(c)["role"].(string); ok && validRole(role) {
+		return role
+	}
+	return RoleReader
+}
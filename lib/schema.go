@@ -0,0 +1,477 @@
+package lib
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SchemaConfig controls the schema computed by sampling the backends.
+type SchemaConfig struct {
+	// How long a schema is served from the cache. Zero computes it on every request.
+	CacheTTL time.Duration `yaml:"cacheTTL" default:"10m"`
+	// Number of elements of every label sampled for the property keys and the edge connections.
+	SampleSize int `yaml:"sampleSize" default:"100"`
+}
+
+// Sources of a Schema.
+const (
+	// Sampled with gremlin queries.
+	SchemaSourceSample = "sample"
+	// Read from the PuppyGraph schema of the backend.
+	SchemaSourcePuppyGraph = "puppygraph"
+)
+
+// SchemaProperty is a property key with the types of its values.
+type SchemaProperty struct {
+	Name string `json:"name"`
+	// GraphSON type names like String, Int32 or Date. PuppyGraph types like Int or Double for a PuppyGraph schema.
+	Types []string `json:"types"`
+}
+
+// SchemaLabel is a vertex or edge label with its property keys.
+type SchemaLabel struct {
+	Label string `json:"label"`
+	// Number of elements, unknown for a PuppyGraph schema.
+	Count      *int64           `json:"count,omitempty"`
+	Properties []SchemaProperty `json:"properties"`
+}
+
+// SchemaConnection is an edge label between two vertex labels.
+type SchemaConnection struct {
+	OutLabel  string `json:"outLabel"`
+	EdgeLabel string `json:"edgeLabel"`
+	InLabel   string `json:"inLabel"`
+}
+
+// Schema of a backend. The property keys and connections of a sampled schema only cover the sampled elements.
+type Schema struct {
+	Backend      string             `json:"backend"`
+	Source       string             `json:"source"`
+	VertexLabels []SchemaLabel      `json:"vertexLabels"`
+	EdgeLabels   []SchemaLabel      `json:"edgeLabels"`
+	PropertyKeys []SchemaProperty   `json:"propertyKeys"`
+	Connections  []SchemaConnection `json:"connections"`
+	Updated      time.Time          `json:"updated"`
+}
+
+// Schemas by backend name and gremlin user, since the users of a backend with BackendAuthUser may not see the same
+// graph. Concurrent requests for a schema wait for the same computation.
+type schemaCache struct {
+	mutex   sync.Mutex
+	entries map[schemaCacheKey]*schemaCacheEntry
+}
+
+type schemaCacheKey struct {
+	backend string
+	// Gremlin username of the requests, empty when the backend has no per user credentials.
+	username string
+}
+
+type schemaCacheEntry struct {
+	mutex  sync.Mutex
+	schema *Schema
+	// The running computation, nil when there is none.
+	flight *schemaFlight
+}
+
+type schemaFlight struct {
+	// Closed when schema and err are set.
+	done   chan struct{}
+	schema *Schema
+	err    error
+}
+
+var schemas = &schemaCache{entries: map[schemaCacheKey]*schemaCacheEntry{}}
+
+func (s *schemaCache) entry(key schemaCacheKey) *schemaCacheEntry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry, ok := s.entries[key]
+	if !ok {
+		entry = &schemaCacheEntry{}
+		s.entries[key] = entry
+	}
+	return entry
+}
+
+// Bounds the computation of a schema, which is not cancelled with the request which started it.
+const schemaTimeout = 5 * time.Minute
+
+// GetSchema returns the cached schema of the backend, or computes it when it is older than SchemaConfig.CacheTTL or
+// refresh is set. The schema is read from Backend.Schema when set, sampled with gremlin queries otherwise. The
+// computation runs in the background, so that it still completes for the other requests waiting for it when the
+// request which started it is cancelled.
+func GetSchema(c *gin.Context, config *Config, backend *Backend, refresh bool) (*Schema, error) {
+	username, _, err := gremlinCredentials(c, config, backend)
+	if err != nil {
+		return nil, err
+	}
+	entry := schemas.entry(schemaCacheKey{backend: backend.Name, username: username})
+	entry.mutex.Lock()
+	if !refresh && entry.flight == nil && entry.schema != nil && time.Since(entry.schema.Updated) < config.Schema.CacheTTL {
+		schema := entry.schema
+		entry.mutex.Unlock()
+		return schema, nil
+	}
+	flight := entry.flight
+	if flight == nil {
+		flight = &schemaFlight{done: make(chan struct{})}
+		entry.flight = flight
+		detached, cancel := detachedContext(c, schemaTimeout)
+		go func() {
+			defer cancel()
+			entry.compute(detached, config, backend, flight)
+		}()
+	}
+	entry.mutex.Unlock()
+
+	select {
+	case <-flight.done:
+		return flight.schema, flight.err
+	case <-c.Request.Context().Done():
+		return nil, ErrQueryCancelled
+	}
+}
+
+// Returns a copy of the request context for the work which outlives the request, with its own deadline.
+func detachedContext(c *gin.Context, timeout time.Duration) (*gin.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	detached := c.Copy()
+	detached.Request = c.Request.WithContext(ctx)
+	return detached, cancel
+}
+
+func (entry *schemaCacheEntry) compute(c *gin.Context, config *Config, backend *Backend, flight *schemaFlight) {
+	var schema *Schema
+	var err error
+	if backend.Schema != "" {
+		schema, err = readPuppyGraphSchema(c, config, backend)
+	} else {
+		schema, err = sampleSchema(c, config, backend)
+	}
+	if err == nil {
+		schema.Backend = backend.Name
+		schema.Updated = time.Now()
+	}
+
+	entry.mutex.Lock()
+	if err == nil {
+		entry.schema = schema
+	}
+	entry.flight = nil
+	entry.mutex.Unlock()
+	flight.schema, flight.err = schema, err
+	close(flight.done)
+}
+
+// Collects the labels, property types and connections of a schema.
+type schemaBuilder struct {
+	counts      map[string]map[string]*int64
+	properties  map[string]map[string]map[string]map[string]bool
+	connections map[SchemaConnection]bool
+}
+
+func newSchemaBuilder() *schemaBuilder {
+	return &schemaBuilder{
+		counts:      map[string]map[string]*int64{ElementVertex: {}, ElementEdge: {}},
+		properties:  map[string]map[string]map[string]map[string]bool{ElementVertex: {}, ElementEdge: {}},
+		connections: map[SchemaConnection]bool{},
+	}
+}
+
+func (b *schemaBuilder) addLabel(kind string, label string, count *int64) {
+	b.counts[kind][label] = count
+	if b.properties[kind][label] == nil {
+		b.properties[kind][label] = map[string]map[string]bool{}
+	}
+}
+
+func (b *schemaBuilder) addProperty(kind string, label string, name string, typ string) {
+	if _, ok := b.counts[kind][label]; !ok {
+		b.addLabel(kind, label, nil)
+	}
+	types := b.properties[kind][label][name]
+	if types == nil {
+		types = map[string]bool{}
+		b.properties[kind][label][name] = types
+	}
+	if typ != "" {
+		types[typ] = true
+	}
+}
+
+func (b *schemaBuilder) build() *Schema {
+	schema := &Schema{Connections: []SchemaConnection{}}
+	keys := map[string]map[string]bool{}
+	labels := func(kind string) []SchemaLabel {
+		result := []SchemaLabel{}
+		for _, label := range sortedKeys(b.counts[kind]) {
+			properties := []SchemaProperty{}
+			for _, name := range sortedKeys(b.properties[kind][label]) {
+				types := b.properties[kind][label][name]
+				properties = append(properties, SchemaProperty{Name: name, Types: sortedKeys(types)})
+				if keys[name] == nil {
+					keys[name] = map[string]bool{}
+				}
+				for typ := range types {
+					keys[name][typ] = true
+				}
+			}
+			result = append(result, SchemaLabel{Label: label, Count: b.counts[kind][label], Properties: properties})
+		}
+		return result
+	}
+	schema.VertexLabels = labels(ElementVertex)
+	schema.EdgeLabels = labels(ElementEdge)
+	schema.PropertyKeys = []SchemaProperty{}
+	for _, name := range sortedKeys(keys) {
+		schema.PropertyKeys = append(schema.PropertyKeys, SchemaProperty{Name: name, Types: sortedKeys(keys[name])})
+	}
+	for connection := range b.connections {
+		schema.Connections = append(schema.Connections, connection)
+	}
+	sort.Slice(schema.Connections, func(i, j int) bool {
+		a, b := schema.Connections[i], schema.Connections[j]
+		if a.OutLabel != b.OutLabel {
+			return a.OutLabel < b.OutLabel
+		}
+		if a.EdgeLabel != b.EdgeLabel {
+			return a.EdgeLabel < b.EdgeLabel
+		}
+		return a.InLabel < b.InLabel
+	})
+	return schema
+}
+
+// Queries of a sampled schema, the label and the sample size are bindings.
+const (
+	schemaVertexCountsQuery = "g.V().groupCount().by(label)"
+	schemaEdgeCountsQuery   = "g.E().groupCount().by(label)"
+	schemaVertexSampleQuery = "g.V().hasLabel(schemaLabel).limit(schemaSampleSize).elementMap()"
+	schemaEdgeSampleQuery   = "g.E().hasLabel(schemaLabel).limit(schemaSampleSize).elementMap()"
+)
+
+// Counts the elements by label, then samples the elementMap() of every label.
+func sampleSchema(c *gin.Context, config *Config, backend *Backend) (*Schema, error) {
+	builder := newSchemaBuilder()
+	sampleSize, err := typed("g:Int64", config.Schema.SampleSize)
+	if err != nil {
+		return nil, err
+	}
+	for _, kind := range []string{ElementVertex, ElementEdge} {
+		countsQuery, sampleQuery := schemaVertexCountsQuery, schemaVertexSampleQuery
+		if kind == ElementEdge {
+			countsQuery, sampleQuery = schemaEdgeCountsQuery, schemaEdgeSampleQuery
+		}
+		response, err := Submit(c, config, QueryRequest{Query: countsQuery, Backend: backend.Name})
+		if err != nil {
+			return nil, err
+		}
+		for _, raw := range response.Value {
+			value, err := DecodeGraphSON(raw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid label counts: %v", err)
+			}
+			counts, _ := value.(map[string]interface{})
+			for label, count := range counts {
+				number, _ := count.(json.Number)
+				n, err := number.Int64()
+				if err != nil {
+					return nil, fmt.Errorf("invalid count of label %q: %v", label, count)
+				}
+				builder.addLabel(kind, label, &n)
+			}
+		}
+
+		for _, label := range sortedKeys(builder.counts[kind]) {
+			labelBinding, _ := json.Marshal(label)
+			response, err := Submit(c, config, QueryRequest{
+				Query:    sampleQuery,
+				Backend:  backend.Name,
+				Bindings: map[string]interface{}{"schemaLabel": json.RawMessage(labelBinding), "schemaSampleSize": sampleSize},
+			})
+			if err != nil {
+				return nil, err
+			}
+			for _, raw := range response.Value {
+				if err := builder.addSample(kind, label, raw); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	schema := builder.build()
+	schema.Source = SchemaSourceSample
+	return schema, nil
+}
+
+// Adds the property types of an elementMap(), and the connection of an edge.
+func (b *schemaBuilder) addSample(kind string, label string, raw json.RawMessage) error {
+	value, err := DecodeGraphSON(raw)
+	if err != nil {
+		return fmt.Errorf("invalid sample of label %q: %v", label, err)
+	}
+	element, ok := value.(*GraphElement)
+	if !ok {
+		return nil
+	}
+	if kind == ElementEdge && element.OutVLabel != "" && element.InVLabel != "" {
+		b.connections[SchemaConnection{OutLabel: element.OutVLabel, EdgeLabel: label, InLabel: element.InVLabel}] = true
+	}
+	types, err := elementMapTypes(raw)
+	if err != nil {
+		return err
+	}
+	for name := range element.Properties {
+		b.addProperty(kind, label, name, types[name])
+	}
+	return nil
+}
+
+// Returns the GraphSON type names of the properties of an elementMap(), like Int32 for g:Int32.
+func elementMapTypes(raw json.RawMessage) (map[string]string, error) {
+	var value struct {
+		Entries []json.RawMessage `json:"@value"`
+	}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, err
+	}
+	types := map[string]string{}
+	for i := 0; i+1 < len(value.Entries); i += 2 {
+		var key string
+		if err := json.Unmarshal(value.Entries[i], &key); err != nil {
+			// g:T and g:Direction keys.
+			continue
+		}
+		types[key] = graphsonTypeName(value.Entries[i+1])
+	}
+	return types, nil
+}
+
+func graphsonTypeName(raw json.RawMessage) string {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return ""
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if typeName, ok := v["@type"].(string); ok {
+			// g:Int32, gx:Byte
+			if _, name, ok := strings.Cut(typeName, ":"); ok {
+				return name
+			}
+			return typeName
+		}
+		return "Map"
+	case string:
+		return "String"
+	case bool:
+		return "Boolean"
+	case float64:
+		return "Double"
+	case []interface{}:
+		return "List"
+	default:
+		return ""
+	}
+}
+
+// The schema format of PuppyGraph, only the labels and attributes are read.
+type puppyGraphSchema struct {
+	Vertices []struct {
+		Label      string                `json:"label"`
+		Attributes []puppyGraphAttribute `json:"attributes"`
+	} `json:"vertices"`
+	Edges []struct {
+		Label      string                `json:"label"`
+		From       string                `json:"from"`
+		To         string                `json:"to"`
+		Attributes []puppyGraphAttribute `json:"attributes"`
+	} `json:"edges"`
+}
+
+type puppyGraphAttribute struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// Reads the PuppyGraph schema of Backend.Schema, a file or an http url. The url is requested with the gremlin
+// credentials of the user as basic authentication.
+func readPuppyGraphSchema(c *gin.Context, config *Config, backend *Backend) (*Schema, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(backend.Schema, "http://") || strings.HasPrefix(backend.Schema, "https://") {
+		data, err = fetchPuppyGraphSchema(c, config, backend)
+	} else {
+		data, err = os.ReadFile(backend.Schema)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the PuppyGraph schema: %v", err)
+	}
+	var puppySchema puppyGraphSchema
+	if err := json.Unmarshal(data, &puppySchema); err != nil {
+		return nil, fmt.Errorf("invalid PuppyGraph schema: %v", err)
+	}
+
+	builder := newSchemaBuilder()
+	for _, vertex := range puppySchema.Vertices {
+		builder.addLabel(ElementVertex, vertex.Label, nil)
+		for _, attribute := range vertex.Attributes {
+			builder.addProperty(ElementVertex, vertex.Label, attribute.Name, attribute.Type)
+		}
+	}
+	for _, edge := range puppySchema.Edges {
+		builder.addLabel(ElementEdge, edge.Label, nil)
+		for _, attribute := range edge.Attributes {
+			builder.addProperty(ElementEdge, edge.Label, attribute.Name, attribute.Type)
+		}
+		builder.connections[SchemaConnection{OutLabel: edge.From, EdgeLabel: edge.Label, InLabel: edge.To}] = true
+	}
+	schema := builder.build()
+	schema.Source = SchemaSourcePuppyGraph
+	return schema, nil
+}
+
+const puppyGraphSchemaTimeout = 30 * time.Second
+
+func fetchPuppyGraphSchema(c *gin.Context, config *Config, backend *Backend) ([]byte, error) {
+	username, password, err := gremlinCredentials(c, config, backend)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, backend.Schema, nil)
+	if err != nil {
+		return nil, err
+	}
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+	client := &http.Client{
+		Timeout: puppyGraphSchemaTimeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: backend.SkipCertVerify},
+		},
+	}
+	defer client.CloseIdleConnections()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,169 @@
+package lib
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+)
+
+var ErrSessionEnded = errors.New("session expired or logged out, log in again")
+
+// A session is a login, referenced by the "sid" claim of the JWT. The gremlin password of the user stays on the
+// server, so that it never leaves it in a token, and a session can be revoked before its JWT expires.
+type session struct {
+	username string
+	// Gremlin password of the user, empty without USE_GREMLIN_AUTH.
+	password  string
+	createdAt time.Time
+	expiresAt time.Time
+}
+
+// Sessions are in memory: they end when the server restarts.
+type sessionStore struct {
+	mutex    sync.Mutex
+	sessions map[string]*session
+}
+
+var sessions = &sessionStore{sessions: map[string]*session{}}
+
+// Starts a session for the duration of a JWT. The expired sessions are removed on the way.
+func (s *sessionStore) create(username string, password string, timeout time.Duration) (string, error) {
+	id, err := randomString()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for expiredID, expired := range s.sessions {
+		if now.After(expired.expiresAt) {
+			delete(s.sessions, expiredID)
+		}
+	}
+	s.sessions[id] = &session{username: username, password: password, createdAt: now, expiresAt: now.Add(timeout)}
+	return id, nil
+}
+
+func (s *sessionStore) get(id string) (session, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	found, ok := s.sessions[id]
+	if !ok || time.Now().After(found.expiresAt) {
+		return session{}, false
+	}
+	return *found, true
+}
+
+// Extends a live session for the duration of a new JWT, up to the maximum lifetime of the session since its login.
+// Returns when the session expires.
+func (s *sessionStore) extend(id string, timeout time.Duration, maxLifetime time.Duration) (time.Time, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	found, ok := s.sessions[id]
+	if !ok || now.After(found.expiresAt) {
+		return time.Time{}, false
+	}
+	deadline := found.createdAt.Add(maxLifetime)
+	if !now.Before(deadline) {
+		delete(s.sessions, id)
+		return time.Time{}, false
+	}
+	found.expiresAt = now.Add(timeout)
+	if found.expiresAt.After(deadline) {
+		found.expiresAt = deadline
+	}
+	return found.expiresAt, true
+}
+
+func (s *sessionStore) revoke(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.sessions, id)
+}
+
+// Ends all the sessions of a user.
+func (s *sessionStore) revokeUser(username string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for id, found := range s.sessions {
+		if found.username == username {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// Returns the session id of the JWT of the request, empty for the requests with an API token.
+func currentSessionID(c *gin.Context) string {
+	id, _ := jwt.ExtractClaims(c)["sid"].(string)
+	return id
+}
+
+// RefreshHandler extends the session of a valid JWT, then returns a new JWT like the refresh handler of the
+// middleware. The user is checked again, and the claims of the new JWT have the current role of the user. A session
+// is not extended past the maximum session lifetime, the user logs in again then.
+func RefreshHandler(mw *jwt.GinJWTMiddleware) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v, exists := c.Get("conf")
+		if !exists {
+			c.JSON(http.StatusInternalServerError, "Cannot load config")
+			return
+		}
+		conf := v.(*Config)
+
+		claims, err := mw.CheckIfTokenExpire(c)
+		if err != nil {
+			mw.Unauthorized(c, http.StatusUnauthorized, mw.HTTPStatusMessageFunc(err, c))
+			return
+		}
+		id, _ := claims["sid"].(string)
+		found, ok := sessions.get(id)
+		if !ok {
+			mw.Unauthorized(c, http.StatusUnauthorized, ErrSessionEnded.Error())
+			return
+		}
+		role, _ := claims["role"].(string)
+		role, err = currentUserRole(c, conf, found.username, role)
+		if err != nil {
+			sessions.revoke(id)
+			mw.Unauthorized(c, http.StatusUnauthorized, ErrSessionEnded.Error())
+			return
+		}
+		expiresAt, ok := sessions.extend(id, mw.Timeout, conf.Authentication.FrontendJWT.MaxSessionLifetime)
+		if !ok {
+			mw.Unauthorized(c, http.StatusUnauthorized, ErrSessionEnded.Error())
+			return
+		}
+		token, _, err := mw.TokenGenerator(&user{Username: found.username, SessionID: id, Role: role})
+		if err != nil {
+			mw.Unauthorized(c, http.StatusUnauthorized, mw.HTTPStatusMessageFunc(jwt.ErrFailedTokenCreation, c))
+			return
+		}
+		setJWTCookie(c, mw, token)
+		mw.RefreshResponse(c, http.StatusOK, token, expiresAt)
+	}
+}
+
+// Sets the JWT cookie like the login handler of the middleware.
+func setJWTCookie(c *gin.Context, mw *jwt.GinJWTMiddleware, token string) {
+	if mw.CookieSameSite != 0 {
+		c.SetSameSite(mw.CookieSameSite)
+	}
+	c.SetCookie(mw.CookieName, token, int(mw.CookieMaxAge.Seconds()), "/", mw.CookieDomain, mw.SecureCookie, mw.CookieHTTPOnly)
+}
+
+// LogoutHandler ends the session of the JWT, which cannot be used anymore, and deletes the cookie.
+func LogoutHandler(mw *jwt.GinJWTMiddleware) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// A JWT which just expired still names its session.
+		if claims, err := mw.CheckIfTokenExpire(c); err == nil {
+			id, _ := claims["sid"].(string)
+			sessions.revoke(id)
+		}
+		mw.LogoutHandler(c)
+	}
+}
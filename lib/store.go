@@ -0,0 +1,391 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrSavedQueryNotFound = errors.New("saved query not found")
+	ErrSavedQueryExists   = errors.New("a saved query with this name already exists")
+)
+
+// HistoryEntry is one query submitted by a user.
+type HistoryEntry struct {
+	ID          string                     `json:"id"`
+	RequestID   string                     `json:"requestId,omitempty"`
+	Query       string                     `json:"query"`
+	Bindings    map[string]json.RawMessage `json:"bindings,omitempty"`
+	Backend     string                     `json:"backend,omitempty"`
+	SubmittedAt time.Time                  `json:"submittedAt"`
+	DurationMs  int64                      `json:"durationMs"`
+	ResultCount int                        `json:"resultCount"`
+	Error       string                     `json:"error,omitempty"`
+}
+
+// SavedQuery is a named query. Saved queries are visible to every user, only the owner can change them.
+type SavedQuery struct {
+	ID          string                     `json:"id"`
+	Owner       string                     `json:"owner"`
+	Name        string                     `json:"name"`
+	Description string                     `json:"description"`
+	Query       string                     `json:"query"`
+	Bindings    map[string]json.RawMessage `json:"bindings,omitempty"`
+	Backend     string                     `json:"backend,omitempty"`
+	Tags        []string                   `json:"tags"`
+	CreatedAt   time.Time                  `json:"createdAt"`
+	UpdatedAt   time.Time                  `json:"updatedAt"`
+}
+
+// SavedQueryFilter selects saved queries. Empty fields match everything.
+type SavedQueryFilter struct {
+	// Case-insensitive substring of the name, description or query.
+	Text  string
+	Owner string
+	// Queries must have all the tags.
+	Tags []string
+}
+
+// Store persists the query history, saved queries and API tokens as files under the storage directory.
+// The history of a user is an append-only JSON lines file, the saved queries and the API tokens are single JSON files.
+type Store struct {
+	dir          string
+	historyLimit int
+
+	mutex sync.Mutex
+	// Number of lines in the history file by username, loaded on first append.
+	historyCount map[string]int
+	savedQueries []*SavedQuery
+	apiTokens    []*storedAPIToken
+}
+
+func OpenStore(config StorageConfig) (*Store, error) {
+	if err := os.MkdirAll(filepath.Join(config.Dir, "history"), 0o700); err != nil {
+		return nil, fmt.Errorf("unable to create storage directory: %v", err)
+	}
+	store := &Store{
+		dir:          config.Dir,
+		historyLimit: config.HistoryLimit,
+		historyCount: map[string]int{},
+	}
+	data, err := os.ReadFile(store.savedQueriesPath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &store.savedQueries); err != nil {
+			return nil, fmt.Errorf("unable to load saved queries: %v", err)
+		}
+	}
+	data, err = os.ReadFile(store.apiTokensPath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err := store.loadAPITokens(data); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *Store) savedQueriesPath() string {
+	return filepath.Join(s.dir, "saved_queries.json")
+}
+
+// Usernames are encoded so that any username is a safe file name.
+func (s *Store) historyPath(username string) string {
+	return filepath.Join(s.dir, "history", "u_"+base64.RawURLEncoding.EncodeToString([]byte(username))+".jsonl")
+}
+
+// AppendHistory records a query of the user. The oldest entries are dropped once the file has grown to twice the
+// history limit, so that the file is not rewritten on every query.
+func (s *Store) AppendHistory(username string, entry HistoryEntry) error {
+	if entry.ID == "" {
+		entry.ID = uuid.NewString()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	path := s.historyPath(username)
+	count, ok := s.historyCount[username]
+	if !ok {
+		entries, err := readHistory(path)
+		if err != nil {
+			return err
+		}
+		count = len(entries)
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	count++
+
+	if s.historyLimit > 0 && count > 2*s.historyLimit {
+		entries, err := readHistory(path)
+		if err != nil {
+			return err
+		}
+		if len(entries) > s.historyLimit {
+			entries = entries[len(entries)-s.historyLimit:]
+		}
+		if err := writeHistory(path, entries); err != nil {
+			return err
+		}
+		count = len(entries)
+	}
+	s.historyCount[username] = count
+	return nil
+}
+
+// History returns the entries of the user matching text, newest first.
+func (s *Store) History(username string, text string, offset int, limit int) ([]HistoryEntry, error) {
+	s.mutex.Lock()
+	entries, err := readHistory(s.historyPath(username))
+	s.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	text = strings.ToLower(text)
+	result := []HistoryEntry{}
+	for i := len(entries) - 1; i >= 0 && (limit <= 0 || len(result) < limit); i-- {
+		if text != "" && !strings.Contains(strings.ToLower(entries[i].Query), text) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		result = append(result, entries[i])
+	}
+	return result, nil
+}
+
+// ClearHistory removes all the history entries of the user.
+func (s *Store) ClearHistory(username string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := os.Remove(s.historyPath(username)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	s.historyCount[username] = 0
+	return nil
+}
+
+func readHistory(path string) ([]HistoryEntry, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []HistoryEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry HistoryEntry
+		// Skip a line truncated by a crash instead of losing the whole history.
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+func writeHistory(path string, entries []HistoryEntry) error {
+	var builder strings.Builder
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		builder.Write(line)
+		builder.WriteByte('\n')
+	}
+	return writeFileAtomic(path, []byte(builder.String()))
+}
+
+// Writes to a temporary file first, so that a crash never leaves a partially written file behind.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// SavedQueries returns the saved queries matching the filter, sorted by name.
+func (s *Store) SavedQueries(filter SavedQueryFilter) []SavedQuery {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	text := strings.ToLower(filter.Text)
+	result := []SavedQuery{}
+	for _, query := range s.savedQueries {
+		if filter.Owner != "" && query.Owner != filter.Owner {
+			continue
+		}
+		if text != "" &&
+			!strings.Contains(strings.ToLower(query.Name), text) &&
+			!strings.Contains(strings.ToLower(query.Description), text) &&
+			!strings.Contains(strings.ToLower(query.Query), text) {
+			continue
+		}
+		if !hasTags(query.Tags, filter.Tags) {
+			continue
+		}
+		result = append(result, *query)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return strings.ToLower(result[i].Name) < strings.ToLower(result[j].Name)
+	})
+	return result
+}
+
+func hasTags(tags []string, required []string) bool {
+	for _, r := range required {
+		found := false
+		for _, tag := range tags {
+			if strings.EqualFold(tag, r) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Store) SavedQuery(id string) (SavedQuery, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, query := range s.savedQueries {
+		if query.ID == id {
+			return *query, nil
+		}
+	}
+	return SavedQuery{}, ErrSavedQueryNotFound
+}
+
+// CreateSavedQuery stores a new query owned by the user. Names are unique per owner.
+func (s *Store) CreateSavedQuery(username string, query SavedQuery) (SavedQuery, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.nameTaken(username, query.Name, "") {
+		return SavedQuery{}, ErrSavedQueryExists
+	}
+	now := time.Now().UTC()
+	query.ID = uuid.NewString()
+	query.Owner = username
+	query.CreatedAt = now
+	query.UpdatedAt = now
+	if query.Tags == nil {
+		query.Tags = []string{}
+	}
+	s.savedQueries = append(s.savedQueries, &query)
+	if err := s.persistSavedQueries(); err != nil {
+		s.savedQueries = s.savedQueries[:len(s.savedQueries)-1]
+		return SavedQuery{}, err
+	}
+	return query, nil
+}
+
+// UpdateSavedQuery replaces the name, description, query, bindings, backend and tags of a query owned by the user.
+func (s *Store) UpdateSavedQuery(username string, id string, update SavedQuery) (SavedQuery, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, query := range s.savedQueries {
+		if query.ID != id || query.Owner != username {
+			continue
+		}
+		if s.nameTaken(username, update.Name, id) {
+			return SavedQuery{}, ErrSavedQueryExists
+		}
+		previous := *query
+		query.Name = update.Name
+		query.Description = update.Description
+		query.Query = update.Query
+		query.Bindings = update.Bindings
+		query.Backend = update.Backend
+		query.Tags = update.Tags
+		if query.Tags == nil {
+			query.Tags = []string{}
+		}
+		query.UpdatedAt = time.Now().UTC()
+		if err := s.persistSavedQueries(); err != nil {
+			*query = previous
+			return SavedQuery{}, err
+		}
+		return *query, nil
+	}
+	return SavedQuery{}, ErrSavedQueryNotFound
+}
+
+// DeleteSavedQuery removes a query owned by the user.
+func (s *Store) DeleteSavedQuery(username string, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, query := range s.savedQueries {
+		if query.ID != id || query.Owner != username {
+			continue
+		}
+		previous := s.savedQueries
+		s.savedQueries = append(append([]*SavedQuery{}, previous[:i]...), previous[i+1:]...)
+		if err := s.persistSavedQueries(); err != nil {
+			s.savedQueries = previous
+			return err
+		}
+		return nil
+	}
+	return ErrSavedQueryNotFound
+}
+
+func (s *Store) nameTaken(username string, name string, exceptID string) bool {
+	for _, query := range s.savedQueries {
+		if query.Owner == username && query.ID != exceptID && strings.EqualFold(query.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Store) persistSavedQueries() error {
+	data, err := json.MarshalIndent(s.savedQueries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.savedQueriesPath(), data)
+}
@@ -0,0 +1,175 @@
+package lib
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Client certificate modes of TLSConfig.ClientAuth. With optional, a certificate sent by the client must be valid.
+const (
+	ClientAuthNone     = "none"
+	ClientAuthOptional = "optional"
+	ClientAuthRequire  = "require"
+)
+
+// TLSConfig serves the UI over HTTPS, enabled when the certificate is set. The files are read again when they change.
+type TLSConfig struct {
+	// PEM certificate chain and private key of the server.
+	CertFile string `yaml:"certFile" envconfig:"TLS_CERT_FILE" default:""`
+	KeyFile  string `yaml:"keyFile" envconfig:"TLS_KEY_FILE" default:""`
+	// How often the files are checked for changes. Zero disables the reload.
+	ReloadInterval time.Duration `yaml:"reloadInterval" envconfig:"TLS_RELOAD_INTERVAL" default:"1m"`
+	// Client certificates: none, optional or require. A valid certificate logs the user in, see ClientRoles.
+	ClientAuth string `yaml:"clientAuth" envconfig:"TLS_CLIENT_AUTH" default:"none"`
+	// PEM certificates of the authorities of the client certificates.
+	ClientCAFile string `yaml:"clientCAFile" envconfig:"TLS_CLIENT_CA_FILE" default:""`
+	// Roles of the client certificate users by common name, e.g. alice:admin,bob:reader. The users of the users file
+	// have their role in the file.
+	ClientRoles map[string]string `yaml:"clientRoles" envconfig:"TLS_CLIENT_ROLES" default:""`
+	// Role of the client certificate users without a role. Empty refuses them.
+	ClientDefaultRole string `yaml:"clientDefaultRole" envconfig:"TLS_CLIENT_DEFAULT_ROLE" default:"reader"`
+}
+
+// Enabled tells whether the UI is served over HTTPS.
+func (config *TLSConfig) Enabled() bool {
+	return config.CertFile != ""
+}
+
+// Builds the TLS config of the server from the files.
+func (config *TLSConfig) load() (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load TLS certificate: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{certificate},
+	}
+	switch config.ClientAuth {
+	case ClientAuthOptional:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return tlsConfig, nil
+	}
+	data, err := os.ReadFile(config.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read client CA file: %v", err)
+	}
+	tlsConfig.ClientCAs = x509.NewCertPool()
+	if !tlsConfig.ClientCAs.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate in client CA file %s", config.ClientCAFile)
+	}
+	return tlsConfig, nil
+}
+
+// Modification times of the files of the config.
+func (config *TLSConfig) modTimes() []time.Time {
+	var times []time.Time
+	for _, path := range []string{config.CertFile, config.KeyFile, config.ClientCAFile} {
+		var modTime time.Time
+		if info, err := os.Stat(path); err == nil {
+			modTime = info.ModTime()
+		}
+		times = append(times, modTime)
+	}
+	return times
+}
+
+func sameTimes(a []time.Time, b []time.Time) bool {
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// WatchTLS loads the TLS config of the server and polls its files. A renewed certificate is used by the next
+// connections, an invalid one is logged and the current one is kept.
+func WatchTLS(config TLSConfig) (*tls.Config, error) {
+	loaded, err := config.load()
+	if err != nil {
+		return nil, err
+	}
+	var current atomic.Pointer[tls.Config]
+	current.Store(loaded)
+	if config.ReloadInterval > 0 {
+		modTimes := config.modTimes()
+		go func() {
+			ticker := time.NewTicker(config.ReloadInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				times := config.modTimes()
+				if sameTimes(times, modTimes) {
+					continue
+				}
+				modTimes = times
+				loaded, err := config.load()
+				if err != nil {
+					logrus.Errorf("TLS reload failed, keeping the current certificate: %v", err)
+					continue
+				}
+				current.Store(loaded)
+				logrus.Info("TLS certificate reloaded")
+			}
+		}()
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return current.Load(), nil
+		},
+	}, nil
+}
+
+// Returns the verified client certificate of the request, if any.
+func clientCertificate(c *gin.Context) (*x509.Certificate, bool) {
+	if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 || len(c.Request.TLS.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+	return c.Request.TLS.VerifiedChains[0][0], true
+}
+
+// Returns the claims of the user of a client certificate, the common name of its subject.
+func clientCertificateClaims(c *gin.Context, certificate *x509.Certificate) (jwt.MapClaims, error) {
+	v, exists := c.Get("conf")
+	if !exists {
+		return nil, fmt.Errorf("cannot load config")
+	}
+	conf := v.(*Config)
+	username := certificate.Subject.CommonName
+	if username == "" {
+		return nil, fmt.Errorf("client certificate without common name")
+	}
+	if reservedUsername(username) {
+		return nil, fmt.Errorf("the %s prefix of client certificate %s is reserved for the OIDC users", oidcUsernamePrefix, username)
+	}
+
+	role, ok := conf.TLS.ClientRoles[username]
+	if !ok {
+		role = conf.TLS.ClientDefaultRole
+	}
+	if v, exists := c.Get("users"); exists {
+		if user, ok := v.(*UserStore).User(username); ok {
+			if user.Disabled {
+				return nil, ErrUserDisabled
+			}
+			role = user.Role
+		}
+	}
+	if role == "" {
+		return nil, fmt.Errorf("user %s has no role", username)
+	}
+	// Certificate users have no session, the backends with gremlin authentication reject them.
+	return jwt.MapClaims{"username": username, "role": role}, nil
+}
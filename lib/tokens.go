@@ -0,0 +1,245 @@
+package lib
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrAPITokenNotFound = errors.New("API token not found")
+	ErrInvalidAPIToken  = errors.New("invalid API token")
+	ErrAPITokenExpired  = errors.New("API token expired")
+)
+
+// Prefix of the API token secrets, which tells them apart from the JWTs in the Authorization header.
+const apiTokenPrefix = "pgt_"
+
+// The last used time of a token is saved at most once a minute.
+const apiTokenLastUsedPrecision = time.Minute
+
+// APIToken is a personal access token, used as a bearer token by scripts in place of the JWT of /login. The secret
+// is only returned when the token is created, the store keeps its hash.
+type APIToken struct {
+	ID    string `json:"id"`
+	Owner string `json:"owner"`
+	Name  string `json:"name"`
+	// First characters of the secret, to recognize a token.
+	Prefix string `json:"prefix"`
+	// Role of the requests with the token: reader for read-only tokens, the role of the owner otherwise.
+	Role string `json:"role"`
+	// Backends the token can query, all of them when empty.
+	Backends   []string   `json:"backends"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+// Returns when the token expires. The tokens saved before the expiry was added expire a lifetime after their
+// creation.
+func (t *APIToken) expiry(lifetime time.Duration) time.Time {
+	if t.ExpiresAt.IsZero() {
+		return t.CreatedAt.Add(lifetime)
+	}
+	return t.ExpiresAt
+}
+
+type storedAPIToken struct {
+	APIToken
+	// Hex SHA-256 of the secret. The secrets are random, a slow hash is not needed.
+	Hash string `json:"hash"`
+}
+
+func (s *Store) apiTokensPath() string {
+	return filepath.Join(s.dir, "api_tokens.json")
+}
+
+func hashAPIToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// APITokens returns the tokens of the user, newest first.
+func (s *Store) APITokens(username string) []APIToken {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	result := []APIToken{}
+	for _, token := range s.apiTokens {
+		if token.Owner == username {
+			result = append(result, token.APIToken)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].CreatedAt.After(result[j].CreatedAt) })
+	return result
+}
+
+// CreateAPIToken stores a new token of the user, valid for the lifetime, and returns it with its secret.
+func (s *Store) CreateAPIToken(username string, token APIToken, lifetime time.Duration) (APIToken, string, error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return APIToken{}, "", err
+	}
+	secret := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(data)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	token.ID = uuid.NewString()
+	token.Owner = username
+	token.Prefix = secret[:len(apiTokenPrefix)+6]
+	token.CreatedAt = time.Now().UTC()
+	token.ExpiresAt = token.CreatedAt.Add(lifetime)
+	token.LastUsedAt = nil
+	if token.Backends == nil {
+		token.Backends = []string{}
+	}
+	s.apiTokens = append(s.apiTokens, &storedAPIToken{APIToken: token, Hash: hashAPIToken(secret)})
+	if err := s.persistAPITokens(); err != nil {
+		s.apiTokens = s.apiTokens[:len(s.apiTokens)-1]
+		return APIToken{}, "", err
+	}
+	return token, secret, nil
+}
+
+// RevokeAPIToken removes a token of the user.
+func (s *Store) RevokeAPIToken(username string, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, token := range s.apiTokens {
+		if token.ID != id || token.Owner != username {
+			continue
+		}
+		previous := s.apiTokens
+		s.apiTokens = append(append([]*storedAPIToken{}, previous[:i]...), previous[i+1:]...)
+		if err := s.persistAPITokens(); err != nil {
+			s.apiTokens = previous
+			return err
+		}
+		return nil
+	}
+	return ErrAPITokenNotFound
+}
+
+// AuthenticateAPIToken returns the token with this secret and records its use.
+func (s *Store) AuthenticateAPIToken(secret string) (APIToken, error) {
+	hash := hashAPIToken(secret)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, token := range s.apiTokens {
+		if subtle.ConstantTimeCompare([]byte(token.Hash), []byte(hash)) != 1 {
+			continue
+		}
+		now := time.Now().UTC()
+		if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) >= apiTokenLastUsedPrecision {
+			previous := token.LastUsedAt
+			token.LastUsedAt = &now
+			// The request is not failed because of the last used time.
+			if err := s.persistAPITokens(); err != nil {
+				logrus.Warnf("unable to record the use of API token %s: %v", token.ID, err)
+				token.LastUsedAt = previous
+			}
+		}
+		return token.APIToken, nil
+	}
+	return APIToken{}, ErrInvalidAPIToken
+}
+
+func (s *Store) loadAPITokens(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, &s.apiTokens); err != nil {
+		return fmt.Errorf("unable to load API tokens: %v", err)
+	}
+	return nil
+}
+
+func (s *Store) persistAPITokens() error {
+	data, err := json.MarshalIndent(s.apiTokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.apiTokensPath(), data)
+}
+
+// Returns the secret of the Authorization header when it is an API token.
+func apiTokenSecret(c *gin.Context) (string, bool) {
+	secret, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || !strings.HasPrefix(secret, apiTokenPrefix) {
+		return "", false
+	}
+	return strings.TrimSpace(secret), true
+}
+
+func apiTokenClaims(c *gin.Context, secret string) (jwt.MapClaims, error) {
+	v, exists := c.Get("conf")
+	if !exists {
+		return nil, fmt.Errorf("cannot load config")
+	}
+	conf := v.(*Config)
+	v, exists = c.Get("store")
+	if !exists {
+		return nil, fmt.Errorf("cannot load store")
+	}
+	token, err := v.(*Store).AuthenticateAPIToken(secret)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(token.expiry(conf.Authentication.APITokenLifetime)) {
+		return nil, ErrAPITokenExpired
+	}
+
+	// Tokens follow the changes of their owner, except the tokens of the OIDC users, whose role is only known at login.
+	role, err := currentUserRole(c, conf, token.Owner, token.Role)
+	if err != nil {
+		return nil, err
+	}
+	if token.Role == RoleReader {
+		role = RoleReader
+	}
+	// Tokens have no session, the backends with gremlin authentication reject them.
+	return jwt.MapClaims{
+		"username": token.Owner,
+		"role":     role,
+		"tokenId":  token.ID,
+		"backends": token.Backends,
+	}, nil
+}
+
+// CurrentAPIToken returns the id of the API token of the request, empty for the requests with a JWT.
+func CurrentAPIToken(c *gin.Context) string {
+	id, _ := jwt.ExtractClaims(c)["tokenId"].(string)
+	return id
+}
+
+// CheckBackendAccess rejects the backends outside of the backends of the API token of the request.
+func CheckBackendAccess(c *gin.Context, backend *Backend) error {
+	backends, ok := jwt.ExtractClaims(c)["backends"].([]string)
+	if !ok || len(backends) == 0 {
+		return nil
+	}
+	for _, name := range backends {
+		if name == backend.Name {
+			return nil
+		}
+	}
+	return &QueryError{Status: http.StatusForbidden, Message: fmt.Sprintf("the API token cannot query backend %s", backend.Name)}
+}
@@ -0,0 +1,298 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists   = errors.New("a user with this name already exists")
+	ErrUserDisabled = errors.New("user is disabled")
+	ErrInvalidUser  = errors.New("invalid user")
+)
+
+// Minimum length of the passwords set through the API.
+const minPasswordLength = 8
+
+// LocalUser is a user of the users file. The password is a bcrypt hash, see HashPassword.
+type LocalUser struct {
+	Username     string    `yaml:"username" json:"username"`
+	PasswordHash string    `yaml:"passwordHash" json:"-"`
+	Role         string    `yaml:"role" json:"role"`
+	Disabled     bool      `yaml:"disabled,omitempty" json:"disabled"`
+	UpdatedAt    time.Time `yaml:"updatedAt,omitempty" json:"updatedAt"`
+}
+
+type usersFile struct {
+	Users []*LocalUser `yaml:"users"`
+}
+
+// UserStore holds the users of a YAML file. The file can also be edited by hand, it is read again when it changes.
+type UserStore struct {
+	path string
+
+	mutex   sync.Mutex
+	users   []*LocalUser
+	modTime time.Time
+}
+
+// HashPassword returns the bcrypt hash of a password, in the format of the users file.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// OpenUserStore loads the users file. A missing file is created with the admin user of the config and a random
+// password, which is only printed in the log of this start.
+func OpenUserStore(path string, admin LocalUser) (*UserStore, error) {
+	store := &UserStore{path: path}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, fmt.Errorf("unable to create users directory: %v", err)
+		}
+		password, err := randomString()
+		if err != nil {
+			return nil, err
+		}
+		admin.PasswordHash, err = HashPassword(password)
+		if err != nil {
+			return nil, err
+		}
+		admin.UpdatedAt = time.Now().UTC()
+		store.users = []*LocalUser{&admin}
+		if err := store.persist(); err != nil {
+			return nil, err
+		}
+		logrus.Warnf("created the users file %s with the user %s and the password %s, change it after the first login", path, admin.Username, password)
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if err := store.refresh(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Reads the file again when it changed since it was loaded.
+func (s *UserStore) refresh() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var file usersFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("invalid users file %s: %v", s.path, err)
+	}
+	seen := map[string]bool{}
+	for _, user := range file.Users {
+		if user.Username == "" || seen[user.Username] {
+			return fmt.Errorf("invalid users file %s: missing or duplicate username %q", s.path, user.Username)
+		}
+		seen[user.Username] = true
+		if reservedUsername(user.Username) {
+			return fmt.Errorf("invalid users file %s: the %s prefix of user %s is reserved for the OIDC users", s.path, oidcUsernamePrefix, user.Username)
+		}
+		if !validRole(user.Role) {
+			return fmt.Errorf("invalid users file %s: unknown role %q of user %s", s.path, user.Role, user.Username)
+		}
+		if _, err := bcrypt.Cost([]byte(user.PasswordHash)); err != nil {
+			return fmt.Errorf("invalid users file %s: password of user %s is not a bcrypt hash", s.path, user.Username)
+		}
+	}
+	s.users = file.Users
+	s.modTime = info.ModTime()
+	return nil
+}
+
+func (s *UserStore) persist() error {
+	data, err := yaml.Marshal(usersFile{Users: s.users})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, data); err != nil {
+		return err
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// Returns the user, after reading the file again when it changed. An invalid file keeps the current users.
+func (s *UserStore) find(username string) *LocalUser {
+	if err := s.refresh(); err != nil {
+		logrus.Errorf("users file reload failed, keeping the current users: %v", err)
+	}
+	for _, user := range s.users {
+		if user.Username == username {
+			return user
+		}
+	}
+	return nil
+}
+
+// A hash compared when the user does not exist, so that unknown users take as long as wrong passwords.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// Authenticate returns the user with this password.
+func (s *UserStore) Authenticate(username string, password string) (LocalUser, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user := s.find(username)
+	if user == nil {
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return LocalUser{}, jwt.ErrFailedAuthentication
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return LocalUser{}, jwt.ErrFailedAuthentication
+	}
+	if user.Disabled {
+		return LocalUser{}, ErrUserDisabled
+	}
+	return *user, nil
+}
+
+// Users returns all the users, sorted by username.
+func (s *UserStore) Users() []LocalUser {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.refresh(); err != nil {
+		logrus.Errorf("users file reload failed, keeping the current users: %v", err)
+	}
+	users := make([]LocalUser, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, *user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users
+}
+
+// User returns the user with this username.
+func (s *UserStore) User(username string) (LocalUser, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user := s.find(username)
+	if user == nil {
+		return LocalUser{}, false
+	}
+	return *user, true
+}
+
+func checkPassword(password string) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("%w: password must have at least %d characters", ErrInvalidUser, minPasswordLength)
+	}
+	return nil
+}
+
+// CreateUser adds an enabled user.
+func (s *UserStore) CreateUser(username string, password string, role string) (LocalUser, error) {
+	if username == "" {
+		return LocalUser{}, fmt.Errorf("%w: missing username", ErrInvalidUser)
+	}
+	if reservedUsername(username) {
+		return LocalUser{}, fmt.Errorf("%w: the %s prefix is reserved for the OIDC users", ErrInvalidUser, oidcUsernamePrefix)
+	}
+	if !validRole(role) {
+		return LocalUser{}, fmt.Errorf("%w: unknown role %q", ErrInvalidUser, role)
+	}
+	if err := checkPassword(password); err != nil {
+		return LocalUser{}, err
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return LocalUser{}, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.find(username) != nil {
+		return LocalUser{}, ErrUserExists
+	}
+	user := &LocalUser{Username: username, PasswordHash: hash, Role: role, UpdatedAt: time.Now().UTC()}
+	s.users = append(s.users, user)
+	if err := s.persist(); err != nil {
+		s.users = s.users[:len(s.users)-1]
+		return LocalUser{}, err
+	}
+	return *user, nil
+}
+
+// UpdateUser changes the role of a user, or disables or enables it. Nil values are left unchanged. The sessions of a
+// user who is demoted or disabled end.
+func (s *UserStore) UpdateUser(username string, role *string, disabled *bool) (LocalUser, error) {
+	if role != nil && !validRole(*role) {
+		return LocalUser{}, fmt.Errorf("%w: unknown role %q", ErrInvalidUser, *role)
+	}
+	revoke := false
+	user, err := s.update(username, func(user *LocalUser) {
+		if role != nil {
+			revoke = revoke || user.Role != *role
+			user.Role = *role
+		}
+		if disabled != nil {
+			revoke = revoke || *disabled
+			user.Disabled = *disabled
+		}
+	})
+	if err == nil && revoke {
+		sessions.revokeUser(username)
+	}
+	return user, err
+}
+
+// ResetPassword replaces the password of a user, and ends the sessions of the user.
+func (s *UserStore) ResetPassword(username string, password string) (LocalUser, error) {
+	if err := checkPassword(password); err != nil {
+		return LocalUser{}, err
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return LocalUser{}, err
+	}
+	user, err := s.update(username, func(user *LocalUser) {
+		user.PasswordHash = hash
+	})
+	if err == nil {
+		sessions.revokeUser(username)
+	}
+	return user, err
+}
+
+func (s *UserStore) update(username string, change func(user *LocalUser)) (LocalUser, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user := s.find(username)
+	if user == nil {
+		return LocalUser{}, ErrUserNotFound
+	}
+	previous := *user
+	change(user)
+	user.UpdatedAt = time.Now().UTC()
+	if err := s.persist(); err != nil {
+		*user = previous
+		return LocalUser{}, err
+	}
+	return *user, nil
+}